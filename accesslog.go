@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//AccessLog configures the log of the requests proxied for a host. Output is
+// "stdout", "file", "syslog" or "off"; requests are not logged when it is left
+// blank. Format is one of "common" (default), "combined", "json" or
+// "template", which renders the text/template Template for every request.
+// Files are written to File and rotated once they grow past MaxSize megabytes
+// or every RotateInterval seconds, keeping MaxBackups of the rotated ones, all
+// of them at 0. Syslog goes to the local daemon unless SyslogAddr names one
+// as "udp://host:514" or "tcp://host:514".
+type AccessLog struct {
+	Output         string
+	Format         string
+	Template       string
+	File           string
+	MaxSize        uint
+	RotateInterval uint
+	MaxBackups     uint
+	SyslogAddr     string
+}
+
+//outputs and formats supported by AccessLog
+const (
+	accessLogStdout   = "stdout"
+	accessLogFile     = "file"
+	accessLogSyslog   = "syslog"
+	accessLogOff      = "off"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+	accessLogTemplate = "template"
+)
+
+//clfTimeLayout is the time layout of the Common Log Format
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+//backupTimeLayout suffixes the files rotated out of the way. It sorts in the
+// order the files were rotated in.
+const backupTimeLayout = "20060102T150405.000000000"
+
+//resolveAccessLog returns the AccessLog of a host, the one of the routes file
+// unless the host sets an Output of its own
+func resolveAccessLog(global, host AccessLog) AccessLog {
+	if host.Output != "" {
+		return host
+	}
+	return global
+}
+
+//validateAccessLog checks config for settings an access log cannot be
+// written with. Nothing is opened here.
+func validateAccessLog(config AccessLog) error {
+	switch config.Output {
+	case "", accessLogOff, accessLogStdout:
+	case accessLogFile:
+		if config.File == "" {
+			return fmt.Errorf("AccessLog output \"file\" needs a File")
+		}
+	case accessLogSyslog:
+		if _, _, addrErr := parseSyslogAddr(config.SyslogAddr); addrErr != nil {
+			return addrErr
+		}
+	default:
+		return fmt.Errorf("Unknown AccessLog output %#v", config.Output)
+	}
+	_, formatErr := parseAccessLogFormat(config)
+	return formatErr
+}
+
+//parseAccessLogFormat returns the template of a "template" formatted access
+// log, nil for the other formats
+func parseAccessLogFormat(config AccessLog) (*template.Template, error) {
+	switch config.Format {
+	case "", accessLogCommon, accessLogCombined, accessLogJSON:
+		return nil, nil
+	case accessLogTemplate:
+		if config.Template == "" {
+			return nil, fmt.Errorf("AccessLog format \"template\" needs a Template")
+		}
+		logTemplate, parseErr := template.New("accessLog").Parse(config.Template)
+		if parseErr != nil {
+			return nil, fmt.Errorf("AccessLog template failed to parse: %v", parseErr)
+		}
+		return logTemplate, nil
+	default:
+		return nil, fmt.Errorf("Unknown AccessLog format %#v", config.Format)
+	}
+}
+
+//parseSyslogAddr splits a "udp://host:514" syslog address into its network
+// and address. Both are blank for the local daemon.
+func parseSyslogAddr(addr string) (string, string, error) {
+	if addr == "" {
+		return "", "", nil
+	}
+	parsed, parseErr := url.Parse(addr)
+	if parseErr != nil || parsed.Host == "" ||
+		(parsed.Scheme != "udp" && parsed.Scheme != "tcp") {
+		return "", "", fmt.Errorf("SyslogAddr %#v is not of the form udp://host:port or "+
+			"tcp://host:port", addr)
+	}
+	return parsed.Scheme, parsed.Host, nil
+}
+
+//accessLogEntry is what an access log line is rendered from. Latencies are in
+// seconds.
+type accessLogEntry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Host            string    `json:"host"`
+	SNI             string    `json:"sni,omitempty"`
+	TLSVersion      string    `json:"tls_version,omitempty"`
+	Method          string    `json:"method"`
+	URI             string    `json:"uri"`
+	Proto           string    `json:"proto"`
+	Route           string    `json:"route"`
+	Upstream        string    `json:"upstream,omitempty"`
+	UpstreamLatency float64   `json:"upstream_latency"`
+	Duration        float64   `json:"duration"`
+	Status          int       `json:"status"`
+	BytesSent       int64     `json:"bytes_sent"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+//newAccessLogEntry describes r, answered through recorder as of start and
+// noted in record
+func newAccessLogEntry(r *http.Request, record *requestRecord, recorder *statusRecorder,
+	start time.Time) *accessLogEntry {
+	entry := &accessLogEntry{
+		Time:            start,
+		RequestID:       record.requestID,
+		RemoteAddr:      r.RemoteAddr,
+		Host:            r.Host,
+		Method:          r.Method,
+		URI:             r.RequestURI,
+		Proto:           r.Proto,
+		Route:           record.route,
+		Upstream:        record.upstream,
+		UpstreamLatency: record.upstreamLatency.Seconds(),
+		Duration:        time.Since(start).Seconds(),
+		Status:          recorder.statusCode(),
+		BytesSent:       recorder.written,
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+	}
+	if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+		entry.RemoteAddr = host
+	}
+	if r.TLS != nil {
+		entry.SNI = r.TLS.ServerName
+		entry.TLSVersion = tlsVersionNames[r.TLS.Version]
+	}
+	return entry
+}
+
+//commonLogLine renders entry in the Common Log Format
+func (entry *accessLogEntry) commonLogLine() string {
+	bytesSent := "-"
+	if entry.BytesSent > 0 {
+		bytesSent = strconv.FormatInt(entry.BytesSent, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s", entry.RemoteAddr,
+		entry.Time.Format(clfTimeLayout),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto), entry.Status, bytesSent)
+}
+
+//combinedLogLine renders entry in the Combined Log Format
+func (entry *accessLogEntry) combinedLogLine() string {
+	quote := func(value string) string {
+		if value == "" {
+			return "\"-\""
+		}
+		return strconv.Quote(value)
+	}
+	return entry.commonLogLine() + " " + quote(entry.Referer) + " " + quote(entry.UserAgent)
+}
+
+//accessLogger writes the access log of a host in its format. A nil logger
+// logs nothing.
+type accessLogger struct {
+	format   string
+	template *template.Template
+	sink     io.Writer
+}
+
+//newAccessLogger opens the access log config asks for. It returns nil if
+// requests are not to be logged.
+func newAccessLogger(config AccessLog) (*accessLogger, error) {
+	if config.Output == "" || config.Output == accessLogOff {
+		return nil, nil
+	}
+	logTemplate, formatErr := parseAccessLogFormat(config)
+	if formatErr != nil {
+		return nil, formatErr
+	}
+	sink, sinkErr := openAccessLogSink(config)
+	if sinkErr != nil {
+		return nil, sinkErr
+	}
+	format := config.Format
+	if format == "" {
+		format = accessLogCommon
+	}
+	return &accessLogger{format: format, template: logTemplate, sink: sink}, nil
+}
+
+//log writes entry as a line of the access log
+func (logger *accessLogger) log(entry *accessLogEntry) {
+	if logger == nil {
+		return
+	}
+	var line bytes.Buffer
+	switch logger.format {
+	case accessLogCombined:
+		line.WriteString(entry.combinedLogLine())
+	case accessLogJSON:
+		encoded, _ := json.Marshal(entry)
+		line.Write(encoded)
+	case accessLogTemplate:
+		if renderErr := logger.template.Execute(&line, entry); renderErr != nil {
+			log.Printf("Access log template failed to render for request %s: %v",
+				entry.RequestID, renderErr)
+			return
+		}
+	default:
+		line.WriteString(entry.commonLogLine())
+	}
+	if !bytes.HasSuffix(line.Bytes(), []byte("\n")) {
+		line.WriteByte('\n')
+	}
+	if _, writeErr := logger.sink.Write(line.Bytes()); writeErr != nil {
+		log.Printf("Access log could not be written for request %s: %v", entry.RequestID,
+			writeErr)
+	}
+}
+
+//accessLogSinks are the destinations access logs are written to by their
+// name. Hosts logging to the same destination share it and it is kept open
+// across route reloads until Silly shuts down.
+var accessLogSinks = struct {
+	mutex sync.Mutex
+	sinks map[string]io.WriteCloser
+}{sinks: make(map[string]io.WriteCloser)}
+
+//openAccessLogSink returns the destination of config, opening it if no other
+// host has. A file already open takes on the rotation settings of config.
+func openAccessLogSink(config AccessLog) (io.Writer, error) {
+	var name string
+	switch config.Output {
+	case accessLogStdout:
+		name = accessLogStdout
+	case accessLogFile:
+		path, absErr := filepath.Abs(config.File)
+		if absErr != nil {
+			return nil, absErr
+		}
+		config.File = path
+		name = accessLogFile + ":" + path
+	case accessLogSyslog:
+		name = accessLogSyslog + ":" + config.SyslogAddr
+	default:
+		return nil, fmt.Errorf("Unknown AccessLog output %#v", config.Output)
+	}
+	accessLogSinks.mutex.Lock()
+	defer accessLogSinks.mutex.Unlock()
+	if sink, exists := accessLogSinks.sinks[name]; exists {
+		if file, isFile := sink.(*rotatingFile); isFile {
+			file.configure(int64(config.MaxSize)<<20,
+				time.Duration(config.RotateInterval)*time.Second, int(config.MaxBackups))
+		}
+		return sink, nil
+	}
+	var sink io.WriteCloser
+	switch config.Output {
+	case accessLogStdout:
+		sink = &lockedWriter{writer: os.Stdout}
+	case accessLogFile:
+		sink = newRotatingFile(config.File, int64(config.MaxSize)<<20,
+			time.Duration(config.RotateInterval)*time.Second, int(config.MaxBackups))
+	case accessLogSyslog:
+		network, addr, addrErr := parseSyslogAddr(config.SyslogAddr)
+		if addrErr != nil {
+			return nil, addrErr
+		}
+		var dialErr error
+		if sink, dialErr = dialSyslog(network, addr); dialErr != nil {
+			return nil, fmt.Errorf("Syslog could not be reached: %v", dialErr)
+		}
+	}
+	accessLogSinks.sinks[name] = sink
+	return sink, nil
+}
+
+//closeAccessLogs closes every access log destination. Ones asked for later
+// are opened afresh.
+func closeAccessLogs() {
+	accessLogSinks.mutex.Lock()
+	defer accessLogSinks.mutex.Unlock()
+	for name, sink := range accessLogSinks.sinks {
+		if closeErr := sink.Close(); closeErr != nil {
+			log.Printf("Access log %s could not be closed: %v", name, closeErr)
+		}
+		delete(accessLogSinks.sinks, name)
+	}
+}
+
+//lockedWriter serialises the lines written to writer. Closing it leaves the
+// writer open.
+type lockedWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (locked *lockedWriter) Write(p []byte) (int, error) {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.writer.Write(p)
+}
+
+func (locked *lockedWriter) Close() error {
+	return nil
+}
+
+//rotatingFile is an access log file that is renamed out of the way, suffixed
+// with the time it happened at, once it would grow past maxSize bytes or has
+// been written to for interval. Either is left alone at 0. Only the latest
+// maxBackups of the rotated files are kept, all of them at 0. The file is
+// opened on the first write.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, interval time.Duration,
+	maxBackups int) *rotatingFile {
+	return &rotatingFile{path: path, maxSize: maxSize, interval: interval,
+		maxBackups: maxBackups}
+}
+
+//configure replaces the rotation settings of the file
+func (file *rotatingFile) configure(maxSize int64, interval time.Duration, maxBackups int) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.maxSize, file.interval, file.maxBackups = maxSize, interval, maxBackups
+}
+
+func (file *rotatingFile) Write(p []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	now := time.Now()
+	if file.file != nil && file.size > 0 &&
+		((file.maxSize > 0 && file.size+int64(len(p)) > file.maxSize) ||
+			(file.interval > 0 && now.Sub(file.opened) >= file.interval)) {
+		if rotateErr := file.rotate(now); rotateErr != nil {
+			log.Printf("Access log %s could not be rotated: %v", file.path, rotateErr)
+		}
+	}
+	if file.file == nil {
+		if openErr := file.open(now); openErr != nil {
+			return 0, openErr
+		}
+	}
+	n, writeErr := file.file.Write(p)
+	file.size += int64(n)
+	return n, writeErr
+}
+
+//open opens the file for appending
+func (file *rotatingFile) open(now time.Time) error {
+	if mkdirErr := os.MkdirAll(filepath.Dir(file.path), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	opened, openErr := os.OpenFile(file.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if openErr != nil {
+		return openErr
+	}
+	info, statErr := opened.Stat()
+	if statErr != nil {
+		opened.Close()
+		return statErr
+	}
+	file.file, file.size, file.opened = opened, info.Size(), now
+	return nil
+}
+
+//rotate closes the file, renames it out of the way and prunes the backups.
+// The next write opens a fresh file.
+func (file *rotatingFile) rotate(now time.Time) error {
+	closeErr := file.file.Close()
+	file.file = nil
+	if closeErr != nil {
+		return closeErr
+	}
+	if renameErr := os.Rename(file.path,
+		file.path+"."+now.Format(backupTimeLayout)); renameErr != nil {
+		return renameErr
+	}
+	if file.maxBackups == 0 {
+		return nil
+	}
+	backups := file.backups()
+	for len(backups) > file.maxBackups {
+		if removeErr := os.Remove(backups[0]); removeErr != nil {
+			return removeErr
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+//backups lists the files rotated out of the way, the oldest first
+func (file *rotatingFile) backups() []string {
+	matches, _ := filepath.Glob(file.path + ".*")
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, file.path+".")
+		if _, parseErr := time.Parse(backupTimeLayout, suffix); parseErr == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func (file *rotatingFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.file == nil {
+		return nil
+	}
+	closeErr := file.file.Close()
+	file.file = nil
+	return closeErr
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+//dialSyslog fails as there is no syslog on this platform
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("Syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ChandraNarreddy/sillyproxy/utility"
+	"golang.org/x/crypto/acme"
+)
+
+//ACMEHost has the certificates of a host obtained and renewed through ACME
+// when Enabled is set. KeyTypes lists the kinds of certificates to obtain,
+// "ECDSA" and/or "RSA"; an ECDSA certificate is obtained if left empty.
+type ACMEHost struct {
+	Enabled  bool
+	KeyTypes []string
+}
+
+func (host ACMEHost) withDefaults() ACMEHost {
+	if len(host.KeyTypes) == 0 {
+		host.KeyTypes = []string{"ECDSA"}
+	}
+	return host
+}
+
+func validateACMEHost(hostName string, host ACMEHost) error {
+	if !host.Enabled {
+		return nil
+	}
+	if hostName == "default" || strings.HasPrefix(hostName, "~") ||
+		strings.ContainsAny(hostName, "*:/") {
+		return fmt.Errorf("Certificates for %#v cannot be obtained through ACME", hostName)
+	}
+	for _, keyType := range host.KeyTypes {
+		if keyType != "ECDSA" && keyType != "RSA" {
+			return fmt.Errorf("KeyType %#v is neither \"ECDSA\" nor \"RSA\"", keyType)
+		}
+	}
+	return nil
+}
+
+//ACME challenge types Silly can answer
+const (
+	acmeHTTP01    = "http-01"
+	acmeTLSALPN01 = "tls-alpn-01"
+	//acmeALPNProto is the ALPN protocol ACME servers validating a TLS-ALPN-01
+	// challenge negotiate
+	acmeALPNProto = "acme-tls/1"
+)
+
+//acmeOptions configure the ACME client
+type acmeOptions struct {
+	directoryURL   string
+	email          string
+	accountKeyFile string
+	caBundle       string
+	challenges     []string
+}
+
+//acmeSettings are set off the command line. The ACME client is not started
+// when the directoryURL is left blank.
+var acmeSettings acmeOptions
+
+//parseACMEChallenges parses a comma separated list of challenge types in the
+// order of preference
+func parseACMEChallenges(list string) ([]string, error) {
+	var challenges []string
+	for _, challenge := range strings.Split(list, ",") {
+		challenge = strings.TrimSpace(challenge)
+		switch challenge {
+		case "":
+			continue
+		case acmeHTTP01, acmeTLSALPN01:
+			challenges = append(challenges, challenge)
+		default:
+			return nil, fmt.Errorf("ACME challenge %#v is not supported", challenge)
+		}
+	}
+	return challenges, nil
+}
+
+//acmeCheckInterval is how often the certificates of ACME hosts are checked
+// for renewal. Failed renewals are retried on the next check.
+const acmeCheckInterval = time.Hour
+
+//acmeManager obtains and renews the certificates of the hosts in the current
+// routes that have ACME enabled. Certificates are written to the keystore and
+// the certStore reloaded off it so that they are served without a restart.
+type acmeManager struct {
+	client       *acme.Client
+	email        string
+	challenges   []string
+	pHandler     *proxyHandler
+	store        *certStore
+	pending      *challengeStore
+	keyStoreFile *string
+	keyStorePass []byte
+	registered   bool
+}
+
+//newACMEManager builds the acmeManager for options. The account key is read
+// off options.accountKeyFile, or generated and written there if missing. It
+// is generated afresh on every start if no file is named.
+func newACMEManager(options acmeOptions, pHandler *proxyHandler, store *certStore,
+	pending *challengeStore, keyStoreFile *string, keyStorePass []byte) (*acmeManager, error) {
+	if len(options.challenges) == 0 {
+		return nil, fmt.Errorf("No ACME challenge type is available")
+	}
+	accountKey, keyErr := loadACMEAccountKey(options.accountKeyFile)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if options.caBundle != "" {
+		tlsConfig, tlsErr := newUpstreamTLSConfig(UpstreamTLS{CABundle: options.caBundle}, store)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig,
+			Proxy: http.ProxyFromEnvironment}
+	}
+	return &acmeManager{
+		client: &acme.Client{Key: accountKey, DirectoryURL: options.directoryURL,
+			HTTPClient: httpClient, UserAgent: "SillyProxy"},
+		email:        options.email,
+		challenges:   options.challenges,
+		pHandler:     pHandler,
+		store:        store,
+		pending:      pending,
+		keyStoreFile: keyStoreFile,
+		keyStorePass: keyStorePass,
+	}, nil
+}
+
+//loadACMEAccountKey reads the ACME account key off file, generating it if
+// the file does not exist yet
+func loadACMEAccountKey(file string) (crypto.Signer, error) {
+	if file != "" {
+		keyPEMBlock, readErr := ioutil.ReadFile(file)
+		if readErr == nil {
+			keyDERBlock, _ := pem.Decode(keyPEMBlock)
+			if keyDERBlock == nil {
+				return nil, fmt.Errorf("ACME account key %#v holds no PEM block", file)
+			}
+			key, parseErr := parsePrivateKey(keyDERBlock.Bytes)
+			if parseErr != nil {
+				return nil, fmt.Errorf("ACME account key %#v could not be parsed: %v", file, parseErr)
+			}
+			return key.(crypto.Signer), nil
+		}
+		if !os.IsNotExist(readErr) {
+			return nil, fmt.Errorf("ACME account key %#v could not be read: %v", file, readErr)
+		}
+	}
+	key, keyPEMBlock, generateErr := generateKey("ECDSA")
+	if generateErr != nil {
+		return nil, generateErr
+	}
+	if file == "" {
+		log.Printf("No ACME account key file given, using a new account for this run")
+		return key, nil
+	}
+	if writeErr := ioutil.WriteFile(file, keyPEMBlock, 0600); writeErr != nil {
+		return nil, fmt.Errorf("ACME account key %#v could not be written: %v", file, writeErr)
+	}
+	return key, nil
+}
+
+//generateKey generates a private key of keyType, returning it along with its
+// PEM encoding
+func generateKey(keyType string) (crypto.Signer, []byte, error) {
+	if keyType == "RSA" {
+		key, generateErr := rsa.GenerateKey(rand.Reader, 2048)
+		if generateErr != nil {
+			return nil, nil, generateErr
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+	key, generateErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if generateErr != nil {
+		return nil, nil, generateErr
+	}
+	der, marshalErr := x509.MarshalECPrivateKey(key)
+	if marshalErr != nil {
+		return nil, nil, marshalErr
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+//run renews certificates right away and then every interval until quit
+func (manager *acmeManager) run(quit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			manager.renew(ctx)
+		}()
+		select {
+		case <-quit:
+			cancel()
+			<-done
+			return
+		case <-done:
+		}
+		cancel()
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//renew obtains a certificate for every ACME host and key type that has none
+// in the keystore or one that is due for renewal
+func (manager *acmeManager) renew(ctx context.Context) {
+	renewed := false
+	for host, handler := range manager.pHandler.load().hosts {
+		hostHandler, isHost := handler.(*hostHandler)
+		if !isHost || !hostHandler.acme.Enabled {
+			continue
+		}
+		for _, keyType := range hostHandler.acme.KeyTypes {
+			alias := host + ":" + keyType
+			if !dueForRenewal(manager.store.snapshot(), alias, time.Now()) {
+				continue
+			}
+			if obtainErr := manager.obtain(ctx, host, keyType); obtainErr != nil {
+				log.Printf("ACME certificate for %s could not be obtained: %v", alias, obtainErr)
+				continue
+			}
+			log.Printf("ACME certificate for %s written to the keystore", alias)
+			renewed = true
+		}
+	}
+	if renewed {
+		if loadErr := loadCertMap(manager.keyStoreFile, manager.keyStorePass,
+			manager.store); loadErr != nil {
+			log.Printf("Keystore reload failed with error: %v", loadErr)
+		}
+	}
+}
+
+//dueForRenewal reports whether the certificate under alias is missing or is
+// into the last third of its validity at now
+func dueForRenewal(snapshot *certSnapshot, alias string, now time.Time) bool {
+	if snapshot == nil {
+		return true
+	}
+	cert, exists := snapshot.certs[certKey(alias)]
+	if !exists || len(cert.Certificate) == 0 {
+		return true
+	}
+	leaf, parseErr := x509.ParseCertificate(cert.Certificate[0])
+	if parseErr != nil {
+		return true
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return now.After(leaf.NotAfter.Add(-lifetime / 3))
+}
+
+//register creates the ACME account unless one exists for the account key
+func (manager *acmeManager) register(ctx context.Context) error {
+	if manager.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if manager.email != "" {
+		account.Contact = []string{"mailto:" + manager.email}
+	}
+	_, registerErr := manager.client.Register(ctx, account, acme.AcceptTOS)
+	if registerErr != nil && registerErr != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("ACME account registration failed: %v", registerErr)
+	}
+	manager.registered = true
+	return nil
+}
+
+//obtain orders a certificate of keyType for host and writes it along with its
+// key to the keystore under the alias "host:keyType"
+func (manager *acmeManager) obtain(ctx context.Context, host, keyType string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	if registerErr := manager.register(ctx); registerErr != nil {
+		return registerErr
+	}
+	order, orderErr := manager.client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if orderErr != nil {
+		return fmt.Errorf("Order failed: %v", orderErr)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if authorizeErr := manager.authorize(ctx, host, authzURL); authorizeErr != nil {
+			return authorizeErr
+		}
+	}
+	if order, orderErr = manager.client.WaitOrder(ctx, order.URI); orderErr != nil {
+		return fmt.Errorf("Order did not become ready: %v", orderErr)
+	}
+	key, keyPEMBlock, generateErr := generateKey(keyType)
+	if generateErr != nil {
+		return generateErr
+	}
+	defer zeroBytes(keyPEMBlock)
+	csr, csrErr := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if csrErr != nil {
+		return csrErr
+	}
+	chain, _, finalizeErr := manager.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if finalizeErr != nil {
+		return fmt.Errorf("Order could not be finalized: %v", finalizeErr)
+	}
+	leaf, parseErr := x509.ParseCertificate(chain[0])
+	if parseErr != nil {
+		return fmt.Errorf("Issued certificate could not be parsed: %v", parseErr)
+	}
+	if verifyErr := leaf.VerifyHostname(host); verifyErr != nil {
+		return fmt.Errorf("Issued certificate does not cover the host: %v", verifyErr)
+	}
+	return utility.StoreKeyPair(*manager.keyStoreFile, host+":"+keyType, keyPEMBlock,
+		chain, manager.keyStorePass)
+}
+
+//authorize answers the first challenge of the authorization at authzURL that
+// Silly is set up for and waits for the ACME server to validate it
+func (manager *acmeManager) authorize(ctx context.Context, host, authzURL string) error {
+	authz, authzErr := manager.client.GetAuthorization(ctx, authzURL)
+	if authzErr != nil {
+		return fmt.Errorf("Authorization could not be fetched: %v", authzErr)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, challengeType := range manager.challenges {
+		for _, offered := range authz.Challenges {
+			if offered.Type == challengeType {
+				challenge = offered
+				break
+			}
+		}
+		if challenge != nil {
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("None of the challenges %v is offered for %s", manager.challenges, host)
+	}
+	switch challenge.Type {
+	case acmeHTTP01:
+		keyAuth, keyAuthErr := manager.client.HTTP01ChallengeResponse(challenge.Token)
+		if keyAuthErr != nil {
+			return keyAuthErr
+		}
+		manager.pending.set(challenge.Token, keyAuth)
+		defer manager.pending.remove(challenge.Token)
+	case acmeTLSALPN01:
+		cert, certErr := manager.client.TLSALPN01ChallengeCert(challenge.Token, host)
+		if certErr != nil {
+			return certErr
+		}
+		manager.pending.setCert(host, &cert)
+		defer manager.pending.removeCert(host)
+	}
+	if _, acceptErr := manager.client.Accept(ctx, challenge); acceptErr != nil {
+		return fmt.Errorf("Challenge %s could not be accepted: %v", challenge.Type, acceptErr)
+	}
+	if _, waitErr := manager.client.WaitAuthorization(ctx, authz.URI); waitErr != nil {
+		return fmt.Errorf("Challenge %s failed: %v", challenge.Type, waitErr)
+	}
+	return nil
+}
+
+//alpnChallengeCert returns the TLS-ALPN-01 challenge certificate for the
+// handshake if it comes from an ACME server validating one
+func alpnChallengeCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	if len(helloInfo.SupportedProtos) != 1 || helloInfo.SupportedProtos[0] != acmeALPNProto {
+		return nil, false
+	}
+	return acmeChallenges.getCert(helloInfo.ServerName)
+}
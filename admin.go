@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+//adminBindAddr is the address of the admin listener. The admin listener is
+// not started when it is left blank.
+var adminBindAddr string
+
+//newAdminServer builds the admin listener serving upstream health and the
+// metrics of Silly. It serves over plain HTTP and is meant to be bound to an
+// internal address only.
+func newAdminServer(bindAddr string, pHandler *proxyHandler) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", upstreamsHandler(pHandler))
+	mux.HandleFunc("/metrics", metricsHandler(metrics, certMap))
+	return &http.Server{
+		Addr:         bindAddr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+//upstreamsHandler reports the health of every upstream of the current routes
+func upstreamsHandler(pHandler *proxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []upstreamHealthStatus{}
+		for _, pool := range pHandler.upstreamPools() {
+			statuses = append(statuses, pool.status()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if encodeErr := json.NewEncoder(w).Encode(statuses); encodeErr != nil {
+			log.Printf("Error writing upstream health status: %v", encodeErr)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -13,103 +16,382 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func assignRoutes(pHMap *proxyHanlderMap, routeMap *RouteMap) {
+//assignRoutes registers the routeMap into pHMap. It returns the upstreamPools
+// created for routes that list Upstreams; their health checks are not started.
+func assignRoutes(pHMap *proxyHanlderMap, routeMap *RouteMap) []*upstreamPool {
 
-	//creating a http client here that will be reused. The client
-	// will not follow redirects hence redirects from downstreams are
-	// passed onto the requestors.
-	// We will define tight timeouts here as we don't expect much latencies from
-	// downstreams.
-	client := &http.Client{
-		//first create a transport that is tolerant to SSL errors
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			DisableKeepAlives:     false,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 500 * time.Second,
-			ExpectContinueTimeout: 10 * time.Second,
-			MaxIdleConnsPerHost:   10,
-			MaxIdleConns:          100,
-		},
-		// we will not follow any redirect rather pass the instructions to
-		// the client
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		//we will declare a reasonable timeout value here. Alternatively we
-		// can look to parameterize this to fetch its value from routeMap
-		Timeout: 15 * time.Second,
+	//clients are shared by the routes whose downstreams take the same TLS
+	// settings, timeouts and protocol so that connections to them are pooled
+	// together
+	clients := make(map[string]*http.Client)
+
+	//the routeMap has been validated by now, a TLS policy failing to build
+	// here leaves connections on the server's own tls.Config
+	globalTLS, globalTLSErr := newServerTLSConfig(routeMap.TLS.withPreset())
+	if globalTLSErr != nil {
+		log.Printf("Falling back to the default TLS policy: %v", globalTLSErr)
+	} else {
+		pHMap.tlsConfig = &serverTLSConfig{config: globalTLS}
 	}
 
+	var pools []*upstreamPool
 	//let us now register the handlers iteratively for each HostMap entry
 	for _, hostMap := range (*routeMap).Routes {
 		// create a new router for each hostMap
 		router := httprouter.New()
+		responder, responderErr := newErrorResponder(hostMap.ErrorResponse)
+		if responderErr != nil {
+			log.Printf("Falling back to plain error responses for host %s: %v",
+				hostMap.Host, responderErr)
+			responder, _ = newErrorResponder(ErrorResponse{})
+		}
+		upgrades := newUpgradeLimiter(hostMap.MaxUpgradedConns)
+		handler := &hostHandler{name: hostMap.Host, router: router, redirect: hostMap.HTTPRedirect.withDefaults(),
+			acme: hostMap.ACME.withDefaults()}
+		//the routeMap has been validated by now, a host whose requestors
+		// cannot be authenticated is left out rather than served unchecked
+		clientAuth, clientAuthErr := newClientAuthenticator(hostMap, certMap)
+		if clientAuthErr != nil {
+			log.Printf("Skipping host %s: %v", hostMap.Host, clientAuthErr)
+			continue
+		}
+		//a host whose access log cannot be opened is served without one
+		accessLog, accessLogErr := newAccessLogger(resolveAccessLog(routeMap.AccessLog,
+			hostMap.AccessLog))
+		if accessLogErr != nil {
+			log.Printf("Access log of host %s could not be opened: %v", hostMap.Host,
+				accessLogErr)
+		}
+		handler.accessLog = accessLog
 		for _, methodPathMap := range hostMap.MethodPathMaps {
 			localMap := methodPathMap
-			//now register the handler to the router using a closure
+			clientAuthMode := clientAuth.routeMode(localMap.ClientAuth)
+			upstreamTLS := upstreamTLSFor(hostMap, localMap)
+			timeouts := localMap.Timeouts.withDefaults()
+			retryPolicy := localMap.Retry.withDefaults()
+			upgradePolicy := localMap.Upgrade.withDefaults()
+			budget := newRetryBudget(retryPolicy)
+			clientKey := fmt.Sprintf("%#v %d %d %s", upstreamTLS, timeouts.Connect,
+				timeouts.ResponseHeader, localMap.Protocol)
+			client, exists := clients[clientKey]
+			if !exists {
+				tlsConfig, clientErr := newUpstreamTLSConfig(upstreamTLS, certMap)
+				if clientErr == nil {
+					client, clientErr = newUpstreamClient(tlsConfig, timeouts, localMap.Protocol)
+				}
+				if clientErr != nil {
+					log.Printf("Skipping route %s %s for host %s: %v", localMap.Method,
+						localMap.Path, hostMap.Host, clientErr)
+					continue
+				}
+				clients[clientKey] = client
+			}
+			//routes listing upstreams get a pool of their own. The routeMap has
+			// been validated by now, an error here means the route is skipped
+			var pool *upstreamPool
+			if len(localMap.Upstreams) > 0 {
+				var poolErr error
+				pool, poolErr = newUpstreamPool(hostMap.Host, localMap, client)
+				if poolErr != nil {
+					log.Printf("Skipping route %s %s for host %s: %v", localMap.Method,
+						localMap.Path, hostMap.Host, poolErr)
+					continue
+				}
+				pools = append(pools, pool)
+			}
+			//now register the handler to the router using a closure, noting the
+			// route for the request to be counted against
+			routeName := localMap.Method + " " + localMap.Path
+			connectErrors := metrics.connectErrors.with(hostMap.Host, routeName)
 			router.Handle(localMap.Method, localMap.Path,
 				func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+					record := recordOf(r)
+					record.route = routeName
 
-					//build a route from localMap.Route and httprouter.Params here
+					//the request is tagged so that failures can be traced across
+					// Silly's logs, the downstream and the requestor
+					requestID := record.requestID
+
+					//the downstream the request went to is noted for the access log
+					var upstreamURL string
+					var upstreamLatency time.Duration
+					defer func() {
+						record.upstream, record.upstreamLatency = upstreamURL, upstreamLatency
+					}()
+
+					//requestors are refused unless they present the client
+					// certificate the route asks for. One verified in a handshake
+					// for this very host needs no second look
+					handshakeVerified := r.TLS != nil &&
+						pHMap.lookup(r.TLS.ServerName) == http.Handler(handler)
+					clientCert, authErr := clientAuth.authorize(r, clientAuthMode,
+						handshakeVerified)
+					if authErr != nil {
+						log.Printf("Client authentication failed for inbound request %#v (request %s): %v",
+							r.RequestURI, requestID, authErr)
+						responder.respond(w, r, http.StatusForbidden,
+							"valid client certificate required", requestID)
+						return
+					}
+
+					//build a route from localMap.Route and httprouter.Params here.
+					// A route that does not build is a fault in the routes file
 					route, routeBuildErr := routeBuilder(ps, localMap.Route)
 					if routeBuildErr != nil {
-						log.Printf("routeBuilder returned error: %#v", routeBuildErr)
-						//fmt.Fprintf(w, "Request failed\n")
-						writeErrorResponse(w, http.StatusBadRequest)
+						log.Printf("routeBuilder returned error for request %s: %#v",
+							requestID, routeBuildErr)
+						responder.respond(w, r, http.StatusInternalServerError,
+							"route could not be built", requestID)
 						return
 					}
-					//now add the query params from the original request as is
-					if r.URL.RawQuery != "" {
-						route = route + "?" + r.URL.RawQuery
+					//requests switching protocols are tunnelled if the route
+					// allows it, else they are proxied as plain requests
+					protocol := upgradeProtocol(r)
+					if !upgradePolicy.allows(protocol) {
+						protocol = ""
 					}
-
-					//create a new HTTP request
-					req, reqErr := http.NewRequest(localMap.Method, route, r.Body)
-					if route == "" || reqErr != nil {
-						log.Printf("Error when creating request to %s for inbound request %#v",
-							route, r.RequestURI)
-						writeErrorResponse(w, http.StatusBadRequest)
-						return
+					if protocol != "" {
+						if !upgrades.acquire() {
+							log.Printf("Upgraded connections limit reached for inbound request %#v (request %s)",
+								r.RequestURI, requestID)
+							responder.respond(w, r, http.StatusServiceUnavailable,
+								"too many upgraded connections", requestID)
+							return
+						}
+						defer upgrades.release()
 					}
 
-					// add all the headers from incoming request to the outgoing
-					for requestHeaderKey, requestHeaderValues := range r.Header {
-						requestHeaderValue := requestHeaderValues[0]
-						for i := 1; i < len(requestHeaderValues); i++ {
-							requestHeaderValue = requestHeaderValue + "," + requestHeaderValues[i]
+					//the total timeout covers every attempt and streaming the
+					// response back while the idle timeout cuts off bodies that
+					// stall on the way. Upgraded connections are bound by their
+					// own idle timeout instead
+					ctx := r.Context()
+					var idle *idleTimeout
+					if protocol == "" {
+						if timeouts.Total > 0 {
+							var cancel context.CancelFunc
+							ctx, cancel = context.WithTimeout(ctx, time.Duration(timeouts.Total)*time.Second)
+							defer cancel()
+						}
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithCancel(ctx)
+						defer cancel()
+						idle = newIdleTimeout(time.Duration(timeouts.Idle)*time.Second, cancel)
+						defer idle.stop()
+						if r.ContentLength != 0 {
+							r.Body = idle.requestBody(r.Body)
+							idle.touch()
 						}
-						req.Header.Add(requestHeaderKey, requestHeaderValue)
 					}
-					req.Header.Set("X-Forwarded-By", "SillyProxy")
+					budget.request()
+					replayable := retryPolicy.replayable(r)
+
+					var resp *http.Response
+					var respErr error
+					for attempt := uint(1); ; attempt++ {
+						//pick the upstream for this attempt and keep it marked as
+						// outstanding until the response has been streamed back
+						var target *upstreamTarget
+						release := func() {}
+						upstreamURL = route
+						if pool != nil {
+							if target = pool.pick(r); target == nil {
+								log.Printf("No healthy upstream for inbound request %#v (request %s)",
+									r.RequestURI, requestID)
+								responder.respond(w, r, http.StatusServiceUnavailable,
+									"no healthy upstream available", requestID)
+								return
+							}
+							release = target.acquire()
+							upstreamURL = target.upstreamURL(route)
+						}
+						//now add the query params from the original request as is
+						if r.URL.RawQuery != "" {
+							upstreamURL = upstreamURL + "?" + r.URL.RawQuery
+						}
 
-					resp, respErr := client.Do(req)
+						req, reqErr := newUpstreamRequest(ctx, r, localMap.Method, upstreamURL,
+							requestID, protocol)
+						if reqErr != nil {
+							release()
+							log.Printf("Error when creating request to %s for inbound request %#v (request %s)",
+								upstreamURL, r.RequestURI, requestID)
+							responder.respond(w, r, http.StatusInternalServerError,
+								"upstream request could not be created", requestID)
+							return
+						}
+						//the identity of the verified client certificate replaces
+						// whatever the requestor claimed it to be
+						clientAuth.headers.set(req.Header, clientCert)
+
+						attemptStart := time.Now()
+						resp, respErr = client.Do(req)
+						upstreamLatency = time.Since(attemptStart)
+						if isConnectError(respErr) {
+							connectErrors.inc()
+						}
+						if pool != nil {
+							pool.observe(target, resp, respErr)
+						}
+						failed := (respErr != nil && ctx.Err() == nil) ||
+							(respErr == nil && retryPolicy.retryOn(resp.StatusCode))
+						if !failed || !replayable || attempt >= retryPolicy.Attempts ||
+							!budget.withdraw() {
+							defer release()
+							break
+						}
+						//this attempt is given up on in favour of another
+						if resp != nil {
+							io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+							resp.Body.Close()
+						}
+						release()
+						log.Printf("Retrying %s for inbound request %#v (request %s) after attempt %d failed",
+							upstreamURL, r.RequestURI, requestID, attempt)
+						if !waitForRetry(ctx, retryPolicy.backoff(attempt)) {
+							resp, respErr = nil, ctx.Err()
+							break
+						}
+					}
 					if respErr != nil {
-						log.Printf("Error in obtaining response from %s for inbound request %#v",
-							route, r.RequestURI)
-						//fmt.Fprintf(w, "Request failed\n")
-						writeErrorResponse(w, http.StatusBadRequest)
+						log.Printf("Error in obtaining response from %s for inbound request %#v (request %s): %v",
+							upstreamURL, r.RequestURI, requestID, respErr)
+						status := statusForUpstreamError(respErr)
+						message := "upstream unreachable"
+						if status == http.StatusGatewayTimeout {
+							message = "upstream timed out"
+						}
+						responder.respond(w, r, status, message, requestID)
 						return
 					}
-					if writeResponse(w, resp) != nil {
-						writeErrorResponse(w, http.StatusInternalServerError)
-						resp.Body.Close()
+					if resp.StatusCode == http.StatusSwitchingProtocols {
+						if protocol == "" {
+							resp.Body.Close()
+							log.Printf("Unrequested protocol switch from %s for inbound request %#v (request %s)",
+								upstreamURL, r.RequestURI, requestID)
+							responder.respond(w, r, http.StatusBadGateway,
+								"upstream switched protocols unrequested", requestID)
+							return
+						}
+						if upgradeErr := proxyUpgrade(w, resp, time.Duration(
+							upgradePolicy.IdleTimeout)*time.Second); upgradeErr != nil {
+							log.Printf("Error in tunnelling upgraded connection to %s for inbound request %#v (request %s): %v",
+								upstreamURL, r.RequestURI, requestID, upgradeErr)
+						}
 						return
 					}
-					resp.Body.Close()
+					if idle != nil {
+						resp.Body = idle.responseBody(resp.Body)
+					}
+					//the status line has already gone out by the time streaming fails,
+					// hence the failure can only be logged here
+					if writeErr := writeResponse(w, resp); writeErr != nil {
+						log.Printf("Error in streaming response from %s for inbound request %#v (request %s): %v",
+							upstreamURL, r.RequestURI, requestID, writeErr)
+					}
 					return
 				})
 			//router.Handle ended
 		}
-		(*pHMap)[hostMap.Host] = router
+		hostTLS, hostTLSErr := newServerTLSConfig(resolveTLSPolicy(routeMap.TLS, hostMap.TLS))
+		if hostTLSErr != nil {
+			log.Printf("Falling back to the global TLS policy for host %s: %v",
+				hostMap.Host, hostTLSErr)
+		} else {
+			clientAuth.configure(hostTLS)
+			handler.tlsConfig = &serverTLSConfig{config: hostTLS}
+		}
+		registerErr := pHMap.register(hostMap.Host, handler)
+		if registerErr != nil {
+			log.Printf("Skipping host %s: %v", hostMap.Host, registerErr)
+		}
 	}
+	pHMap.unmatched = routeMap.Unmatched
+	//requests to hosts matching no HostMap go to the access log of the routes
+	// file
+	unmatchedLog, unmatchedLogErr := newAccessLogger(routeMap.AccessLog)
+	if unmatchedLogErr != nil {
+		log.Printf("Access log of unmatched hosts could not be opened: %v", unmatchedLogErr)
+	}
+	pHMap.accessLog = unmatchedLog
+	return pools
+
+}
 
+//newUpstreamRequest creates the request to upstreamURL for the inbound
+// request r. The inbound body is handed over as is so that uploads (chunked
+// or otherwise) stream to the downstream. The request asks the downstream to
+// switch to protocol unless it is blank.
+func newUpstreamRequest(ctx context.Context, r *http.Request, method string,
+	upstreamURL string, requestID string, protocol string) (*http.Request, error) {
+	if upstreamURL == "" {
+		return nil, fmt.Errorf("Upstream URL is empty")
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, method, upstreamURL, r.Body)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	req.ContentLength = r.ContentLength
+	if r.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	req.Trailer = r.Trailer
+
+	// add all the headers from incoming request to the outgoing
+	copyHeader(req.Header, r.Header)
+	//hop-by-hop headers end with this hop. "TE: trailers" is
+	// the one exception, downstreams such as gRPC insist on it
+	removeHopHeaders(req.Header)
+	if headerHasToken(r.Header, "Te", "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+	if protocol != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", protocol)
+	}
+	setForwardedHeaders(req, r)
+	req.Header.Set("X-Forwarded-By", "SillyProxy")
+	req.Header.Set(requestIDHeader, requestID)
+	return req, nil
+}
+
+//newUpstreamClient creates the http client that routes reach their
+// downstreams through, verifying the downstreams as tlsConfig says, bounding
+// connects and response headers by timeouts and speaking protocol to them
+func newUpstreamClient(tlsConfig *tls.Config, timeouts Timeouts,
+	protocol string) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(timeouts.Connect) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport, protocolErr := configureProtocol(&http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		DisableKeepAlives:     false,
+		TLSHandshakeTimeout:   time.Duration(timeouts.Connect) * time.Second,
+		ResponseHeaderTimeout: time.Duration(timeouts.ResponseHeader) * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost:   10,
+		MaxIdleConns:          100,
+	}, dialer, protocol)
+	if protocolErr != nil {
+		return nil, protocolErr
+	}
+	//the client will not follow redirects hence redirects from downstreams are
+	// passed onto the requestors.
+	return &http.Client{
+		Transport: transport,
+		// we will not follow any redirect rather pass the instructions to
+		// the client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		//there is no overall timeout on the client as responses are streamed
+		// back and may legitimately stay open (server-sent events, long
+		// polling). The outbound request is bound to the inbound request's
+		// context instead, so it is cancelled when the requestor goes away or
+		// the route's Total or Idle timeout runs out.
+	}, nil
 }
 
 func routeBuilder(ps httprouter.Params, route []interface{}) (string, error) {
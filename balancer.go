@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//Upstream is a backend instance that a route's traffic can be spread over.
+// Target is the base URL (scheme://host:port) the built route is appended to.
+// Weight defaults to 1 and is honoured by the weighted and consistent-hash
+// strategies.
+type Upstream struct {
+	Target string
+	Weight int
+}
+
+//Balancer configures how a route picks one of its Upstreams. Strategy is one
+// of "weighted" (default), "round-robin", "least-outstanding" or
+// "consistent-hash". HashOn tells consistent-hash what to hash on and takes
+// the form "header:<name>", "cookie:<name>" or "ip".
+type Balancer struct {
+	Strategy string
+	HashOn   string
+}
+
+//strategies supported by Balancer
+const (
+	strategyWeighted         = "weighted"
+	strategyRoundRobin       = "round-robin"
+	strategyLeastOutstanding = "least-outstanding"
+	strategyConsistentHash   = "consistent-hash"
+)
+
+//hashRingReplicas is the number of points each unit of weight gets on the
+// consistent hash ring
+const hashRingReplicas = 100
+
+//upstreamTarget is the runtime state of an Upstream
+type upstreamTarget struct {
+	target      string
+	weight      int
+	outstanding int64
+	health      *upstreamHealth
+}
+
+func newUpstreamTarget(target string, weight int) *upstreamTarget {
+	return &upstreamTarget{
+		target: target,
+		weight: weight,
+		health: &upstreamHealth{healthy: true},
+	}
+}
+
+//acquire marks a request as outstanding against the target. The returned
+// func must be called once the request is done with.
+func (target *upstreamTarget) acquire() func() {
+	atomic.AddInt64(&target.outstanding, 1)
+	return func() {
+		atomic.AddInt64(&target.outstanding, -1)
+	}
+}
+
+//upstreamURL appends a route built by routeBuilder to the target's base URL
+func (target *upstreamTarget) upstreamURL(route string) string {
+	return strings.TrimSuffix(target.target, "/") + "/" + strings.TrimPrefix(route, "/")
+}
+
+//upstreamBalancer picks the upstreamTarget for an inbound request
+type upstreamBalancer interface {
+	next(r *http.Request) *upstreamTarget
+}
+
+//newUpstreamTargets validates a route's Upstreams and builds their runtime state
+func newUpstreamTargets(upstreams []Upstream) ([]*upstreamTarget, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("No upstreams to balance over")
+	}
+	targets := make([]*upstreamTarget, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if validateErr := validateUpstream(upstream); validateErr != nil {
+			return nil, validateErr
+		}
+		weight := upstream.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		targets = append(targets, newUpstreamTarget(upstream.Target, weight))
+	}
+	return targets, nil
+}
+
+//newUpstreamBalancer builds the upstreamBalancer for a route's targets
+func newUpstreamBalancer(targets []*upstreamTarget, balancer Balancer) (upstreamBalancer, error) {
+	switch balancer.Strategy {
+	case "", strategyWeighted:
+		return newWeightedBalancer(targets), nil
+	case strategyRoundRobin:
+		return &roundRobinBalancer{targets: targets}, nil
+	case strategyLeastOutstanding:
+		return &leastOutstandingBalancer{targets: targets}, nil
+	case strategyConsistentHash:
+		hashKey, hashKeyErr := parseHashOn(balancer.HashOn)
+		if hashKeyErr != nil {
+			return nil, hashKeyErr
+		}
+		return newConsistentHashBalancer(targets, hashKey), nil
+	default:
+		return nil, fmt.Errorf("Unknown balancer strategy %#v", balancer.Strategy)
+	}
+}
+
+func validateUpstream(upstream Upstream) error {
+	targetURL, parseErr := url.Parse(upstream.Target)
+	if parseErr != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") ||
+		targetURL.Host == "" {
+		return fmt.Errorf("Upstream target %#v is not an absolute http(s) URL", upstream.Target)
+	}
+	if upstream.Weight < 0 {
+		return fmt.Errorf("Upstream target %#v has a negative weight", upstream.Target)
+	}
+	return nil
+}
+
+//roundRobinBalancer hands out targets in turn, ignoring their weights
+type roundRobinBalancer struct {
+	targets []*upstreamTarget
+	counter uint64
+}
+
+func (balancer *roundRobinBalancer) next(r *http.Request) *upstreamTarget {
+	n := atomic.AddUint64(&balancer.counter, 1) - 1
+	return balancer.targets[n%uint64(len(balancer.targets))]
+}
+
+//weightedBalancer is a smooth weighted round-robin. Each pick raises every
+// target's current weight by its weight and picks the highest, which is then
+// lowered by the total. Heavier targets are picked proportionally more often
+// without being picked in bursts.
+type weightedBalancer struct {
+	mutex   sync.Mutex
+	targets []*upstreamTarget
+	current []int
+	total   int
+}
+
+func newWeightedBalancer(targets []*upstreamTarget) *weightedBalancer {
+	balancer := &weightedBalancer{
+		targets: targets,
+		current: make([]int, len(targets)),
+	}
+	for _, target := range targets {
+		balancer.total += target.weight
+	}
+	return balancer
+}
+
+func (balancer *weightedBalancer) next(r *http.Request) *upstreamTarget {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	picked := 0
+	for i, target := range balancer.targets {
+		balancer.current[i] += target.weight
+		if balancer.current[i] > balancer.current[picked] {
+			picked = i
+		}
+	}
+	balancer.current[picked] -= balancer.total
+	return balancer.targets[picked]
+}
+
+//leastOutstandingBalancer picks the target with the fewest requests in
+// flight. The scan starts at a rotating offset so that ties are spread out.
+type leastOutstandingBalancer struct {
+	targets []*upstreamTarget
+	counter uint64
+}
+
+func (balancer *leastOutstandingBalancer) next(r *http.Request) *upstreamTarget {
+	offset := int(atomic.AddUint64(&balancer.counter, 1) % uint64(len(balancer.targets)))
+	picked := balancer.targets[offset]
+	for i := 1; i < len(balancer.targets); i++ {
+		target := balancer.targets[(offset+i)%len(balancer.targets)]
+		if atomic.LoadInt64(&target.outstanding) < atomic.LoadInt64(&picked.outstanding) {
+			picked = target
+		}
+	}
+	return picked
+}
+
+//hashKeyFunc extracts the key a request is hashed on. An empty key means the
+// request carries nothing to hash on.
+type hashKeyFunc func(r *http.Request) string
+
+func parseHashOn(hashOn string) (hashKeyFunc, error) {
+	switch {
+	case hashOn == "ip":
+		return func(r *http.Request) string {
+			host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+			if splitErr != nil {
+				return r.RemoteAddr
+			}
+			return host
+		}, nil
+	case strings.HasPrefix(hashOn, "header:") && len(hashOn) > len("header:"):
+		name := strings.TrimPrefix(hashOn, "header:")
+		return func(r *http.Request) string {
+			return r.Header.Get(name)
+		}, nil
+	case strings.HasPrefix(hashOn, "cookie:") && len(hashOn) > len("cookie:"):
+		name := strings.TrimPrefix(hashOn, "cookie:")
+		return func(r *http.Request) string {
+			cookie, cookieErr := r.Cookie(name)
+			if cookieErr != nil {
+				return ""
+			}
+			return cookie.Value
+		}, nil
+	default:
+		return nil, fmt.Errorf("HashOn %#v must be \"ip\", \"header:<name>\" "+
+			"or \"cookie:<name>\"", hashOn)
+	}
+}
+
+//consistentHashBalancer maps requests onto a hash ring of the targets so that
+// the same key keeps landing on the same target while the set of targets is
+// stable. Requests without a key are spread round-robin.
+type consistentHashBalancer struct {
+	ring     []uint32
+	owners   map[uint32]*upstreamTarget
+	hashKey  hashKeyFunc
+	fallback *roundRobinBalancer
+}
+
+func newConsistentHashBalancer(targets []*upstreamTarget,
+	hashKey hashKeyFunc) *consistentHashBalancer {
+	balancer := &consistentHashBalancer{
+		owners:   make(map[uint32]*upstreamTarget),
+		hashKey:  hashKey,
+		fallback: &roundRobinBalancer{targets: targets},
+	}
+	for _, target := range targets {
+		for i := 0; i < target.weight*hashRingReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(target.target + "#" + strconv.Itoa(i)))
+			if _, taken := balancer.owners[point]; taken {
+				continue
+			}
+			balancer.owners[point] = target
+			balancer.ring = append(balancer.ring, point)
+		}
+	}
+	sort.Slice(balancer.ring, func(i, j int) bool {
+		return balancer.ring[i] < balancer.ring[j]
+	})
+	return balancer
+}
+
+func (balancer *consistentHashBalancer) next(r *http.Request) *upstreamTarget {
+	key := balancer.hashKey(r)
+	if key == "" {
+		return balancer.fallback.next(r)
+	}
+	point := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(balancer.ring), func(i int) bool {
+		return balancer.ring[i] >= point
+	})
+	if i == len(balancer.ring) {
+		i = 0
+	}
+	return balancer.owners[balancer.ring[i]]
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -11,14 +12,181 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ChandraNarreddy/sillyproxy/utility"
 	keystore "github.com/pavel-v-chernykh/keystore-go/v4"
 )
 
-//certMap is a map of aliases and certificates in the form ("w.a.p:ECDSA",cert)
-var certMap map[string]tls.Certificate
+//certSnapshot is an immutable view of the certificates loaded off the
+// keystore. Aliases are of the form ("w.a.p:ECDSA",cert) and may be wildcards
+// such as "*.a.p:ECDSA". sanCerts indexes the same certs by the DNS SANs of
+// their leaf, lower cased, so that a cert serves every name it covers. Certs
+// of the default alias are held apart so that they can be grabbed without a
+// map lookup. Client certificates presented to downstreams are kept in
+// clientCerts by the name their "client:" alias carries; they are never
+// served to requestors. Session ticket keys of "ticket:" aliases are kept in
+// ticketKeys. The CA bundles of trusted certificate entries that requestors'
+// client certificates are verified against are kept in caBundles by name.
+type certSnapshot struct {
+	certs          map[string]*tls.Certificate
+	sanCerts       map[string]*tls.Certificate
+	clientCerts    map[string]*tls.Certificate
+	Ed25519default *tls.Certificate
+	ECDSAdefault   *tls.Certificate
+	RSAdefault     *tls.Certificate
+	ticketKeys     []ticketKey
+	caBundles      map[string][]*x509.Certificate
+}
+
+//newCertSnapshot returns an empty certSnapshot
+func newCertSnapshot() *certSnapshot {
+	return &certSnapshot{certs: make(map[string]*tls.Certificate),
+		sanCerts: make(map[string]*tls.Certificate), clientCerts: make(map[string]*tls.Certificate),
+		caBundles: make(map[string][]*x509.Certificate)}
+}
+
+//caBundleName returns the name of the CA bundle a trusted certificate entry
+// belongs to, "name" for "ca:name:0". Entries imported by other tools make up
+// a bundle of their own under their alias.
+func caBundleName(alias string) string {
+	if !strings.HasPrefix(alias, utility.TrustedCertAliasPrefix) {
+		return alias
+	}
+	name := strings.TrimPrefix(alias, utility.TrustedCertAliasPrefix)
+	if index := strings.LastIndex(name, ":"); index > 0 {
+		return name[:index]
+	}
+	return name
+}
+
+//certKey returns the key of the cert under alias in certs, alias with the
+// name ahead of its cert type lowercased
+func certKey(alias string) string {
+	certType := certTypeOf(alias)
+	if name := strings.TrimSuffix(alias, ":"+certType); name != alias {
+		return strings.ToLower(name) + ":" + certType
+	}
+	return strings.ToLower(alias)
+}
+
+//certTypeOf returns the cert type an alias is suffixed with, "RSA" if it is
+// suffixed with none of the certTypes
+func certTypeOf(alias string) string {
+	for _, certType := range certTypes {
+		if strings.HasSuffix(alias, ":"+certType) {
+			return certType
+		}
+	}
+	return "RSA"
+}
+
+//defaultCert returns the cert of certType of the default alias, nil if there
+// is none
+func (snapshot *certSnapshot) defaultCert(certType string) *tls.Certificate {
+	switch certType {
+	case "Ed25519":
+		return snapshot.Ed25519default
+	case "ECDSA":
+		return snapshot.ECDSAdefault
+	}
+	return snapshot.RSAdefault
+}
+
+//lookup returns the cert of certType ("Ed25519", "ECDSA" or "RSA") for name,
+// looking at the aliases first and the SANs after. Names match regardless of
+// case.
+func (snapshot *certSnapshot) lookup(name, certType string) (*tls.Certificate, bool) {
+	key := strings.ToLower(name) + ":" + certType
+	if cert, exists := snapshot.certs[key]; exists {
+		return cert, true
+	}
+	cert, exists := snapshot.sanCerts[key]
+	return cert, exists
+}
+
+//indexSANs fills sanCerts off the leaves of certs. Aliases are walked in
+// order so that the cert a SAN ends up with does not change across reloads.
+// The Leaf of every cert served, defaults included, is set along the way.
+func (snapshot *certSnapshot) indexSANs() {
+	aliases := make([]string, 0, len(snapshot.certs))
+	for alias := range snapshot.certs {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		cert := snapshot.certs[alias]
+		leaf, parseErr := x509.ParseCertificate(cert.Certificate[0])
+		if parseErr != nil {
+			log.Printf("Certificate of alias %s could not be parsed for its SANs: %v",
+				alias, parseErr)
+			continue
+		}
+		cert.Leaf = leaf
+		certType := certTypeOf(alias)
+		for _, name := range leaf.DNSNames {
+			key := strings.ToLower(name) + ":" + certType
+			if _, exists := snapshot.sanCerts[key]; !exists {
+				snapshot.sanCerts[key] = cert
+			}
+		}
+	}
+	for _, certType := range certTypes {
+		if cert := snapshot.defaultCert(certType); cert != nil && cert.Leaf == nil {
+			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+	}
+}
+
+//certStore publishes certSnapshots atomically. A snapshot is never modified
+// once published; each reload builds a new one and swaps it in whole.
+type certStore struct {
+	current atomic.Value
+}
+
+func newCertStore() *certStore {
+	return &certStore{}
+}
+
+//snapshot returns the current certSnapshot or nil if none was published yet
+func (store *certStore) snapshot() *certSnapshot {
+	snapshot, _ := store.current.Load().(*certSnapshot)
+	return snapshot
+}
+
+func (store *certStore) publish(snapshot *certSnapshot) {
+	store.current.Store(snapshot)
+}
+
+//purge publishes an empty snapshot and zeroes out the certificates and keys
+// held by the previous one
+func (store *certStore) purge() {
+	previous := store.snapshot()
+	store.publish(newCertSnapshot())
+	if previous == nil {
+		return
+	}
+	for _, cert := range previous.certs {
+		clearOut(cert)
+	}
+	for _, cert := range previous.clientCerts {
+		clearOut(cert)
+	}
+	for _, certType := range certTypes {
+		if cert := previous.defaultCert(certType); cert != nil {
+			clearOut(cert)
+		}
+	}
+	for i := range previous.ticketKeys {
+		clearOut(&previous.ticketKeys[i])
+	}
+}
+
+//certMap holds the certificates that returnCert serves
+var certMap = newCertStore()
 
 // keyStorePass is a pointer to the key store's password byte array
 var keyStorePassBytes []byte
@@ -26,14 +194,15 @@ var keyStorePassBytes []byte
 // keyStoreFile is a pointer to the keystore file's location string
 var keyStoreFile *string
 
-//loadCertMap loads the certificate map from the keystore object
-func loadCertMap(filePtr *string, password []byte,
-	certMap *map[string]tls.Certificate) error {
+//loadCertMap builds a new certSnapshot from the keystore and publishes it to
+// the store. The store is left untouched if the keystore fails to load.
+func loadCertMap(filePtr *string, password []byte, store *certStore) error {
 	f, err := os.Open(*filePtr)
 	if err != nil {
 		err = errors.New("loadKeyStore failed with error: " + fmt.Sprintf("%v", err))
 		return err
 	}
+	defer f.Close()
 	keyStore := keystore.New(keystore.WithCaseExactAliases())
 	err = keyStore.Load(f, password)
 	if err != nil {
@@ -42,62 +211,101 @@ func loadCertMap(filePtr *string, password []byte,
 	}
 	defer clearOut(&keyStore)
 
-	// Check here if atleast "default" alias RSA or ECDSA exists
+	// Check here if atleast "default" alias RSA, ECDSA or Ed25519 exists
 	if !aliasExists(&keyStore, "default:RSA") &&
 		!aliasExists(&keyStore, "default:ECDSA") &&
+		!aliasExists(&keyStore, "default:Ed25519") &&
 		!aliasExists(&keyStore, "default:DSA") {
 		//throw an error back that loadCertMap failed as there is no default cert
 		return fmt.Errorf("No certificate exists with \"default\" alias. " +
 			"Please load a cert with default alias into the keystore")
 	}
+	snapshot := newCertSnapshot()
 	aliases := keyStore.Aliases()
 	for _, alias := range aliases {
+		//CA certificates come without a private key
+		if keyStore.IsTrustedCertificateEntry(alias) {
+			entry, getErr := keyStore.GetTrustedCertificateEntry(alias)
+			if getErr != nil {
+				return fmt.Errorf("Failed to fetch a trusted certificate entry for alias %v", alias)
+			}
+			caCert, parseErr := x509.ParseCertificate(entry.Certificate.Content)
+			if parseErr != nil {
+				log.Printf("Trusted certificate load failed for alias %s: %v", alias, parseErr)
+				continue
+			}
+			name := caBundleName(alias)
+			snapshot.caBundles[name] = append(snapshot.caBundles[name], caCert)
+			continue
+		}
 		entry, getPrivateKeyEntryErr := keyStore.GetPrivateKeyEntry(alias, password)
 		if getPrivateKeyEntryErr != nil {
 			return fmt.Errorf("Failed to fetch a private key entry for alias %v", alias)
 		}
+		//session ticket keys carry no certificate
+		if strings.HasPrefix(alias, utility.TicketKeyAliasPrefix) {
+			key, parseErr := parseTicketKey(entry.PrivateKey)
+			if parseErr != nil {
+				log.Printf("Session ticket key load failed for alias %s: %v", alias, parseErr)
+			} else {
+				snapshot.ticketKeys = append(snapshot.ticketKeys,
+					ticketKey{key: key, created: entry.CreationTime})
+			}
+			zeroBytes(entry.PrivateKey)
+			continue
+		}
 		certChain := entry.CertificateChain
 		var keyPEMBlock []byte
 		var keyDERBlock *pem.Block
-		cert := tls.Certificate{}
+		cert := &tls.Certificate{}
 		if len(certChain) == 0 {
 			log.Printf("PrivateKeyEntry for alias %s does not contain a certificate chain", alias)
-		} else {
-			for i := 0; i < len(certChain); i++ {
-				cert.Certificate = append(cert.Certificate, certChain[i].Content)
+			continue
+		}
+		for i := 0; i < len(certChain); i++ {
+			cert.Certificate = append(cert.Certificate, certChain[i].Content)
+		}
+		keyPEMBlock = entry.PrivateKey
+		keyDERBlock, _ = pem.Decode(keyPEMBlock)
+		if keyDERBlock == nil {
+			log.Printf("Privatekey load failed for for alias %s", alias)
+			zeroBytes(keyPEMBlock)
+			continue
+		}
+		cert.PrivateKey, err = parsePrivateKey(keyDERBlock.Bytes)
+		if err != nil {
+			log.Printf("Privatekey load failed for for alias %s", alias)
+		} else if name, isClientCert := clientCertName(alias); isClientCert {
+			//an ECDSA client certificate wins over an RSA one of the same name
+			if _, exists := snapshot.clientCerts[name]; !exists || strings.HasSuffix(alias, ":ECDSA") {
+				snapshot.clientCerts[name] = cert
 			}
-			keyPEMBlock = entry.PrivateKey
-			keyDERBlock, _ = pem.Decode(keyPEMBlock)
-			cert.PrivateKey, err = parsePrivateKey(keyDERBlock.Bytes)
-			if err != nil {
-				log.Printf("Privatekey load failed for for alias %s", alias)
-			} else {
-
-				if strings.HasPrefix(alias, "default") {
-					if strings.HasSuffix(alias, ":ECDSA") {
-						ECDSAdefaultExists = true
-						*ECDSAdefault = cert
-					} else {
-						RSAdefaultExists = true
-						*RSAdefault = cert
-					}
-				} else {
-					(*certMap)[alias] = cert
+		} else {
+			if strings.HasPrefix(alias, "default") {
+				switch certTypeOf(alias) {
+				case "Ed25519":
+					snapshot.Ed25519default = cert
+				case "ECDSA":
+					snapshot.ECDSAdefault = cert
+				default:
+					snapshot.RSAdefault = cert
 				}
-				//log.Printf("Certificate successfully loaded for alias: %s", k)
+			} else {
+				snapshot.certs[certKey(alias)] = cert
 			}
-			zeroBytes(keyPEMBlock)
-			clearOut(keyDERBlock)
+			//log.Printf("Certificate successfully loaded for alias: %s", k)
 		}
-		clearOut(&cert)
+		zeroBytes(keyPEMBlock)
+		clearOut(keyDERBlock)
 	}
-	f.Close()
+	snapshot.indexSANs()
+	store.publish(snapshot)
 	return nil
 }
 
-//reloadCertMap reloads the certMap once every 6 hours
+//reloadCertMap reloads the certMap once every n seconds
 func reloadCertMap(filePtr *string, password []byte,
-	certMap *map[string]tls.Certificate, quit <-chan struct{}, n uint) {
+	store *certStore, quit <-chan struct{}, n uint) {
 	ticker := time.NewTicker(time.Duration(n) * time.Second)
 	for {
 		select {
@@ -105,7 +313,7 @@ func reloadCertMap(filePtr *string, password []byte,
 			ticker.Stop()
 			return
 		case <-ticker.C:
-			KSerror := loadCertMap(filePtr, password, certMap)
+			KSerror := loadCertMap(filePtr, password, store)
 			if KSerror != nil {
 				log.Printf("Keystore reload failed with error: %v", KSerror)
 			}
@@ -128,7 +336,7 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	}
 	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
 		default:
 			return nil, errors.New("tls: found unknown private key type " +
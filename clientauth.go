@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+//errClientCertRejected fails the handshakes of client certificates that do
+// not verify
+var errClientCertRejected = errors.New("Client certificate rejected")
+
+//client authentication modes of ClientAuth
+const (
+	clientAuthNone    = "none"
+	clientAuthRequest = "request"
+	clientAuthRequire = "require"
+)
+
+//ClientAuth governs the certificates requestors authenticate to a host with.
+// Mode is "none" (default), "request", asking for a certificate and verifying
+// it if one is presented, or "require", refusing requestors without a valid
+// one. CAs names the CA bundles, imported into the keystore with the
+// TrustedCert command, that certificates must chain up to. CRLs lists files
+// of PEM or DER encoded CRLs that certificates are checked against. Headers
+// names the headers the verified certificate is forwarded to downstreams in.
+type ClientAuth struct {
+	Mode    string
+	CAs     []string
+	CRLs    []string
+	Headers ClientCertHeaders
+}
+
+//ClientCertHeaders names the headers that carry the identity of a verified
+// client certificate to downstreams, each left out when blank. Subject is the
+// subject DN, SANs the subject alternative names, Serial the serial number in
+// hex and Fingerprint the SHA-256 hash of the certificate in hex. XFCC carries
+// them in the X-Forwarded-Client-Cert format along with the URL encoded PEM.
+// Requestors' own copies of these headers are always dropped.
+type ClientCertHeaders struct {
+	Subject     string
+	SANs        string
+	Serial      string
+	Fingerprint string
+	XFCC        string
+}
+
+//names returns the header names that are set
+func (headers ClientCertHeaders) names() []string {
+	var names []string
+	for _, name := range []string{headers.Subject, headers.SANs, headers.Serial,
+		headers.Fingerprint, headers.XFCC} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func validateClientCertHeaders(headers ClientCertHeaders) error {
+	seen := make(map[string]bool)
+	for _, name := range headers.names() {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("Header %#v is not a valid header name", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if seen[canonical] {
+			return fmt.Errorf("Header %#v is named more than once", name)
+		}
+		seen[canonical] = true
+		for _, hopHeader := range hopHeaders {
+			if canonical == hopHeader {
+				return fmt.Errorf("Header %#v is a hop-by-hop header", name)
+			}
+		}
+	}
+	return nil
+}
+
+//set drops the requestor's copies of the headers from header and sets them
+// off cert, unless cert is nil
+func (headers ClientCertHeaders) set(header http.Header, cert *x509.Certificate) {
+	for _, name := range headers.names() {
+		header.Del(name)
+	}
+	if cert == nil {
+		return
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	if headers.Subject != "" {
+		header.Set(headers.Subject, headerSafe(cert.Subject.String()))
+	}
+	if headers.SANs != "" {
+		if sans := subjectAltNames(cert); len(sans) > 0 {
+			header.Set(headers.SANs, headerSafe(strings.Join(sans, ", ")))
+		}
+	}
+	if headers.Serial != "" {
+		header.Set(headers.Serial, fmt.Sprintf("%x", cert.SerialNumber))
+	}
+	if headers.Fingerprint != "" {
+		header.Set(headers.Fingerprint, hex.EncodeToString(fingerprint[:]))
+	}
+	if headers.XFCC != "" {
+		header.Set(headers.XFCC, xfccElement(cert, fingerprint[:]))
+	}
+}
+
+//subjectAltNames lists the SANs of cert as "DNS=", "URI=", "Email=" and "IP="
+// prefixed values
+func subjectAltNames(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS="+name)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI="+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "Email="+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP="+ip.String())
+	}
+	return sans
+}
+
+//xfccElement renders cert as an element of the X-Forwarded-Client-Cert
+// header: its hash, URL encoded PEM, subject and URI and DNS SANs
+func xfccElement(cert *x509.Certificate, fingerprint []byte) string {
+	quote := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	element := fmt.Sprintf("Hash=%s;Cert=\"%s\";Subject=\"%s\"", hex.EncodeToString(fingerprint),
+		url.PathEscape(string(certPEM)), quote(headerSafe(cert.Subject.String())))
+	for _, uri := range cert.URIs {
+		element += ";URI=" + url.PathEscape(uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		element += ";DNS=" + url.PathEscape(name)
+	}
+	return element
+}
+
+//headerSafe percent encodes the control characters of value, which have no
+// place in a header, along with "%" itself so that the value decodes back
+func headerSafe(value string) string {
+	var safe strings.Builder
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' || c == 0x7f || c == '%' {
+			fmt.Fprintf(&safe, "%%%02X", c)
+		} else {
+			safe.WriteByte(c)
+		}
+	}
+	return safe.String()
+}
+
+//clientAuthRank orders the modes from the most lenient to the strictest
+func clientAuthRank(mode string) int {
+	switch mode {
+	case clientAuthRequest:
+		return 1
+	case clientAuthRequire:
+		return 2
+	}
+	return 0
+}
+
+func validateClientAuthMode(mode string) error {
+	switch mode {
+	case "", clientAuthNone, clientAuthRequest, clientAuthRequire:
+		return nil
+	}
+	return fmt.Errorf("Mode %#v is neither \"none\", \"request\" nor \"require\"", mode)
+}
+
+//validateClientAuth checks the ClientAuth of hostMap along with the modes its
+// MethodPathMaps set. A route may ask for more than its host but not less,
+// as the handshake is over by the time the route is known.
+func validateClientAuth(hostMap HostMap) error {
+	if modeErr := validateClientAuthMode(hostMap.ClientAuth.Mode); modeErr != nil {
+		return modeErr
+	}
+	handshakeMode := hostMap.ClientAuth.Mode
+	for _, methodPathMap := range hostMap.MethodPathMaps {
+		if modeErr := validateClientAuthMode(methodPathMap.ClientAuth); modeErr != nil {
+			return fmt.Errorf("ClientAuth of %#v is invalid: %v", methodPathMap.Path, modeErr)
+		}
+		if methodPathMap.ClientAuth != "" &&
+			clientAuthRank(methodPathMap.ClientAuth) < clientAuthRank(hostMap.ClientAuth.Mode) {
+			return fmt.Errorf("ClientAuth of %#v is %#v, which is more lenient than the "+
+				"host's %#v", methodPathMap.Path, methodPathMap.ClientAuth, hostMap.ClientAuth.Mode)
+		}
+		if clientAuthRank(methodPathMap.ClientAuth) > clientAuthRank(handshakeMode) {
+			handshakeMode = methodPathMap.ClientAuth
+		}
+	}
+	if clientAuthRank(handshakeMode) > 0 && len(hostMap.ClientAuth.CAs) == 0 {
+		return fmt.Errorf("CAs must name the CA bundles client certificates are verified against")
+	}
+	if _, crlErr := loadCRLs(hostMap.ClientAuth.CRLs); crlErr != nil {
+		return crlErr
+	}
+	return validateClientCertHeaders(hostMap.ClientAuth.Headers)
+}
+
+//clientCRL is a CRL along with the DER of its issuer's name and the serial
+// numbers it revokes
+type clientCRL struct {
+	list    *pkix.CertificateList
+	issuer  []byte
+	revoked map[string]bool
+}
+
+//loadCRLs reads the CRLs of files
+func loadCRLs(files []string) ([]*clientCRL, error) {
+	var crls []*clientCRL
+	for _, file := range files {
+		content, readErr := ioutil.ReadFile(file)
+		if readErr != nil {
+			return nil, fmt.Errorf("CRL %#v could not be read: %v", file, readErr)
+		}
+		list, parseErr := x509.ParseCRL(content)
+		if parseErr != nil {
+			return nil, fmt.Errorf("CRL %#v could not be parsed: %v", file, parseErr)
+		}
+		issuer, marshalErr := asn1.Marshal(list.TBSCertList.Issuer)
+		if marshalErr != nil {
+			return nil, fmt.Errorf("CRL %#v has an invalid issuer: %v", file, marshalErr)
+		}
+		crl := &clientCRL{list: list, issuer: issuer, revoked: make(map[string]bool)}
+		for _, revoked := range list.TBSCertList.RevokedCertificates {
+			crl.revoked[revoked.SerialNumber.String()] = true
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+//revokes reports whether crl, signed by issuer, revokes cert
+func (crl *clientCRL) revokes(cert, issuer *x509.Certificate) bool {
+	return bytes.Equal(crl.issuer, issuer.RawSubject) && crl.revoked[cert.SerialNumber.String()] &&
+		issuer.CheckCRLSignature(crl.list) == nil
+}
+
+//clientCertVerifier verifies client certificates against the CA bundles of
+// the keystore named by cas and the crls. The bundles are looked up in store
+// so that keystore reloads are picked up.
+type clientCertVerifier struct {
+	cas   []string
+	crls  []*clientCRL
+	store *certStore
+	roots atomic.Value
+}
+
+//rootPool is the pool of roots built off the CA bundles of a snapshot
+type rootPool struct {
+	snapshot *certSnapshot
+	pool     *x509.CertPool
+}
+
+//rootsFor returns the pool of the CA bundles of snapshot, built once per
+// snapshot
+func (verifier *clientCertVerifier) rootsFor(snapshot *certSnapshot) (*x509.CertPool, error) {
+	if cached, _ := verifier.roots.Load().(rootPool); cached.snapshot == snapshot &&
+		cached.pool != nil {
+		return cached.pool, nil
+	}
+	pool := x509.NewCertPool()
+	found := false
+	for _, name := range verifier.cas {
+		for _, caCert := range snapshot.caBundles[name] {
+			pool.AddCert(caCert)
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("None of the CA bundles %v are in the keystore", verifier.cas)
+	}
+	verifier.roots.Store(rootPool{snapshot: snapshot, pool: pool})
+	return pool, nil
+}
+
+//verify checks that certs, leaf first, chain up to one of the CAs, are meant
+// for client authentication and are not revoked by any of the CRLs
+func (verifier *clientCertVerifier) verify(certs []*x509.Certificate, now time.Time) error {
+	snapshot := verifier.store.snapshot()
+	if snapshot == nil {
+		return fmt.Errorf("No CA bundles loaded to verify client certificates against")
+	}
+	roots, rootsErr := verifier.rootsFor(snapshot)
+	if rootsErr != nil {
+		return rootsErr
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, verifyErr := certs[0].Verify(x509.VerifyOptions{Roots: roots,
+		Intermediates: intermediates, CurrentTime: now,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if verifyErr != nil {
+		return fmt.Errorf("Client certificate could not be verified: %v", verifyErr)
+	}
+	if len(verifier.crls) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		if !verifier.revoked(chain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Client certificate %s has been revoked", certs[0].SerialNumber)
+}
+
+//revoked reports whether a certificate of chain is revoked by its issuer
+func (verifier *clientCertVerifier) revoked(chain []*x509.Certificate) bool {
+	for i := 0; i+1 < len(chain); i++ {
+		for _, crl := range verifier.crls {
+			if crl.revokes(chain[i], chain[i+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//clientAuthenticator authenticates the requestors of a host. mode is the
+// host's own and handshakeMode the strictest of it and its routes' modes,
+// which decides whether a certificate is asked for in the handshake. headers
+// carry verified certificates on to downstreams.
+type clientAuthenticator struct {
+	mode          string
+	handshakeMode string
+	verifier      *clientCertVerifier
+	headers       ClientCertHeaders
+}
+
+//newClientAuthenticator builds the clientAuthenticator of a validated hostMap
+func newClientAuthenticator(hostMap HostMap, store *certStore) (*clientAuthenticator, error) {
+	auth := &clientAuthenticator{mode: hostMap.ClientAuth.Mode,
+		handshakeMode: hostMap.ClientAuth.Mode, headers: hostMap.ClientAuth.Headers}
+	for _, methodPathMap := range hostMap.MethodPathMaps {
+		if clientAuthRank(methodPathMap.ClientAuth) > clientAuthRank(auth.handshakeMode) {
+			auth.handshakeMode = methodPathMap.ClientAuth
+		}
+	}
+	crls, crlErr := loadCRLs(hostMap.ClientAuth.CRLs)
+	if crlErr != nil {
+		return nil, crlErr
+	}
+	auth.verifier = &clientCertVerifier{cas: hostMap.ClientAuth.CAs, crls: crls, store: store}
+	return auth, nil
+}
+
+//configure has tlsConfig ask for client certificates as the host and its
+// routes need them. Certificates are verified in VerifyConnection, against
+// the CA bundles of the current keystore snapshot, rather than by crypto/tls.
+func (auth *clientAuthenticator) configure(tlsConfig *tls.Config) {
+	switch auth.handshakeMode {
+	case clientAuthRequest:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case clientAuthRequire:
+		//routes requiring a certificate of a host that does not are refused
+		// over HTTP instead, so that the rest of the host stays open
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		if auth.mode == clientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+	default:
+		return
+	}
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		if verifyErr := auth.verifier.verify(state.PeerCertificates, time.Now()); verifyErr != nil {
+			return fmt.Errorf("%w: %v", errClientCertRejected, verifyErr)
+		}
+		return nil
+	}
+}
+
+//routeMode returns the mode of a route, the host's unless the route sets one
+func (auth *clientAuthenticator) routeMode(mode string) string {
+	if mode == "" {
+		return auth.mode
+	}
+	return mode
+}
+
+//authorize checks the client certificate of r against mode and returns its
+// leaf if it was verified, nil if none was presented or a route of mode
+// "none" had no need to verify it. A certificate verified in the handshake
+// for this very host, as handshakeVerified says, is trusted as is; one
+// presented to another host is verified afresh.
+func (auth *clientAuthenticator) authorize(r *http.Request, mode string,
+	handshakeVerified bool) (*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	if r.TLS != nil {
+		certs = r.TLS.PeerCertificates
+	}
+	if len(certs) == 0 {
+		if mode == clientAuthRequire {
+			return nil, fmt.Errorf("Client certificate required")
+		}
+		return nil, nil
+	}
+	if handshakeVerified {
+		return certs[0], nil
+	}
+	if clientAuthRank(mode) == 0 {
+		return nil, nil
+	}
+	if verifyErr := auth.verifier.verify(certs, time.Now()); verifyErr != nil {
+		return nil, verifyErr
+	}
+	return certs[0], nil
+}
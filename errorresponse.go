@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+//ErrorResponse configures the body a host answers failed requests with.
+// Format is one of "text" (default), "json" or "template". The "template"
+// format renders the template file at Template and serves it with
+// ContentType, which defaults to "text/html; charset=utf-8". HTML templates
+// are parsed with html/template so that the host and path the requestor sent
+// are escaped.
+type ErrorResponse struct {
+	Format      string
+	Template    string
+	ContentType string
+}
+
+//formats supported by ErrorResponse
+const (
+	errorFormatText     = "text"
+	errorFormatJSON     = "json"
+	errorFormatTemplate = "template"
+)
+
+//requestIDHeader carries the ID Silly tags each request with. It is passed on
+// to the downstream and returned to the requestor on failures.
+const requestIDHeader = "X-Request-Id"
+
+//errorDetails is what an error response body is rendered from
+type errorDetails struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id"`
+	Host       string `json:"-"`
+	Path       string `json:"-"`
+}
+
+//errorResponder writes failed requests' responses in the format configured
+// for a host
+type errorResponder struct {
+	format      string
+	template    errorTemplate
+	contentType string
+}
+
+//errorTemplate is a text/template or an html/template
+type errorTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+//isHTMLContentType reports whether contentType is an HTML media type
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, parseErr := mime.ParseMediaType(contentType)
+	if parseErr != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	return strings.Contains(mediaType, "html")
+}
+
+func newErrorResponder(config ErrorResponse) (*errorResponder, error) {
+	switch config.Format {
+	case "", errorFormatText:
+		return &errorResponder{format: errorFormatText}, nil
+	case errorFormatJSON:
+		return &errorResponder{format: errorFormatJSON}, nil
+	case errorFormatTemplate:
+		if config.Template == "" {
+			return nil, fmt.Errorf("ErrorResponse format \"template\" needs a Template file")
+		}
+		contentType := config.ContentType
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		var parsed errorTemplate
+		var parseErr error
+		if isHTMLContentType(contentType) {
+			parsed, parseErr = htmltemplate.ParseFiles(config.Template)
+		} else {
+			parsed, parseErr = template.ParseFiles(config.Template)
+		}
+		if parseErr != nil {
+			return nil, fmt.Errorf("ErrorResponse template %#v failed to parse: %v",
+				config.Template, parseErr)
+		}
+		return &errorResponder{format: errorFormatTemplate, template: parsed,
+			contentType: contentType}, nil
+	default:
+		return nil, fmt.Errorf("Unknown ErrorResponse format %#v", config.Format)
+	}
+}
+
+//respond writes status along with an error body describing the failure.
+// gRPC calls are answered with the matching grpc-status instead.
+func (responder *errorResponder) respond(w http.ResponseWriter, r *http.Request,
+	status int, message string, requestID string) {
+	details := errorDetails{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  requestID,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	if isGRPCRequest(r) {
+		writeGRPCError(w, r, status, message)
+		return
+	}
+	var body []byte
+	switch responder.format {
+	case errorFormatJSON:
+		body, _ = json.Marshal(details)
+		w.Header().Set("Content-Type", "application/json")
+	case errorFormatTemplate:
+		var rendered bytes.Buffer
+		renderErr := responder.template.Execute(&rendered, details)
+		if renderErr == nil {
+			body = rendered.Bytes()
+			w.Header().Set("Content-Type", responder.contentType)
+			break
+		}
+		log.Printf("Error template failed to render for request %s: %v", requestID, renderErr)
+		fallthrough
+	default:
+		body = []byte(fmt.Sprintf("Request Failed: %s (request id %s)", message, requestID))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, writeErr := w.Write(body); writeErr != nil {
+		log.Printf("Error response could not be written for request %s: %v", requestID, writeErr)
+	}
+}
+
+//statusForUpstreamError maps a failure to obtain a response from a downstream
+// onto the status to answer with. Timeouts map to 504 and everything else that
+// went wrong on the way to the downstream (refused connections, DNS, TLS or
+// protocol errors) maps to 502.
+func statusForUpstreamError(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+//newRequestID returns a random 128 bit request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, readErr := rand.Read(id); readErr != nil {
+		log.Printf("Request ID could not be generated: %v", readErr)
+	}
+	return hex.EncodeToString(id)
+}
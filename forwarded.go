@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//hopHeaders are the RFC 7230 hop-by-hop headers. They describe a single
+// connection and are never passed on by Silly in either direction.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//trustedProxies lists the networks of proxies in front of Silly. Forwarding
+// headers of requests arriving from these are extended, those of any other
+// requestor are discarded and replaced.
+var trustedProxies []*net.IPNet
+
+//parseTrustedProxies parses a comma separated list of CIDRs. Plain IPs are
+// taken as a network of their own.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Trusted proxy %#v is neither an IP nor a CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, parseErr := net.ParseCIDR(entry)
+		if parseErr != nil {
+			return nil, fmt.Errorf("Trusted proxy %#v is not a valid CIDR: %v", entry, parseErr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//isTrustedProxy reports whether ip belongs to one of trustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//removeHopHeaders deletes the hop-by-hop headers from header, along with the
+// ones the Connection header names
+func removeHopHeaders(header http.Header) {
+	for _, connectionValue := range header.Values("Connection") {
+		for _, token := range strings.Split(connectionValue, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				header.Del(token)
+			}
+		}
+	}
+	for _, hopHeader := range hopHeaders {
+		header.Del(hopHeader)
+	}
+}
+
+//headerHasToken reports whether any value of the comma separated header key
+// holds token, compared case insensitively
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, element := range strings.Split(value, ",") {
+			//parameters such as a q-value do not matter here
+			element = strings.TrimSpace(strings.SplitN(element, ";", 2)[0])
+			if strings.EqualFold(element, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host
+// and the RFC 7239 Forwarded header of req, the outbound request built for r.
+// The values a trusted proxy sent along are extended with the requestor's,
+// anything else the requestor claimed is replaced.
+func setForwardedHeaders(req *http.Request, r *http.Request) {
+	clientIP := r.RemoteAddr
+	if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+		clientIP = host
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	trusted := isTrustedProxy(net.ParseIP(clientIP))
+
+	forwardedFor := clientIP
+	forwarded := forwardedElement(clientIP, r.Host, proto)
+	forwardedProto, forwardedHost := proto, r.Host
+	if trusted {
+		if prior := strings.Join(r.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			forwardedFor = prior + ", " + forwardedFor
+		}
+		if prior := strings.Join(r.Header.Values("Forwarded"), ", "); prior != "" {
+			forwarded = prior + ", " + forwarded
+		}
+		//the proto and host a trusted proxy saw are the ones the requestor
+		// actually used
+		if prior := r.Header.Get("X-Forwarded-Proto"); prior != "" {
+			forwardedProto = prior
+		}
+		if prior := r.Header.Get("X-Forwarded-Host"); prior != "" {
+			forwardedHost = prior
+		}
+	}
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	req.Header.Set("X-Forwarded-Proto", forwardedProto)
+	req.Header.Set("X-Forwarded-Host", forwardedHost)
+	req.Header.Set("Forwarded", forwarded)
+}
+
+//forwardedElement renders a single RFC 7239 forwarded-element
+func forwardedElement(clientIP, host, proto string) string {
+	//IPv6 nodes are bracketed and, like any value that is not a token, quoted
+	node := clientIP
+	if ip := net.ParseIP(clientIP); ip != nil && ip.To4() == nil {
+		node = "\"[" + clientIP + "]\""
+	}
+	return fmt.Sprintf("for=%s;host=%s;proto=%s", node, forwardedValue(host), proto)
+}
+
+//forwardedValue quotes value unless it is a valid RFC 7230 token
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+		}
+	}
+	return value
+}
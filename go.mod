@@ -1,9 +1,16 @@
 module github.com/ChandraNarreddy/sillyproxy
 
-go 1.16
+go 1.17
 
 require (
 	github.com/ChandraNarreddy/sillyproxy/utility v0.0.0-20210430120824-b77059e6aaa8
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/pavel-v-chernykh/keystore-go/v4 v4.1.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 )
+
+require golang.org/x/text v0.13.0 // indirect
+
+//utility is developed alongside the proxy, build against the copy in this tree
+replace github.com/ChandraNarreddy/sillyproxy/utility => ./utility
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//HealthCheck configures how a route watches the health of its Upstreams.
+// Active probes are sent to Path every Interval seconds when Path is set; a
+// target is ejected after UnhealthyThreshold failed probes in a row and brought
+// back after HealthyThreshold successful ones. Passive outlier detection ejects
+// a target for EjectionTime seconds after Consecutive5xx server errors or
+// ConsecutiveErrors transport errors (refused or reset connections, early EOFs
+// and timeouts) in a row. A target coming back has its
+// share of traffic ramped up over SlowStart seconds.
+type HealthCheck struct {
+	Path               string
+	Interval           uint
+	Timeout            uint
+	HealthyThreshold   uint
+	UnhealthyThreshold uint
+	Consecutive5xx     uint
+	ConsecutiveErrors  uint
+	EjectionTime       uint
+	SlowStart          uint
+}
+
+//defaults for HealthCheck attributes left unset
+const (
+	defaultProbeInterval      = 10
+	defaultProbeTimeout       = 2
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	defaultEjectionTime       = 30
+)
+
+func (check HealthCheck) withDefaults() HealthCheck {
+	if check.Interval == 0 {
+		check.Interval = defaultProbeInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultProbeTimeout
+	}
+	if check.HealthyThreshold == 0 {
+		check.HealthyThreshold = defaultHealthyThreshold
+	}
+	if check.UnhealthyThreshold == 0 {
+		check.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if check.EjectionTime == 0 {
+		check.EjectionTime = defaultEjectionTime
+	}
+	return check
+}
+
+func validateHealthCheck(check HealthCheck) error {
+	if check.Path != "" && !strings.HasPrefix(check.Path, "/") {
+		return fmt.Errorf("HealthCheck path %#v must begin with \"/\"", check.Path)
+	}
+	return nil
+}
+
+//upstreamHealth tracks the health of an upstreamTarget as seen by the active
+// probes and by the requests proxied to it
+type upstreamHealth struct {
+	mutex             sync.Mutex
+	healthy           bool
+	probeSuccesses    uint
+	probeFailures     uint
+	consecutive5xx    uint
+	consecutiveErrors uint
+	ejectedUntil      time.Time
+	recoveredAt       time.Time
+}
+
+//admit tells whether the target may take a request at the given time. While
+// a recovered target is slow starting it is admitted with a probability that
+// grows linearly over the slowStart window.
+func (health *upstreamHealth) admit(now time.Time, slowStart time.Duration) bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if !health.healthy || now.Before(health.ejectedUntil) {
+		return false
+	}
+	if slowStart > 0 && now.Sub(health.recoveredAt) < slowStart {
+		share := float64(now.Sub(health.recoveredAt)) / float64(slowStart)
+		if share < 0.1 {
+			share = 0.1
+		}
+		return rand.Float64() < share
+	}
+	return true
+}
+
+func (health *upstreamHealth) available(now time.Time) bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.healthy && !now.Before(health.ejectedUntil)
+}
+
+//probed records the outcome of an active probe and reports whether the
+// target's health flipped
+func (health *upstreamHealth) probed(success bool, check HealthCheck,
+	now time.Time) (flipped bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if success {
+		health.probeFailures = 0
+		health.probeSuccesses++
+		if !health.healthy && health.probeSuccesses >= check.HealthyThreshold {
+			health.healthy = true
+			health.recoveredAt = now
+			return true
+		}
+		return false
+	}
+	health.probeSuccesses = 0
+	health.probeFailures++
+	if health.healthy && health.probeFailures >= check.UnhealthyThreshold {
+		health.healthy = false
+		return true
+	}
+	return false
+}
+
+//observed records the outcome of a proxied request for passive outlier
+// detection and reports whether the target got ejected. Only a response below
+// 500 clears the counts.
+func (health *upstreamHealth) observed(statusCode int, transportErr bool,
+	check HealthCheck, now time.Time) (ejected bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	switch {
+	case transportErr:
+		health.consecutiveErrors++
+	case statusCode >= 500:
+		health.consecutive5xx++
+	default:
+		health.consecutiveErrors = 0
+		health.consecutive5xx = 0
+		return false
+	}
+	if (check.ConsecutiveErrors > 0 && health.consecutiveErrors >= check.ConsecutiveErrors) ||
+		(check.Consecutive5xx > 0 && health.consecutive5xx >= check.Consecutive5xx) {
+		health.consecutiveErrors = 0
+		health.consecutive5xx = 0
+		health.ejectedUntil = now.Add(time.Duration(check.EjectionTime) * time.Second)
+		//the ramp up begins once the ejection is over
+		health.recoveredAt = health.ejectedUntil
+		return true
+	}
+	return false
+}
+
+//upstreamHealthStatus is the health of an upstreamTarget as reported on the
+// admin listener
+type upstreamHealthStatus struct {
+	Host         string
+	Method       string
+	Path         string
+	Target       string
+	Weight       int
+	Healthy      bool
+	Ejected      bool
+	EjectedUntil *time.Time `json:",omitempty"`
+	Outstanding  int64
+}
+
+//upstreamPool ties a route's upstreamTargets to the balancer that picks
+// among them and to the health checks that watch over them
+type upstreamPool struct {
+	host      string
+	method    string
+	path      string
+	targets   []*upstreamTarget
+	balancer  upstreamBalancer
+	check     HealthCheck
+	prober    *http.Client
+	quit      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+//newUpstreamPool builds the upstreamPool for a MethodPathMap that lists Upstreams
+func newUpstreamPool(host string, methodPathMap MethodPathMap,
+	prober *http.Client) (*upstreamPool, error) {
+	targets, targetsErr := newUpstreamTargets(methodPathMap.Upstreams)
+	if targetsErr != nil {
+		return nil, targetsErr
+	}
+	balancer, balancerErr := newUpstreamBalancer(targets, methodPathMap.Balancer)
+	if balancerErr != nil {
+		return nil, balancerErr
+	}
+	if checkErr := validateHealthCheck(methodPathMap.HealthCheck); checkErr != nil {
+		return nil, checkErr
+	}
+	return &upstreamPool{
+		host:     host,
+		method:   methodPathMap.Method,
+		path:     methodPathMap.Path,
+		targets:  targets,
+		balancer: balancer,
+		check:    methodPathMap.HealthCheck.withDefaults(),
+		prober:   prober,
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+//pick returns the target for a request, skipping targets that are unhealthy,
+// ejected or not admitted while slow starting. It returns nil when no target
+// is available.
+func (pool *upstreamPool) pick(r *http.Request) *upstreamTarget {
+	now := time.Now()
+	slowStart := time.Duration(pool.check.SlowStart) * time.Second
+	for i := 0; i < 2*len(pool.targets); i++ {
+		if target := pool.balancer.next(r); target.health.admit(now, slowStart) {
+			return target
+		}
+	}
+	//the balancer kept landing on targets that are out, settle for any
+	// target that is available
+	offset := rand.Intn(len(pool.targets))
+	for i := range pool.targets {
+		if target := pool.targets[(offset+i)%len(pool.targets)]; target.health.available(now) {
+			return target
+		}
+	}
+	return nil
+}
+
+//observe feeds the outcome of a proxied request to passive outlier detection.
+// Any failure to get a response counts against the target, not just failures
+// to connect.
+func (pool *upstreamPool) observe(target *upstreamTarget, resp *http.Response, respErr error) {
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	} else if errors.Is(respErr, context.Canceled) {
+		// the requestor went away, that says nothing about the target
+		return
+	}
+	if target.health.observed(statusCode, respErr != nil, pool.check, time.Now()) {
+		log.Printf("Upstream %s of %s %s for host %s ejected for %ds by outlier detection",
+			target.target, pool.method, pool.path, pool.host, pool.check.EjectionTime)
+	}
+}
+
+//isConnectError reports whether err is a failure to connect to a downstream
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return err != nil && errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+//start sends active probes to every target until the pool is stopped. It is a
+// no-op if the pool has no probe path configured.
+func (pool *upstreamPool) start() {
+	if pool.check.Path == "" {
+		return
+	}
+	pool.startOnce.Do(func() {
+		go pool.sendProbes()
+	})
+}
+
+func (pool *upstreamPool) sendProbes() {
+	ticker := time.NewTicker(time.Duration(pool.check.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.quit:
+			return
+		case <-ticker.C:
+			for _, target := range pool.targets {
+				go pool.probe(target)
+			}
+		}
+	}
+}
+
+func (pool *upstreamPool) probe(target *upstreamTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(pool.check.Timeout)*time.Second)
+	defer cancel()
+	success := false
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet,
+		target.upstreamURL(pool.check.Path), nil)
+	if reqErr == nil {
+		resp, respErr := pool.prober.Do(req)
+		if respErr == nil {
+			resp.Body.Close()
+			success = resp.StatusCode >= 200 && resp.StatusCode < 400
+		}
+	}
+	if target.health.probed(success, pool.check, time.Now()) {
+		state := "unhealthy"
+		if success {
+			state = "healthy"
+		}
+		log.Printf("Upstream %s of %s %s for host %s is now %s", target.target,
+			pool.method, pool.path, pool.host, state)
+	}
+}
+
+//adoptHealth carries the health of the targets of the pool in previous that
+// serves the same host, method, path and targets over to pool, so that
+// ejections, failure counts and probe results survive a routes reload. It
+// must be called before pool is started.
+func (pool *upstreamPool) adoptHealth(previous []*upstreamPool) {
+	for _, old := range previous {
+		if old.host != pool.host || old.method != pool.method || old.path != pool.path ||
+			!sameTargets(old.targets, pool.targets) {
+			continue
+		}
+		healths := make(map[string]*upstreamHealth, len(old.targets))
+		for _, target := range old.targets {
+			healths[target.target] = target.health
+		}
+		for _, target := range pool.targets {
+			target.health = healths[target.target]
+		}
+		return
+	}
+}
+
+//sameTargets reports whether a and b balance over the same targets
+func sameTargets(a, b []*upstreamTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, target := range a {
+		counts[target.target]++
+	}
+	for _, target := range b {
+		if counts[target.target] == 0 {
+			return false
+		}
+		counts[target.target]--
+	}
+	return true
+}
+
+func (pool *upstreamPool) stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.quit)
+	})
+}
+
+func (pool *upstreamPool) status() []upstreamHealthStatus {
+	now := time.Now()
+	statuses := make([]upstreamHealthStatus, 0, len(pool.targets))
+	for _, target := range pool.targets {
+		target.health.mutex.Lock()
+		status := upstreamHealthStatus{
+			Host:        pool.host,
+			Method:      pool.method,
+			Path:        pool.path,
+			Target:      target.target,
+			Weight:      target.weight,
+			Healthy:     target.health.healthy,
+			Ejected:     now.Before(target.health.ejectedUntil),
+			Outstanding: atomic.LoadInt64(&target.outstanding),
+		}
+		if status.Ejected {
+			ejectedUntil := target.health.ejectedUntil
+			status.EjectedUntil = &ejectedUntil
+		}
+		target.health.mutex.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/ChandraNarreddy/sillyproxy/utility"
 )
@@ -14,13 +16,15 @@ func main() {
 
 	hostname := flag.String("hostname", "",
 		"Hostname under which the pem content needs to be written to."+
-			"Leave blank if you wish this certificate to be bound as default")
+			"Leave blank if you wish this certificate to be bound as default. "+
+			"Use \"client:name\" for a client certificate presented to downstreams. "+
+			"Names the CA bundle for the TrustedCert command")
 
 	keyStorePass := flag.String("keypass", "", "Password to the keystore")
 
 	minTLSVer := flag.Uint("minTLSver", 1,
 		"global configuration for minimum TLS version - \n\t"+
-			"1 for 1.1, \n\t 2 for 1.2, \n\t3 for 1.3. \n\t Default is 1.1")
+			"0 for 1.0, \n\t1 for 1.1, \n\t 2 for 1.2, \n\t3 for 1.3. \n\t Default is 1.1")
 
 	bindAddr := flag.String("bind", ":443", "address and port to bind")
 
@@ -32,6 +36,51 @@ func main() {
 
 	routeMapFilePath := flag.String("routes", "", "path to routes map file")
 
+	adminBind := flag.String("adminBind", "",
+		"address and port for the admin listener (upstream health and metrics). Disabled if blank")
+
+	httpBind := flag.String("httpBind", "",
+		"address and port for the cleartext listener that redirects to HTTPS and "+
+			"answers ACME HTTP-01 challenges. Disabled if blank")
+
+	acmeWebrootDir := flag.String("acmeWebroot", "",
+		"directory an external ACME client writes HTTP-01 challenge tokens to")
+
+	acmeDirectory := flag.String("acmeDirectory", "",
+		"ACME directory URL to obtain certificates for hosts with ACME enabled from. "+
+			"Disabled if blank")
+
+	acmeEmail := flag.String("acmeEmail", "", "contact email for the ACME account")
+
+	acmeAccountKey := flag.String("acmeAccountKey", "",
+		"PEM file with the ACME account key. Generated if missing")
+
+	acmeCA := flag.String("acmeCA", "",
+		"PEM file of CAs to trust for the ACME directory instead of the system roots")
+
+	acmeChallengeList := flag.String("acmeChallenges", "tls-alpn-01,http-01",
+		"comma separated ACME challenge types to answer, in order of preference")
+
+	trustedProxyList := flag.String("trustedProxies", "",
+		"comma separated CIDRs of proxies in front of Silly whose X-Forwarded-* and "+
+			"Forwarded headers are extended rather than replaced")
+
+	ticketKeys := flag.String("ticketKeys", "",
+		"file of base64 encoded session ticket keys, one per line, the first of which "+
+			"encrypts new tickets. The keystore's ticket keys are used if blank")
+
+	ticketKeysKept := flag.Int("ticketKeysKept", 3,
+		"number of session ticket keys the TicketKey command keeps in the keystore")
+
+	ocspStaple := flag.Bool("ocspStapling", true,
+		"fetch the OCSP responses of the certificates served and staple them")
+
+	ocspCache := flag.String("ocspCacheDir", "",
+		"directory to cache OCSP responses in across restarts. Held in memory only if blank")
+
+	shutdownGrace := flag.Uint("shutdownGrace", 30,
+		"seconds to wait for in-flight requests to complete on shutdown")
+
 	// let us parse the flags
 	flag.Parse()
 
@@ -46,6 +95,19 @@ func main() {
 				log.Printf(err.Error())
 			}
 			return
+		case "TrustedCert", "trustedcert":
+			err := utility.ImportCABundle(*keyStoreFile, *hostname, *pemCertFile,
+				[]byte(*keyStorePass))
+			if err != nil {
+				log.Printf(err.Error())
+			}
+			return
+		case "TicketKey", "ticketkey":
+			err := utility.AddTicketKey(*keyStoreFile, []byte(*keyStorePass), *ticketKeysKept)
+			if err != nil {
+				log.Printf(err.Error())
+			}
+			return
 		}
 	}
 	/***profiling code
@@ -58,9 +120,33 @@ func main() {
 	}
 	defer pprof.StopCPUProfile()
 	*****profiling****/
+	shutdownGracePeriod = time.Duration(*shutdownGrace) * time.Second
+	adminBindAddr = *adminBind
+	httpBindAddr = *httpBind
+	ticketKeyFile = *ticketKeys
+	ocspStapling = *ocspStaple
+	ocspCacheDir = *ocspCache
+	acmeWebroot = *acmeWebrootDir
+	acmeSettings = acmeOptions{directoryURL: *acmeDirectory, email: *acmeEmail,
+		accountKeyFile: *acmeAccountKey, caBundle: *acmeCA}
+	var acmeChallengesErr error
+	if acmeSettings.challenges, acmeChallengesErr = parseACMEChallenges(*acmeChallengeList); acmeChallengesErr != nil {
+		log.Fatalf("SillyProxy failed with error: %#v", acmeChallengesErr.Error())
+	}
+	var trustedProxiesErr error
+	if trustedProxies, trustedProxiesErr = parseTrustedProxies(*trustedProxyList); trustedProxiesErr != nil {
+		log.Fatalf("SillyProxy failed with error: %#v", trustedProxiesErr.Error())
+	}
 	sillyProxy, sillyProxyErr := SillyProxy(keyStoreFile, keyStorePass, minTLSVer, bindAddr, routeMapFilePath)
 	if sillyProxyErr != nil {
 		log.Fatalf("SillyProxy failed with error: %#v", sillyProxyErr.Error())
 	}
-	log.Fatal(sillyProxy.ListenAndServeTLS("", "").Error())
+	serveErr := sillyProxy.ListenAndServeTLS("", "")
+	if serveErr != http.ErrServerClosed {
+		log.Fatal(serveErr.Error())
+	}
+	//the listener is closed as soon as shutdown begins, wait for the drain
+	if drainErr := <-proxyDrained; drainErr != nil {
+		log.Fatal(drainErr.Error())
+	}
 }
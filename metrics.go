@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ChandraNarreddy/sillyproxy/utility"
+)
+
+//metricSeries are the series of a metric by their label values
+type metricSeries struct {
+	mutex  sync.RWMutex
+	series map[string]interface{}
+}
+
+//get returns the series of values, creating it with create if there is none
+func (vec *metricSeries) get(values []string, create func() interface{}) interface{} {
+	key := strings.Join(values, "\xff")
+	vec.mutex.RLock()
+	series, exists := vec.series[key]
+	vec.mutex.RUnlock()
+	if exists {
+		return series
+	}
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	if series, exists = vec.series[key]; !exists {
+		if vec.series == nil {
+			vec.series = make(map[string]interface{})
+		}
+		series = create()
+		vec.series[key] = series
+	}
+	return series
+}
+
+//each calls fn on every series in the order of their label values
+func (vec *metricSeries) each(fn func(values []string, series interface{})) {
+	vec.mutex.RLock()
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	vec.mutex.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		vec.mutex.RLock()
+		series := vec.series[key]
+		vec.mutex.RUnlock()
+		fn(strings.Split(key, "\xff"), series)
+	}
+}
+
+//counter is a metric that only goes up
+type counter struct {
+	value uint64
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+//counterVec is a counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	metricSeries
+}
+
+func (vec *counterVec) with(values ...string) *counter {
+	return vec.get(values, func() interface{} { return &counter{} }).(*counter)
+}
+
+func (vec *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", vec.name, vec.help, vec.name)
+	vec.each(func(values []string, series interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", vec.name, formatLabels(vec.labels, values),
+			atomic.LoadUint64(&series.(*counter).value))
+	})
+}
+
+//gauge is a metric that goes up and down
+type gauge struct {
+	value int64
+}
+
+func (g *gauge) add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+//gaugeVec is a gauge partitioned by labels
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	metricSeries
+}
+
+func (vec *gaugeVec) with(values ...string) *gauge {
+	return vec.get(values, func() interface{} { return &gauge{} }).(*gauge)
+}
+
+func (vec *gaugeVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", vec.name, vec.help, vec.name)
+	vec.each(func(values []string, series interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", vec.name, formatLabels(vec.labels, values),
+			atomic.LoadInt64(&series.(*gauge).value))
+	})
+}
+
+//histogram counts observations into buckets by their upper bound
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+func (h *histogram) observe(value float64) {
+	bucket := sort.SearchFloat64s(h.buckets, value)
+	if bucket < len(h.buckets) {
+		atomic.AddUint64(&h.counts[bucket], 1)
+	}
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+//histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	metricSeries
+}
+
+func (vec *histogramVec) with(values ...string) *histogram {
+	return vec.get(values, func() interface{} {
+		return &histogram{buckets: vec.buckets, counts: make([]uint64, len(vec.buckets))}
+	}).(*histogram)
+}
+
+func (vec *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", vec.name, vec.help, vec.name)
+	bucketLabels := append(append([]string{}, vec.labels...), "le")
+	vec.each(func(values []string, series interface{}) {
+		h := series.(*histogram)
+		count := atomic.LoadUint64(&h.count)
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, formatLabels(bucketLabels,
+				append(append([]string{}, values...), formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, formatLabels(bucketLabels,
+			append(append([]string{}, values...), "+Inf")), count)
+		labels := formatLabels(vec.labels, values)
+		fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", vec.name, labels,
+			formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sumBits))), vec.name, labels, count)
+	})
+}
+
+//formatLabels renders the labels of a series in the Prometheus text format
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = label + "=\"" + escape(value) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//tlsVersionNames names the TLS versions handshakes are counted by
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+//proxyMetrics are the metrics Silly exposes on the admin listener's /metrics.
+// The type of the certificate served to a connection is kept against its
+// addresses in certTypes until its handshake is counted, which happens as
+// soon as it completes or fails.
+type proxyMetrics struct {
+	requests          *counterVec
+	requestDuration   *histogramVec
+	inFlight          *gaugeVec
+	connectErrors     *counterVec
+	handshakes        *counterVec
+	handshakeFailures *counterVec
+	sniMisses         *counterVec
+	certTypes         sync.Map
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests: &counterVec{name: "sillyproxy_requests_total",
+			help:   "Requests by host, route and status.",
+			labels: []string{"host", "route", "status"}},
+		requestDuration: &histogramVec{name: "sillyproxy_request_duration_seconds",
+			help:   "Time taken to answer requests by host, route and status.",
+			labels: []string{"host", "route", "status"}, buckets: latencyBuckets},
+		inFlight: &gaugeVec{name: "sillyproxy_requests_in_flight",
+			help: "Requests being answered by host.", labels: []string{"host"}},
+		connectErrors: &counterVec{name: "sillyproxy_upstream_connect_errors_total",
+			help:   "Failed attempts to connect to downstreams by host and route.",
+			labels: []string{"host", "route"}},
+		handshakes: &counterVec{name: "sillyproxy_tls_handshakes_total",
+			help:   "TLS handshakes by version, cipher suite and type of certificate served.",
+			labels: []string{"version", "cipher", "cert_type"}},
+		handshakeFailures: &counterVec{name: "sillyproxy_tls_handshake_failures_total",
+			help:   "TLS handshakes that failed by reason.",
+			labels: []string{"reason"}},
+		sniMisses: &counterVec{name: "sillyproxy_tls_sni_misses_total",
+			help: "TLS handshakes whose server name matched no certificate and got a default one."},
+	}
+}
+
+//metrics are the metrics of this Silly
+var metrics = newProxyMetrics()
+
+//unmatched is the route requests no route answers are counted against, 404s
+// and 405s of the router among them, and the host of requests to hosts that
+// match no HostMap
+const unmatched = "unmatched"
+
+//requestRecord is what the handlers of a request note of it for it to be
+// accounted for once answered: the route that answered it, the ID it is
+// tagged with and the downstream it went to
+type requestRecord struct {
+	route           string
+	requestID       string
+	upstream        string
+	upstreamLatency time.Duration
+}
+
+//requestRecordKey is the context key of a request's requestRecord
+type requestRecordKey struct{}
+
+//recordOf returns the requestRecord of r, a blank one if it has none
+func recordOf(r *http.Request) *requestRecord {
+	if record, exists := r.Context().Value(requestRecordKey{}).(*requestRecord); exists {
+		return record
+	}
+	return &requestRecord{requestID: newRequestID()}
+}
+
+//account serves r through serve and accounts for it once it has been
+// answered, whichever handler answered it: it is counted in the metrics
+// against host along with its latency and logged to accessLog. Upgraded
+// connections are accounted for once their tunnel closes.
+func account(host string, accessLog *accessLogger, w http.ResponseWriter, r *http.Request,
+	serve http.HandlerFunc) {
+	start := time.Now()
+	inFlight := metrics.inFlight.with(host)
+	inFlight.add(1)
+	defer inFlight.add(-1)
+	record := &requestRecord{route: unmatched, requestID: newRequestID()}
+	recorder := &statusRecorder{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, record))
+	serve(recorder, r)
+	status := strconv.Itoa(recorder.statusCode())
+	metrics.requests.with(host, record.route, status).inc()
+	metrics.requestDuration.with(host, record.route, status).observe(time.Since(start).Seconds())
+	accessLog.log(newAccessLogEntry(r, record, recorder, start))
+}
+
+//certServed notes the type of the certificate served to the requestor of
+// helloInfo for its handshake to be counted by, and counts an SNI miss if it
+// is a default certificate served for a server name
+func (m *proxyMetrics) certServed(helloInfo *tls.ClientHelloInfo, certType string,
+	isDefault bool) {
+	if helloInfo.Conn != nil {
+		m.certTypes.Store(connKey(helloInfo.Conn), certType)
+	}
+	if isDefault && helloInfo.ServerName != "" {
+		m.sniMisses.with().inc()
+	}
+}
+
+//connKey identifies conn by both its addresses, which the TLS connection
+// shares with the one underneath it
+func connKey(conn net.Conn) string {
+	return conn.LocalAddr().String() + "|" + conn.RemoteAddr().String()
+}
+
+//connState has the handshake of every new TLS connection counted, whether or
+// not a request follows. It is the ConnState of the TLS listener.
+func (m *proxyMetrics) connState(conn net.Conn, state http.ConnState) {
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS && state == http.StateNew {
+		go m.countHandshake(tlsConn)
+	}
+}
+
+//countHandshake waits for the handshake of conn and counts it, or its failure.
+// crypto/tls runs a handshake once however many ask for it, so this shares
+// the outcome of the server's own and is held to the server's deadlines.
+func (m *proxyMetrics) countHandshake(conn *tls.Conn) {
+	handshakeErr := conn.Handshake()
+	served, recorded := m.certTypes.LoadAndDelete(connKey(conn))
+	if handshakeErr != nil {
+		m.handshakeFailures.with(handshakeFailureReason(handshakeErr)).inc()
+		return
+	}
+	connState := conn.ConnectionState()
+	certType := "resumed"
+	if recorded {
+		certType = served.(string)
+	} else if !connState.DidResume {
+		certType = "unknown"
+	}
+	version, known := tlsVersionNames[connState.Version]
+	if !known {
+		version = fmt.Sprintf("0x%04x", connState.Version)
+	}
+	m.handshakes.with(version, tls.CipherSuiteName(connState.CipherSuite), certType).inc()
+}
+
+//handshakeFailureReason sorts a failed handshake by handshakeErr into
+// client_certificate, no_certificate, timeout, closed or other
+func handshakeFailureReason(handshakeErr error) string {
+	var netErr net.Error
+	switch {
+	//crypto/tls fails handshakes missing a required client certificate
+	// with an error of its own
+	case errors.Is(handshakeErr, errClientCertRejected),
+		strings.Contains(handshakeErr.Error(), "client didn't provide a certificate"):
+		return "client_certificate"
+	case errors.Is(handshakeErr, errNoCertToServe):
+		return "no_certificate"
+	case errors.As(handshakeErr, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(handshakeErr, io.EOF), errors.Is(handshakeErr, io.ErrUnexpectedEOF),
+		errors.Is(handshakeErr, syscall.ECONNRESET), errors.Is(handshakeErr, net.ErrClosed):
+		return "closed"
+	}
+	return "other"
+}
+
+//write renders the metrics in the Prometheus text format, along with the
+// expiry of the certificates of store
+func (m *proxyMetrics) write(w io.Writer, store *certStore) {
+	m.requests.write(w)
+	m.requestDuration.write(w)
+	m.inFlight.write(w)
+	m.connectErrors.write(w)
+	m.handshakes.write(w)
+	m.handshakeFailures.write(w)
+	m.sniMisses.write(w)
+	writeCertExpiry(w, store.snapshot())
+}
+
+//writeCertExpiry renders the expiry of every certificate of snapshot by alias
+func writeCertExpiry(w io.Writer, snapshot *certSnapshot) {
+	const name = "sillyproxy_certificate_expiry_timestamp_seconds"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name,
+		"Time the certificates of the keystore expire at, in seconds since the epoch.", name)
+	if snapshot == nil {
+		return
+	}
+	certs := make(map[string]*tls.Certificate)
+	for alias, cert := range snapshot.certs {
+		certs[alias] = cert
+	}
+	for alias, cert := range snapshot.clientCerts {
+		certs[utility.ClientCertAliasPrefix+alias] = cert
+	}
+	for _, certType := range certTypes {
+		if cert := snapshot.defaultCert(certType); cert != nil {
+			certs["default:"+certType] = cert
+		}
+	}
+	aliases := make([]string, 0, len(certs))
+	for alias := range certs {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		cert := certs[alias]
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels([]string{"alias"}, []string{alias}),
+			leaf.NotAfter.Unix())
+	}
+}
+
+//metricsHandler serves the metrics of Silly
+func metricsHandler(m *proxyMetrics, store *certStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buffered := bufio.NewWriter(w)
+		m.write(buffered, store)
+		buffered.Flush()
+	}
+}
+
+//statusRecorder records the status a handler answers with and the bytes of
+// body it writes. Flushing and hijacking are passed through to the
+// ResponseWriter it wraps.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, writeErr := recorder.ResponseWriter.Write(b)
+	recorder.written += int64(n)
+	return n, writeErr
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	conn, rw, hijackErr := hijacker.Hijack()
+	if hijackErr == nil && recorder.status == 0 {
+		recorder.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, hijackErr
+}
+
+//statusCode returns the status recorded, 200 if the handler wrote nothing
+func (recorder *statusRecorder) statusCode() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+//ocspStapling turns fetching and stapling the OCSP responses of the
+// certificates served on
+var ocspStapling = true
+
+//ocspCacheDir is the directory OCSP responses are cached in across restarts.
+// They are only held in memory when it is left blank.
+var ocspCacheDir string
+
+//ocspRefreshInterval is how often, in seconds, staples are looked at and the
+// ones due refreshed. Certificates loaded in the meantime get theirs then.
+const ocspRefreshInterval = 5 * 60
+
+//ocspNoNextUpdateRefresh is when a response that carries no nextUpdate is
+// refreshed, counting from its thisUpdate
+const ocspNoNextUpdateRefresh = time.Hour
+
+//ocspResponseLimit caps the size of the responses read off OCSP responders
+const ocspResponseLimit = 1 << 20
+
+//oidTLSFeature is the TLS Feature extension of RFC 7633 that Must-Staple
+// certificates carry, and statusRequestFeature the status_request feature
+var (
+	oidTLSFeature        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+	statusRequestFeature = 5
+)
+
+//errOCSPRevoked is returned for OCSP responses that report the certificate
+// revoked
+var errOCSPRevoked = errors.New("Certificate was revoked")
+
+//ocspStaple is a verified OCSP response with a "good" status
+type ocspStaple struct {
+	raw        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+//validAt reports whether the staple can still be served at now
+func (staple *ocspStaple) validAt(now time.Time) bool {
+	return staple.nextUpdate.IsZero() || now.Before(staple.nextUpdate)
+}
+
+//refreshDue reports whether the staple is halfway through its validity at
+// now, by when a fresh response is fetched
+func (staple *ocspStaple) refreshDue(now time.Time) bool {
+	if staple.nextUpdate.IsZero() {
+		return !now.Before(staple.thisUpdate.Add(ocspNoNextUpdateRefresh))
+	}
+	return !now.Before(staple.thisUpdate.Add(staple.nextUpdate.Sub(staple.thisUpdate) / 2))
+}
+
+//ocspStore holds the staples of the certificates served against the DER of
+// their leaf. A nil store staples nothing.
+type ocspStore struct {
+	mutex    sync.RWMutex
+	staples  map[string]*ocspStaple
+	cacheDir string
+	client   *http.Client
+}
+
+func newOCSPStore(cacheDir string) *ocspStore {
+	return &ocspStore{staples: make(map[string]*ocspStaple), cacheDir: cacheDir,
+		client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+//ocspStaples are the staples returnCert serves certificates with. It is nil
+// when stapling is turned off.
+var ocspStaples *ocspStore
+
+//staple returns cert with its OCSP response stapled if it has a valid one,
+// and whether cert can be served at all. Must-Staple certificates are not
+// served without a staple as clients honouring Must-Staple refuse them.
+func (store *ocspStore) staple(cert *tls.Certificate, now time.Time) (*tls.Certificate, bool) {
+	if store == nil || len(cert.Certificate) == 0 {
+		return cert, true
+	}
+	store.mutex.RLock()
+	staple := store.staples[string(cert.Certificate[0])]
+	store.mutex.RUnlock()
+	if staple != nil && staple.validAt(now) {
+		//certificates of a published snapshot are never modified
+		stapled := *cert
+		stapled.OCSPStaple = staple.raw
+		return &stapled, true
+	}
+	return cert, cert.Leaf == nil || !isMustStaple(cert.Leaf)
+}
+
+//isMustStaple reports whether leaf asks for its OCSP response to be stapled
+func isMustStaple(leaf *x509.Certificate) bool {
+	for _, extension := range leaf.Extensions {
+		if !extension.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, unmarshalErr := asn1.Unmarshal(extension.Value, &features); unmarshalErr != nil {
+			return false
+		}
+		for _, feature := range features {
+			if feature == statusRequestFeature {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//servedCerts returns the certificates of snapshot served to requestors, the
+// defaults included, once each
+func servedCerts(snapshot *certSnapshot) []*tls.Certificate {
+	seen := make(map[*tls.Certificate]bool)
+	var certs []*tls.Certificate
+	add := func(cert *tls.Certificate) {
+		if cert != nil && !seen[cert] && len(cert.Certificate) > 0 {
+			seen[cert] = true
+			certs = append(certs, cert)
+		}
+	}
+	for _, cert := range snapshot.certs {
+		add(cert)
+	}
+	for _, certType := range certTypes {
+		add(snapshot.defaultCert(certType))
+	}
+	return certs
+}
+
+//update brings the staples in line with the certificates of snapshot.
+// Staples missing from memory are looked up in the cache directory and, if
+// fetch is set, the ones missing or due are fetched from the OCSP responder
+// of their certificate. A staple that fails to refresh is kept until it
+// expires, unless the responder reports the certificate revoked, in which case
+// it is dropped along with its cached copy. Staples of certificates no longer
+// served are dropped.
+func (store *ocspStore) update(snapshot *certSnapshot, now time.Time, fetch bool) {
+	if store == nil || snapshot == nil {
+		return
+	}
+	store.mutex.RLock()
+	current := store.staples
+	store.mutex.RUnlock()
+	staples := make(map[string]*ocspStaple)
+	for _, cert := range servedCerts(snapshot) {
+		der := string(cert.Certificate[0])
+		if _, done := staples[der]; done {
+			continue
+		}
+		leaf, parseErr := x509.ParseCertificate(cert.Certificate[0])
+		if parseErr != nil || len(leaf.OCSPServer) == 0 {
+			continue
+		}
+		if len(cert.Certificate) < 2 {
+			if isMustStaple(leaf) {
+				log.Printf("Must-Staple certificate for %v carries no issuer to request its OCSP "+
+					"response with and will not be served", leaf.DNSNames)
+			}
+			continue
+		}
+		issuer, parseErr := x509.ParseCertificate(cert.Certificate[1])
+		if parseErr != nil {
+			continue
+		}
+		staple := current[der]
+		if staple == nil {
+			staple = store.readCache(leaf, issuer, now)
+		}
+		if fetch && (staple == nil || staple.refreshDue(now)) {
+			fetched, fetchErr := store.fetch(leaf, issuer, now)
+			if errors.Is(fetchErr, errOCSPRevoked) {
+				log.Printf("Certificate for %v is revoked, its OCSP staple is dropped: %v",
+					leaf.DNSNames, fetchErr)
+				staple = nil
+				store.removeCache(leaf)
+			} else if fetchErr != nil {
+				log.Printf("OCSP response for %v could not be fetched: %v", leaf.DNSNames, fetchErr)
+			} else {
+				staple = fetched
+				store.writeCache(leaf, fetched)
+			}
+		}
+		if staple != nil && staple.validAt(now) {
+			staples[der] = staple
+		} else if fetch && isMustStaple(leaf) {
+			log.Printf("Must-Staple certificate for %v has no OCSP response to staple and "+
+				"will not be served", leaf.DNSNames)
+		}
+	}
+	store.mutex.Lock()
+	store.staples = staples
+	store.mutex.Unlock()
+}
+
+//parseStaple verifies raw as the OCSP response for leaf signed on behalf of
+// issuer and returns it as a staple if the certificate is good at now
+func parseStaple(raw []byte, leaf, issuer *x509.Certificate, now time.Time) (*ocspStaple, error) {
+	response, parseErr := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if parseErr != nil {
+		return nil, fmt.Errorf("OCSP response is invalid: %v", parseErr)
+	}
+	switch response.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, fmt.Errorf("%w at %v", errOCSPRevoked, response.RevokedAt)
+	default:
+		return nil, fmt.Errorf("Certificate is unknown to the OCSP responder")
+	}
+	staple := &ocspStaple{raw: raw, thisUpdate: response.ThisUpdate,
+		nextUpdate: response.NextUpdate}
+	if !staple.validAt(now) {
+		return nil, fmt.Errorf("OCSP response expired at %v", response.NextUpdate)
+	}
+	return staple, nil
+}
+
+//fetch requests the OCSP response of leaf from its first OCSP responder
+func (store *ocspStore) fetch(leaf, issuer *x509.Certificate, now time.Time) (*ocspStaple, error) {
+	request, requestErr := ocsp.CreateRequest(leaf, issuer, nil)
+	if requestErr != nil {
+		return nil, fmt.Errorf("OCSP request could not be built: %v", requestErr)
+	}
+	resp, postErr := store.client.Post(leaf.OCSPServer[0], "application/ocsp-request",
+		bytes.NewReader(request))
+	if postErr != nil {
+		return nil, postErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s answered with status %d",
+			leaf.OCSPServer[0], resp.StatusCode)
+	}
+	raw, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, ocspResponseLimit))
+	if readErr != nil {
+		return nil, readErr
+	}
+	return parseStaple(raw, leaf, issuer, now)
+}
+
+//cacheFile returns the file the OCSP response of leaf is cached in, named
+// after the SHA-256 hash of the leaf
+func (store *ocspStore) cacheFile(leaf *x509.Certificate) string {
+	hash := sha256.Sum256(leaf.Raw)
+	return filepath.Join(store.cacheDir, hex.EncodeToString(hash[:])+".ocsp")
+}
+
+//readCache returns the cached staple of leaf, nil if there is no cache, no
+// cached response or it no longer holds
+func (store *ocspStore) readCache(leaf, issuer *x509.Certificate, now time.Time) *ocspStaple {
+	if store.cacheDir == "" {
+		return nil
+	}
+	raw, readErr := ioutil.ReadFile(store.cacheFile(leaf))
+	if readErr != nil {
+		return nil
+	}
+	staple, parseErr := parseStaple(raw, leaf, issuer, now)
+	if parseErr != nil {
+		log.Printf("Cached OCSP response for %v is discarded: %v", leaf.DNSNames, parseErr)
+		return nil
+	}
+	return staple
+}
+
+//writeCache caches staple for leaf. The response is written to a temporary
+// file and renamed into place so that a restart never reads half of it.
+func (store *ocspStore) writeCache(leaf *x509.Certificate, staple *ocspStaple) {
+	if store.cacheDir == "" {
+		return
+	}
+	file := store.cacheFile(leaf)
+	if mkdirErr := os.MkdirAll(store.cacheDir, 0700); mkdirErr != nil {
+		log.Printf("OCSP cache directory %s could not be created: %v", store.cacheDir, mkdirErr)
+		return
+	}
+	writeErr := ioutil.WriteFile(file+".tmp", staple.raw, 0600)
+	if writeErr == nil {
+		writeErr = os.Rename(file+".tmp", file)
+	}
+	if writeErr != nil {
+		log.Printf("OCSP response for %v could not be cached: %v", leaf.DNSNames, writeErr)
+	}
+}
+
+//removeCache removes the cached response of leaf, if there is one
+func (store *ocspStore) removeCache(leaf *x509.Certificate) {
+	if store.cacheDir == "" {
+		return
+	}
+	if removeErr := os.Remove(store.cacheFile(leaf)); removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Printf("Cached OCSP response for %v could not be removed: %v", leaf.DNSNames, removeErr)
+	}
+}
+
+//refreshOCSPStaples updates the staples of the certificates of store right
+// away and then once every n seconds
+func refreshOCSPStaples(store *certStore, staples *ocspStore, quit <-chan struct{}, n uint) {
+	staples.update(store.snapshot(), time.Now(), true)
+	ticker := time.NewTicker(time.Duration(n) * time.Second)
+	for {
+		select {
+		case <-quit:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			staples.update(store.snapshot(), time.Now(), true)
+		}
+	}
+}
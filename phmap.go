@@ -1,23 +1,209 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync/atomic"
 )
 
-//proxyHanlderMap maps the host names to their http.Handlers
-type proxyHanlderMap map[string]http.Handler
+//proxyHanlderMap maps the host names to their http.Handlers. A host is
+// looked up by its exact name first, then by the longest wildcard covering it
+// ("*.example.com" covers any name ending in ".example.com"), then against the
+// regex hosts ("~api-[0-9]+\.example\.com") in the order of the routes file
+// and lastly the default host "*". Requests to hosts that match none of these
+// are dealt with as unmatched says and logged to accessLog. tlsConfig applies
+// to TLS connections to hosts that have none of their own.
+type proxyHanlderMap struct {
+	hosts     map[string]http.Handler
+	patterns  []hostPattern
+	unmatched UnmatchedHost
+	tlsConfig *serverTLSConfig
+	accessLog *accessLogger
+}
+
+//hostPattern is a regex host along with its handler
+type hostPattern struct {
+	pattern *regexp.Regexp
+	handler http.Handler
+}
+
+//defaultHost is the Host of the HostMap that catches all hosts not otherwise
+// matched
+const defaultHost = "*"
+
+func newProxyHanlderMap() *proxyHanlderMap {
+	return &proxyHanlderMap{hosts: make(map[string]http.Handler)}
+}
+
+//register maps host to handler. Regex hosts, prefixed with "~", are compiled
+// to match host names in full.
+func (PHMap *proxyHanlderMap) register(host string, handler http.Handler) error {
+	if !strings.HasPrefix(host, "~") {
+		PHMap.hosts[hostName(host)] = handler
+		return nil
+	}
+	pattern, compileErr := compileHostPattern(host)
+	if compileErr != nil {
+		return compileErr
+	}
+	PHMap.patterns = append(PHMap.patterns, hostPattern{pattern: pattern, handler: handler})
+	return nil
+}
+
+//compileHostPattern compiles a regex host, matched regardless of case
+func compileHostPattern(host string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)^(?:" + strings.TrimPrefix(host, "~") + ")$")
+}
+
+//hostName returns the name host, a Host header or a server name, is for. The
+// port is dropped, IPv6 literals lose their brackets and names are lowercased
+// and lose the trailing dot of a fully qualified name.
+func hostName(host string) string {
+	if name, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+		host = name
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
 
-func (PHMap proxyHanlderMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+//lookup returns the http.Handler registered for host, nil if there is none.
+// Hosts match regardless of case, port and trailing dot.
+func (PHMap *proxyHanlderMap) lookup(host string) http.Handler {
+	host = hostName(host)
+	if handler := PHMap.hosts[host]; handler != nil {
+		return handler
+	}
+	//wildcards are tried from the longest down
+	for rest := host; strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		if handler := PHMap.hosts["*."+rest]; handler != nil {
+			return handler
+		}
+	}
+	for _, hostPattern := range PHMap.patterns {
+		if hostPattern.pattern.MatchString(host) {
+			return hostPattern.handler
+		}
+	}
+	return PHMap.hosts[defaultHost]
+}
+
+func (PHMap *proxyHanlderMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Check if a http.Handler is registered for the given host.
 	// If yes, use it to handle the request.
-	//r.Host can return host value along with the port number as Host:Port.
-	//hence splitting the value to obtain just the host value [0] at all times.
-	if handler := PHMap[strings.Split(r.Host, ":")[0]]; handler != nil {
+	if handler := PHMap.lookup(r.Host); handler != nil {
 		handler.ServeHTTP(w, r)
 	} else {
 		// Handle host names for which no handler is registered
-		http.Error(w, "Request Forbidden, this request for hostname: "+
-			r.Host+" is in error. Please check your input", 403) // Or Redirect?
+		account(unmatched, PHMap.accessLog, w, r, PHMap.unmatched.serve)
 	}
 }
+
+//UnmatchedHost governs requests to hosts that match no HostMap. Action is
+// "reject" (default) to answer them with 403, or "redirect" to redirect them
+// to Location with Status, 302 by default. Requests are sent to the default
+// host "*" instead whenever the routes define one.
+type UnmatchedHost struct {
+	Action   string
+	Location string
+	Status   int
+}
+
+//actions on requests to unmatched hosts
+const (
+	unmatchedReject   = "reject"
+	unmatchedRedirect = "redirect"
+)
+
+func validateUnmatchedHost(unmatched UnmatchedHost) error {
+	switch unmatched.Action {
+	case "", unmatchedReject:
+	case unmatchedRedirect:
+		if location, parseErr := url.Parse(unmatched.Location); parseErr != nil ||
+			!location.IsAbs() {
+			return fmt.Errorf("Location %#v is not an absolute URL", unmatched.Location)
+		}
+		if redirectErr := validateHTTPRedirect(HTTPRedirect{Status: unmatched.Status}); redirectErr != nil {
+			return redirectErr
+		}
+	default:
+		return fmt.Errorf("Action %#v is neither %#v nor %#v", unmatched.Action,
+			unmatchedReject, unmatchedRedirect)
+	}
+	return nil
+}
+
+func (unmatched UnmatchedHost) serve(w http.ResponseWriter, r *http.Request) {
+	if unmatched.Action == unmatchedRedirect {
+		status := unmatched.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, unmatched.Location, status)
+		return
+	}
+	http.Error(w, "Request Forbidden, this request for hostname: "+
+		r.Host+" is in error. Please check your input", 403)
+}
+
+//routeTable is a proxyHanlderMap along with the upstreamPools of its routes
+type routeTable struct {
+	pHMap *proxyHanlderMap
+	pools []*upstreamPool
+}
+
+//proxyHandler serves each request off the proxyHanlderMap that is current
+// when the request arrives. The map can be swapped atomically at any time,
+// requests already in flight carry on with the map they started on.
+type proxyHandler struct {
+	current atomic.Value
+}
+
+//newProxyHandler publishes pHMap and starts the health checks of its pools
+func newProxyHandler(pHMap *proxyHanlderMap, pools []*upstreamPool) *proxyHandler {
+	pHandler := &proxyHandler{}
+	for _, pool := range pools {
+		pool.start()
+	}
+	pHandler.current.Store(&routeTable{pHMap: pHMap, pools: pools})
+	return pHandler
+}
+
+func (pHandler *proxyHandler) load() *proxyHanlderMap {
+	return pHandler.current.Load().(*routeTable).pHMap
+}
+
+func (pHandler *proxyHandler) upstreamPools() []*upstreamPool {
+	return pHandler.current.Load().(*routeTable).pools
+}
+
+//swap publishes pHMap in place of the current one. Pools unchanged from the
+// current map keep the health of their targets. Health checks of the new
+// pools are started before the swap and those of the old pools stopped after.
+func (pHandler *proxyHandler) swap(pHMap *proxyHanlderMap, pools []*upstreamPool) {
+	previous := pHandler.current.Load().(*routeTable)
+	for _, pool := range pools {
+		pool.adoptHealth(previous.pools)
+		pool.start()
+	}
+	pHandler.current.Store(&routeTable{pHMap: pHMap, pools: pools})
+	for _, pool := range previous.pools {
+		pool.stop()
+	}
+}
+
+//stop stops the health checks of the current pools
+func (pHandler *proxyHandler) stop() {
+	for _, pool := range pHandler.upstreamPools() {
+		pool.stop()
+	}
+}
+
+func (pHandler *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pHandler.load().ServeHTTP(w, r)
+}
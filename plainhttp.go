@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//httpBindAddr is the address of the cleartext listener. The cleartext
+// listener is not started when it is left blank.
+var httpBindAddr string
+
+//acmeWebroot is a directory that an external ACME client writes HTTP-01
+// challenge tokens to. Tokens are looked up there after acmeChallenges.
+var acmeWebroot string
+
+//acmeChallengePath is where ACME servers fetch HTTP-01 challenge tokens from
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+//HTTPRedirect governs requests to a host arriving over the cleartext
+// listener. They are redirected to HTTPS with Status, 301 by default, unless
+// Disabled is set in which case they are proxied over plain HTTP just as if
+// they had arrived over TLS. Host and Port, when set, replace the host and
+// port of the request in the redirect's Location.
+type HTTPRedirect struct {
+	Disabled bool
+	Status   int
+	Host     string
+	Port     uint
+}
+
+func (redirect HTTPRedirect) withDefaults() HTTPRedirect {
+	if redirect.Status == 0 {
+		redirect.Status = http.StatusMovedPermanently
+	}
+	return redirect
+}
+
+func validateHTTPRedirect(redirect HTTPRedirect) error {
+	switch redirect.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("Status %d is not a redirect status", redirect.Status)
+	}
+	if redirect.Port > 65535 {
+		return fmt.Errorf("Port %d is not a valid port", redirect.Port)
+	}
+	if strings.ContainsAny(redirect.Host, ":/") {
+		return fmt.Errorf("Host %#v must be a bare host name", redirect.Host)
+	}
+	return nil
+}
+
+//location returns the HTTPS URL r is redirected to
+func (redirect HTTPRedirect) location(r *http.Request) string {
+	host := r.Host
+	if splitHost, _, splitErr := net.SplitHostPort(r.Host); splitErr == nil {
+		host = splitHost
+	}
+	if redirect.Host != "" {
+		host = redirect.Host
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if redirect.Port != 0 && redirect.Port != 443 {
+		host = host + ":" + strconv.FormatUint(uint64(redirect.Port), 10)
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+//hostHandler routes the requests to a host and carries how the host wants
+// requests over the cleartext listener dealt with, its certificates managed and
+// TLS connections to it set up
+type hostHandler struct {
+	name      string
+	router    http.Handler
+	redirect  HTTPRedirect
+	acme      ACMEHost
+	tlsConfig *serverTLSConfig
+	accessLog *accessLogger
+}
+
+//ServeHTTP routes r, accounted for whether or not a route answers it
+func (handler *hostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account(handler.name, handler.accessLog, w, r, handler.router.ServeHTTP)
+}
+
+//serveCleartext redirects r to HTTPS unless the host opted out of the
+// redirect, in which case r is routed as usual. Redirects are accounted for
+// against the route "redirect".
+func (handler *hostHandler) serveCleartext(w http.ResponseWriter, r *http.Request) {
+	if handler.redirect.Disabled {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	account(handler.name, handler.accessLog, w, r, func(w http.ResponseWriter, r *http.Request) {
+		recordOf(r).route = "redirect"
+		http.Redirect(w, r, handler.redirect.location(r), handler.redirect.Status)
+	})
+}
+
+//challengeStore holds the key authorizations of pending HTTP-01 challenges
+// against their tokens and the certificates of pending TLS-ALPN-01 challenges
+// against their host names
+type challengeStore struct {
+	mutex  sync.RWMutex
+	tokens map[string]string
+	certs  map[string]*tls.Certificate
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{tokens: make(map[string]string),
+		certs: make(map[string]*tls.Certificate)}
+}
+
+//acmeChallenges are the ACME challenges Silly answers, HTTP-01 ones on the
+// cleartext listener and TLS-ALPN-01 ones on the TLS listener
+var acmeChallenges = newChallengeStore()
+
+func (store *challengeStore) set(token, keyAuth string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[token] = keyAuth
+}
+
+func (store *challengeStore) remove(token string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.tokens, token)
+}
+
+func (store *challengeStore) get(token string) (string, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keyAuth, exists := store.tokens[token]
+	return keyAuth, exists
+}
+
+func (store *challengeStore) setCert(host string, cert *tls.Certificate) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.certs[host] = cert
+}
+
+func (store *challengeStore) removeCert(host string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.certs, host)
+}
+
+func (store *challengeStore) getCert(host string) (*tls.Certificate, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	cert, exists := store.certs[host]
+	return cert, exists
+}
+
+//isACMEToken reports whether token is made of base64url characters only, as
+// ACME tokens are. Anything else is refused before touching the webroot.
+func isACMEToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+//acmeChallengeHandler answers HTTP-01 challenges from store, falling back to
+// the files in webroot if one is set
+func acmeChallengeHandler(store *challengeStore, webroot string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+		if !isACMEToken(token) {
+			http.NotFound(w, r)
+			return
+		}
+		keyAuth, exists := store.get(token)
+		if !exists && webroot != "" {
+			content, readErr := ioutil.ReadFile(filepath.Join(webroot, token))
+			if readErr == nil {
+				keyAuth, exists = strings.TrimSpace(string(content)), true
+			}
+		}
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	}
+}
+
+//newPlainServer builds the cleartext listener. It answers ACME HTTP-01
+// challenges for any host and redirects or proxies everything else as the
+// HTTPRedirect of the host asked for says.
+func newPlainServer(bindAddr string, pHandler *proxyHandler) *http.Server {
+	challengeHandler := acmeChallengeHandler(acmeChallenges, acmeWebroot)
+	//a ServeMux is not used as it would clean up paths meant for downstreams
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			challengeHandler(w, r)
+			return
+		}
+		if host, isHost := pHandler.load().lookup(r.Host).(*hostHandler); isHost {
+			host.serveCleartext(w, r)
+			return
+		}
+		pHandler.ServeHTTP(w, r)
+	})
+	return &http.Server{
+		Addr:    bindAddr,
+		Handler: handler,
+		//only the header is bound here, bodies are streamed and bound per
+		// route by its Timeouts
+		ReadHeaderTimeout: 50 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+//shutdownPlainServer drains plainServer within gracePeriod
+func shutdownPlainServer(plainServer *http.Server, gracePeriod time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if shutdownErr := plainServer.Shutdown(ctx); shutdownErr != nil {
+		plainServer.Close()
+		log.Printf("Cleartext connections did not drain within %v: %v", gracePeriod,
+			shutdownErr)
+	}
+}
@@ -2,36 +2,76 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 )
 
-func writeErrorResponse(w http.ResponseWriter, status int) error {
-	w.WriteHeader(status)
-	_, responseWriteErr := w.Write([]byte("Request Failed"))
-	if responseWriteErr != nil {
-		return fmt.Errorf("Response could not be written for inbound request")
-	}
-	return nil
-}
-
+//writeResponse streams the downstream response back to the client. The body
+// is copied as it arrives and flushed after every write so that large
+// downloads, server-sent events and long-polling responses are never staged
+// in memory. Trailers announced by the downstream are relayed after the body.
+// Hop-by-hop headers of the downstream are not passed on.
 func writeResponse(w http.ResponseWriter, resp *http.Response) error {
-	for responseHeaderkey, responseHeaderValues := range resp.Header {
-		responseHeaderValue := responseHeaderValues[0]
-		for i := 1; i < len(responseHeaderValues); i++ {
-			responseHeaderValue = responseHeaderValue + "," + responseHeaderValues[i]
-		}
-		w.Header().Add(responseHeaderkey, responseHeaderValue)
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	//announce the trailers before the header is written. Their values only
+	// become available once the body has been read through.
+	for trailerKey := range resp.Trailer {
+		w.Header().Add("Trailer", trailerKey)
 	}
 	w.WriteHeader(resp.StatusCode)
-	var respBodyBytes []byte
+
 	if resp.Body != nil {
-		respBodyBytes, _ = ioutil.ReadAll(resp.Body)
+		//the header goes out right away, the requestor of a bidirectional
+		// stream may be waiting on it before sending the rest of its body
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		_, copyErr := io.Copy(newFlushWriter(w), resp.Body)
+		if copyErr != nil {
+			return fmt.Errorf("Response could not be streamed for inbound request: %v", copyErr)
+		}
 	}
-	resp.Body.Close()
-	_, responseWriteErr := w.Write(respBodyBytes)
-	if responseWriteErr != nil {
-		return fmt.Errorf("Response could not be written for inbound request")
+
+	//trailers are set using http.TrailerPrefix so that the ones the downstream
+	// sent without announcing are relayed too
+	for trailerKey, trailerValues := range resp.Trailer {
+		for _, trailerValue := range trailerValues {
+			w.Header().Add(http.TrailerPrefix+trailerKey, trailerValue)
+		}
 	}
 	return nil
 }
+
+//copyHeader adds every value of src to dst one by one. Values are never
+// folded into a single comma separated value as that corrupts headers such as
+// Set-Cookie which cannot be folded. Keys are kept exactly as they appear.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append(dst[key], values...)
+	}
+}
+
+//flushWriter flushes the underlying http.ResponseWriter after each write
+// when it supports http.Flusher
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		fw.flusher.Flush()
+	}
+	return n, err
+}
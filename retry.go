@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Timeouts bound the exchange with a route's downstream, in seconds. Connect
+// bounds establishing the connection (TLS handshake included), ResponseHeader
+// the wait for the response's header once the request is sent and Total the
+// whole exchange, retries and streaming the body back included. A Total of 0
+// leaves the exchange unbounded for routes that stream indefinitely. Idle
+// bounds the time the request body being streamed up or the response body
+// being streamed back may go without moving.
+type Timeouts struct {
+	Connect        uint
+	ResponseHeader uint
+	Total          uint
+	Idle           uint
+}
+
+//defaults applied to Timeouts left at 0
+const (
+	defaultConnectTimeout        = 5
+	defaultResponseHeaderTimeout = 500
+	defaultIdleTimeout           = 300
+)
+
+func (timeouts Timeouts) withDefaults() Timeouts {
+	if timeouts.Connect == 0 {
+		timeouts.Connect = defaultConnectTimeout
+	}
+	if timeouts.ResponseHeader == 0 {
+		timeouts.ResponseHeader = defaultResponseHeaderTimeout
+	}
+	if timeouts.Idle == 0 {
+		timeouts.Idle = defaultIdleTimeout
+	}
+	return timeouts
+}
+
+//idleTimeout cancels an exchange once its bodies stop moving for timeout. It
+// is held off while the downstream works on its response, which the
+// ResponseHeader timeout bounds instead.
+type idleTimeout struct {
+	timeout    time.Duration
+	timer      *time.Timer
+	responding int32
+}
+
+//newIdleTimeout returns an idleTimeout calling cancel, not yet running
+func newIdleTimeout(timeout time.Duration, cancel context.CancelFunc) *idleTimeout {
+	idle := &idleTimeout{timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+	idle.timer.Stop()
+	return idle
+}
+
+//touch starts the timeout over
+func (idle *idleTimeout) touch() {
+	idle.timer.Reset(idle.timeout)
+}
+
+//stop lets the exchange be
+func (idle *idleTimeout) stop() {
+	idle.timer.Stop()
+}
+
+//requestBody returns body, starting the timeout over on every read of it. It
+// is held off once body has been read through unless the response is being
+// streamed back already.
+func (idle *idleTimeout) requestBody(body io.ReadCloser) io.ReadCloser {
+	return &idleBody{ReadCloser: body, idle: idle, request: true}
+}
+
+//responseBody returns body, starting the timeout over on every read of it
+func (idle *idleTimeout) responseBody(body io.ReadCloser) io.ReadCloser {
+	atomic.StoreInt32(&idle.responding, 1)
+	idle.touch()
+	return &idleBody{ReadCloser: body, idle: idle}
+}
+
+//idleBody is a body whose reads keep its idleTimeout from running out
+type idleBody struct {
+	io.ReadCloser
+	idle    *idleTimeout
+	request bool
+}
+
+func (body *idleBody) Read(p []byte) (int, error) {
+	n, readErr := body.ReadCloser.Read(p)
+	if body.request && readErr == io.EOF && atomic.LoadInt32(&body.idle.responding) == 0 {
+		body.idle.stop()
+	} else {
+		body.idle.touch()
+	}
+	return n, readErr
+}
+
+//RetryPolicy retries a request on another attempt when the downstream could
+// not be reached or answered with one of the RetryOn statuses. Attempts caps
+// the number of attempts, the first one included; retries are off if it is
+// left at 0 or 1. The wait before the nth retry is a random duration of up to
+// Backoff milliseconds doubled n-1 times, capped at MaxBackoff. Only
+// idempotent methods are retried unless RetryNonIdempotent is set and requests
+// carrying a body are never retried as it has been streamed to the
+// downstream. BudgetPercent caps retries to that percentage of the route's
+// requests over the last 10 seconds, with MinRetriesPerSecond allowed
+// regardless, so that retries cannot pile on to a downstream in trouble.
+type RetryPolicy struct {
+	Attempts            uint
+	Backoff             uint
+	MaxBackoff          uint
+	RetryOn             []int
+	RetryNonIdempotent  bool
+	BudgetPercent       uint
+	MinRetriesPerSecond uint
+}
+
+//defaults applied to RetryPolicy fields left at 0
+const (
+	defaultRetryBackoff        = 25
+	defaultRetryMaxBackoff     = 250
+	defaultRetryBudgetPercent  = 20
+	defaultMinRetriesPerSecond = 3
+	retryBudgetWindow          = 10
+)
+
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.Attempts == 0 {
+		policy.Attempts = 1
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = defaultRetryBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = policy.Backoff
+	}
+	if policy.BudgetPercent == 0 {
+		policy.BudgetPercent = defaultRetryBudgetPercent
+	}
+	if policy.MinRetriesPerSecond == 0 {
+		policy.MinRetriesPerSecond = defaultMinRetriesPerSecond
+	}
+	return policy
+}
+
+func validateRetryPolicy(policy RetryPolicy) error {
+	for _, status := range policy.RetryOn {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("RetryOn status %d is not a valid HTTP status", status)
+		}
+	}
+	if policy.BudgetPercent > 100 {
+		return fmt.Errorf("BudgetPercent %d is over 100", policy.BudgetPercent)
+	}
+	return nil
+}
+
+//isIdempotent reports whether method is idempotent as per RFC 7231
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+//replayable reports whether r may be sent again on a retry
+func (policy RetryPolicy) replayable(r *http.Request) bool {
+	if policy.Attempts < 2 || r.ContentLength != 0 {
+		return false
+	}
+	return policy.RetryNonIdempotent || isIdempotent(r.Method)
+}
+
+//retryOn reports whether a response with status is to be retried
+func (policy RetryPolicy) retryOn(status int) bool {
+	for _, retryStatus := range policy.RetryOn {
+		if status == retryStatus {
+			return true
+		}
+	}
+	return false
+}
+
+//backoff returns the wait before retry number n, counted from 1
+func (policy RetryPolicy) backoff(n uint) time.Duration {
+	ceiling := time.Duration(policy.Backoff) * time.Millisecond
+	for i := uint(1); i < n && ceiling < time.Duration(policy.MaxBackoff)*time.Millisecond; i++ {
+		ceiling = ceiling * 2
+	}
+	if maxBackoff := time.Duration(policy.MaxBackoff) * time.Millisecond; ceiling > maxBackoff {
+		ceiling = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+//waitForRetry sleeps for wait. It returns false if ctx ends before that.
+func waitForRetry(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+//retryBudget counts a route's requests and retries per second over a sliding
+// window of retryBudgetWindow seconds
+type retryBudget struct {
+	mutex      sync.Mutex
+	percent    uint
+	minPerSec  uint
+	seconds    [retryBudgetWindow]int64
+	requests   [retryBudgetWindow]uint
+	retries    [retryBudgetWindow]uint
+	timeSource func() time.Time
+}
+
+func newRetryBudget(policy RetryPolicy) *retryBudget {
+	return &retryBudget{percent: policy.BudgetPercent,
+		minPerSec: policy.MinRetriesPerSecond, timeSource: time.Now}
+}
+
+//slot returns the index of the current second, resetting it if it last
+// counted an earlier second
+func (budget *retryBudget) slot() int {
+	now := budget.timeSource().Unix()
+	index := int(now % retryBudgetWindow)
+	if budget.seconds[index] != now {
+		budget.seconds[index] = now
+		budget.requests[index] = 0
+		budget.retries[index] = 0
+	}
+	return index
+}
+
+//request counts a request to the route
+func (budget *retryBudget) request() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.requests[budget.slot()]++
+}
+
+//withdraw takes a retry out of the budget. It returns false if the budget
+// is spent.
+func (budget *retryBudget) withdraw() bool {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	current := budget.slot()
+	oldest := budget.seconds[current] - retryBudgetWindow
+	var requests, retries uint
+	for i := range budget.seconds {
+		if budget.seconds[i] > oldest {
+			requests += budget.requests[i]
+			retries += budget.retries[i]
+		}
+	}
+	allowed := requests * budget.percent / 100
+	if floor := budget.minPerSec * retryBudgetWindow; allowed < floor {
+		allowed = floor
+	}
+	if retries >= allowed {
+		return false
+	}
+	budget.retries[current]++
+	return true
+}
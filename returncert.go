@@ -2,24 +2,10 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-)
-
-//declaring pointers to point at default cert to optimize for seeking default
-var (
-	//ECDSAdefaultExists is a boolean that represents whether a ECDSA cert for the
-	//default alias exists or not
-	ECDSAdefaultExists = false
-	//ECDSAdefault is used to hold ECDSA cert for default alias. Certs of default
-	//alias are optimized to be grabbed this way instead of being part of certMap
-	ECDSAdefault = &tls.Certificate{}
-
-	//RSAdefaultExists is a boolean that represents whether a RSA cert for the
-	//default alias exists or not
-	RSAdefaultExists = false
-	//RSAdefault is used to hold RSA cert for default alias. Certs of default
-	//alias are optimized to be grabbed this way instead of being part of certMap
-	RSAdefault = &tls.Certificate{}
+	"strings"
+	"time"
 )
 
 //ECDSA, RSA and DSA declared as enums
@@ -29,6 +15,13 @@ const (
 	//DSA   = 3
 )
 
+//certTypes are the kinds of certificate served, in order of preference. They
+// are the suffixes of the aliases certificates are imported under.
+var certTypes = []string{"Ed25519", "ECDSA", "RSA"}
+
+//errNoCertToServe fails the handshakes of requestors no certificate suits
+var errNoCertToServe = errors.New("No certificate to serve")
+
 var (
 	//CiphersECDSA lists cipherSuite (as per http://www.iana.org/assignments/tls-parameters/tls-parameters.xml)
 	//that allow for ECDSA signature based server authentication in TLS handshake
@@ -58,13 +51,22 @@ var (
 
 // returnCert will return the certificate based on the client's hello
 // information. It will check if the certMap has a certificate matching up the
-// servername. If found, it will favour ECDSA over RSA
+// servername, by alias or by the SANs of the certificates, and then one
+// matching up its wildcard before falling back to the default. At each step
+// it will favour Ed25519 over ECDSA and ECDSA over RSA, serving the first the
+// requestor can verify. Must-Staple certs lacking an OCSP response are passed
+// over. The type of the cert served is noted for the handshake metrics
 func returnCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, error) {
 
-	//extract the server name from client hello. Look for supported certificates
-	// from keyXchangeAlg. Return matching certificate in order of priority: ECDSA,
-	// RSA and DSA. Note that if the cert entry does identify the cert type, it is
-	// assumed to be of type RSA.
+	//ACME servers validating a TLS-ALPN-01 challenge get the challenge's cert
+	if cert, isChallenge := alpnChallengeCert(helloInfo); isChallenge {
+		return cert, nil
+	}
+
+	//extract the server name from client hello. Look for certificates the
+	// requestor supports and return the matching one in order of priority:
+	// Ed25519, ECDSA and RSA. Note that if the cert entry does identify the
+	// cert type, it is assumed to be of type RSA.
 	var aliasToLookFor string
 	if helloInfo.ServerName == "" {
 		////////debug////////
@@ -74,50 +76,91 @@ func returnCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		////////debug////////
 		aliasToLookFor = "default"
 	} else {
-		aliasToLookFor = helloInfo.ServerName
+		aliasToLookFor = strings.TrimSuffix(helloInfo.ServerName, ".")
+	}
+
+	//all lookups for this handshake are made against the same snapshot
+	snapshot := certMap.snapshot()
+	if snapshot == nil {
+		return nil, fmt.Errorf("No certificates loaded to serve %#v", helloInfo)
 	}
 
-	var remoteSupportsECDSA, remoteSupportsRSA int = 0, 0
+	//a cert type the host has a cert of but the requestor does not support is
+	// not served off the defaults either
+	remoteRejects := make(map[string]bool, len(certTypes))
+	//certs go out with their OCSP response stapled, if they have one
+	now := time.Now()
 
-	if ecdsa, exists := certMap[aliasToLookFor+":ECDSA"]; exists {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersECDSA) {
-			return &ecdsa, nil
+	for _, name := range []string{aliasToLookFor, wildcardOf(aliasToLookFor)} {
+		if name == "" {
+			continue
 		}
-		remoteSupportsECDSA = -1
-	}
-	if rsa, exists := certMap[aliasToLookFor+":RSA"]; exists {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersRSA) {
-			return &rsa, nil
+		for _, certType := range certTypes {
+			if cert, exists := snapshot.lookup(name, certType); exists {
+				if !supportsCert(helloInfo, cert, certType) {
+					remoteRejects[certType] = true
+				} else if stapled, servable := ocspStaples.staple(cert, now); servable {
+					metrics.certServed(helloInfo, certType, false)
+					return stapled, nil
+				}
+			}
 		}
-		remoteSupportsRSA = -1
 	}
-	/*****
-	if dsa, exists := certMap[aliasToLookFor+":DSA"]; exists {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersDSA) {
-			return &dsa, nil
+	for _, certType := range certTypes {
+		if cert := snapshot.defaultCert(certType); cert != nil && !remoteRejects[certType] {
+			if supportsCert(helloInfo, cert, certType) {
+				if stapled, servable := ocspStaples.staple(cert, now); servable {
+					metrics.certServed(helloInfo, certType, true)
+					return stapled, nil
+				}
+			}
 		}
-		remoteSupportsDSA = -1
 	}
-	*****/
-	if ECDSAdefaultExists && (remoteSupportsECDSA != -1) {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersECDSA) {
-			return ECDSAdefault, nil
+	//return nil, fmt.Errorf("No certificate to serve for %#v", helloInfo.Conn.RemoteAddr().String())
+	return nil, fmt.Errorf("%w for %#v", errNoCertToServe, helloInfo)
+}
+
+//supportsCert reports whether the requestor can verify cert of certType.
+// Requestors offering TLS 1.2 or later along with signature schemes are
+// checked against the versions, signature schemes, curves and cipher suites
+// they offer, which is the only way to tell for TLS 1.3 where cipher suites no
+// longer carry the authentication type. The cipher suites tell for older ones.
+func supportsCert(helloInfo *tls.ClientHelloInfo, cert *tls.Certificate, certType string) bool {
+	if len(helloInfo.SignatureSchemes) == 0 || !offersTLS12(helloInfo.SupportedVersions) {
+		switch certType {
+		case "ECDSA":
+			return isSigAlgSupported(helloInfo.CipherSuites, CiphersECDSA)
+		case "RSA":
+			return isSigAlgSupported(helloInfo.CipherSuites, CiphersRSA)
 		}
+		//Ed25519 needs signature schemes to be negotiated
+		return false
 	}
-	if RSAdefaultExists && (remoteSupportsRSA != -1) {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersRSA) {
-			return RSAdefault, nil
+	//the server name has been matched already and defaults stand in for any
+	// name, so the cert is not checked against it
+	probe := *helloInfo
+	probe.ServerName = ""
+	return probe.SupportsCertificate(cert) == nil
+}
+
+//offersTLS12 reports whether versions has TLS 1.2 or later in it
+func offersTLS12(versions []uint16) bool {
+	for _, version := range versions {
+		if version >= tls.VersionTLS12 {
+			return true
 		}
 	}
-	/**********
-	if DSAdefaultExists && (remoteSupportsDSA != -1) {
-		if isSigAlgSupported(helloInfo.CipherSuites, CiphersDSA) {
-			return DSAdefault, nil
-		}
+	return false
+}
+
+//wildcardOf returns the wildcard name that covers name, "*.example.com" for
+// "api.example.com". It returns blank for names a wildcard cannot cover.
+func wildcardOf(name string) string {
+	dot := strings.Index(name, ".")
+	if dot <= 0 || !strings.Contains(name[dot+1:], ".") {
+		return ""
 	}
-	***********/
-	//return nil, fmt.Errorf("No certificate to serve for %#v", helloInfo.Conn.RemoteAddr().String())
-	return nil, fmt.Errorf("No certificate to serve for %#v", helloInfo)
+	return "*" + name[dot:]
 }
 
 func isSigAlgSupported(cipherSuites []uint16, ciphersListToCompare []uint16) bool {
@@ -3,25 +3,67 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
-//HostMap lists the MethodPathMaps to each Host
+//HostMap lists the MethodPathMaps to each Host. ErrorResponse sets the body
+// failed requests to the Host are answered with and UpstreamTLS the TLS
+// settings for its downstreams. MaxUpgradedConns caps the connections the
+// Host keeps upgraded at a time, it is left uncapped at 0. HTTPRedirect
+// governs requests to the Host arriving over the cleartext listener and ACME
+// has the certificates of the Host obtained and renewed automatically. TLS
+// refines the TLS policy of the routes file for connections to the Host,
+// ClientAuth governs the client certificates its requestors present and
+// AccessLog, when its Output is set, replaces the AccessLog of the routes file
+// for the Host.
 type HostMap struct {
-	Host           string
-	MethodPathMaps []MethodPathMap
+	Host             string
+	MethodPathMaps   []MethodPathMap
+	ErrorResponse    ErrorResponse
+	UpstreamTLS      UpstreamTLS
+	MaxUpgradedConns uint
+	HTTPRedirect     HTTPRedirect
+	ACME             ACMEHost
+	TLS              TLSPolicy
+	ClientAuth       ClientAuth
+	AccessLog        AccessLog
 }
 
-//MethodPathMap maps each inbound method+path combination to backend route
+//MethodPathMap maps each inbound method+path combination to backend route.
+// When Upstreams are listed, Route builds just the path and query which is
+// appended to the Target of the upstream the Balancer picks for the request.
+// UpstreamTLS, when set, replaces the UpstreamTLS of the host for the route.
+// Timeouts and Retry govern the exchange with the route's downstream and
+// Upgrade the requests to the route that ask to switch protocols. Protocol is
+// spoken to the downstream: "http1" (default), "h2" or "h2c". ClientAuth,
+// when set, replaces the Mode of the host's ClientAuth for the route.
 type MethodPathMap struct {
-	Method string
-	Path   string
-	Route  []interface{}
+	Method      string
+	Path        string
+	Route       []interface{}
+	Upstreams   []Upstream
+	Balancer    Balancer
+	HealthCheck HealthCheck
+	UpstreamTLS *UpstreamTLS
+	Timeouts    Timeouts
+	Retry       RetryPolicy
+	Upgrade     UpgradePolicy
+	Protocol    string
+	ClientAuth  string
 }
 
-//RouteMap is a collection of HostMap called Routes
+//RouteMap is a collection of HostMap called Routes. Unmatched governs
+// requests to hosts that none of the Routes match, TLS is the TLS policy
+// for connections to every host and AccessLog logs the requests to every host.
 type RouteMap struct {
-	Routes []HostMap
+	Routes    []HostMap
+	Unmatched UnmatchedHost
+	TLS       TLSPolicy
+	AccessLog AccessLog
 }
 
 func buildRouteMap(routeMapFilePath *string, routeMap *RouteMap) error {
@@ -29,6 +71,7 @@ func buildRouteMap(routeMapFilePath *string, routeMap *RouteMap) error {
 	if fileErr != nil {
 		return fmt.Errorf("\nError while opening routeMapFile -%#v: %#v", *routeMapFilePath, fileErr.Error())
 	}
+	defer routeMapFile.Close()
 	routeMapDecoder := json.NewDecoder(routeMapFile)
 	decodeErr := routeMapDecoder.Decode(routeMap)
 	if decodeErr != nil {
@@ -36,3 +79,193 @@ func buildRouteMap(routeMapFilePath *string, routeMap *RouteMap) error {
 	}
 	return nil
 }
+
+//validateHost checks that host is a plain name, a wildcard such as
+// "*.example.com", a regex prefixed with "~" or the default host "*"
+func validateHost(host string) error {
+	switch {
+	case host == defaultHost:
+	case strings.HasPrefix(host, "~"):
+		if _, compileErr := compileHostPattern(host); compileErr != nil {
+			return compileErr
+		}
+	case strings.HasPrefix(host, "*."):
+		if strings.Contains(host[2:], "*") || len(host) == 2 {
+			return fmt.Errorf("A wildcard may only take the first label")
+		}
+	case strings.Contains(host, "*"):
+		return fmt.Errorf("A wildcard may only take the first label")
+	}
+	return nil
+}
+
+//validateRouteMap checks the routeMap for entries that cannot be registered
+func validateRouteMap(routeMap *RouteMap) error {
+	if unmatchedErr := validateUnmatchedHost(routeMap.Unmatched); unmatchedErr != nil {
+		return fmt.Errorf("Unmatched is invalid: %v", unmatchedErr)
+	}
+	if tlsErr := validateTLSPolicy(routeMap.TLS.withPreset()); tlsErr != nil {
+		return fmt.Errorf("TLS is invalid: %v", tlsErr)
+	}
+	if accessLogErr := validateAccessLog(routeMap.AccessLog); accessLogErr != nil {
+		return fmt.Errorf("AccessLog is invalid: %v", accessLogErr)
+	}
+	hosts := make(map[string]bool)
+	for _, hostMap := range routeMap.Routes {
+		if hostMap.Host == "" {
+			return fmt.Errorf("A HostMap entry is missing its Host")
+		}
+		if hosts[hostMap.Host] {
+			return fmt.Errorf("Host %#v is defined more than once", hostMap.Host)
+		}
+		hosts[hostMap.Host] = true
+		if hostErr := validateHost(hostMap.Host); hostErr != nil {
+			return fmt.Errorf("Host %#v is invalid: %v", hostMap.Host, hostErr)
+		}
+		if _, responderErr := newErrorResponder(hostMap.ErrorResponse); responderErr != nil {
+			return fmt.Errorf("ErrorResponse of host %#v is invalid: %v", hostMap.Host,
+				responderErr)
+		}
+		if _, tlsErr := newUpstreamTLSConfig(hostMap.UpstreamTLS, certMap); tlsErr != nil {
+			return fmt.Errorf("UpstreamTLS of host %#v is invalid: %v", hostMap.Host, tlsErr)
+		}
+		if redirectErr := validateHTTPRedirect(hostMap.HTTPRedirect); redirectErr != nil {
+			return fmt.Errorf("HTTPRedirect of host %#v is invalid: %v", hostMap.Host,
+				redirectErr)
+		}
+		if acmeErr := validateACMEHost(hostMap.Host, hostMap.ACME); acmeErr != nil {
+			return fmt.Errorf("ACME of host %#v is invalid: %v", hostMap.Host, acmeErr)
+		}
+		if tlsErr := validateTLSPolicy(resolveTLSPolicy(routeMap.TLS,
+			hostMap.TLS)); tlsErr != nil {
+			return fmt.Errorf("TLS of host %#v is invalid: %v", hostMap.Host, tlsErr)
+		}
+		if clientAuthErr := validateClientAuth(hostMap); clientAuthErr != nil {
+			return fmt.Errorf("ClientAuth of host %#v is invalid: %v", hostMap.Host, clientAuthErr)
+		}
+		if accessLogErr := validateAccessLog(hostMap.AccessLog); accessLogErr != nil {
+			return fmt.Errorf("AccessLog of host %#v is invalid: %v", hostMap.Host, accessLogErr)
+		}
+		for _, methodPathMap := range hostMap.MethodPathMaps {
+			if methodPathMap.Method == "" {
+				return fmt.Errorf("MethodPathMap %#v of host %#v is missing its Method",
+					methodPathMap.Path, hostMap.Host)
+			}
+			if !strings.HasPrefix(methodPathMap.Path, "/") {
+				return fmt.Errorf("Path %#v of host %#v must begin with \"/\"",
+					methodPathMap.Path, hostMap.Host)
+			}
+			if methodPathMap.UpstreamTLS != nil {
+				if _, tlsErr := newUpstreamTLSConfig(*methodPathMap.UpstreamTLS,
+					certMap); tlsErr != nil {
+					return fmt.Errorf("UpstreamTLS of %#v for host %#v is invalid: %v",
+						methodPathMap.Path, hostMap.Host, tlsErr)
+				}
+			}
+			if protocolErr := validateProtocol(methodPathMap.Protocol); protocolErr != nil {
+				return fmt.Errorf("Protocol of %#v for host %#v is invalid: %v",
+					methodPathMap.Path, hostMap.Host, protocolErr)
+			}
+			if retryErr := validateRetryPolicy(methodPathMap.Retry); retryErr != nil {
+				return fmt.Errorf("Retry of %#v for host %#v is invalid: %v",
+					methodPathMap.Path, hostMap.Host, retryErr)
+			}
+			if len(methodPathMap.Upstreams) > 0 {
+				if _, poolErr := newUpstreamPool(hostMap.Host, methodPathMap,
+					nil); poolErr != nil {
+					return fmt.Errorf("Upstreams of %#v for host %#v are invalid: %v",
+						methodPathMap.Path, hostMap.Host, poolErr)
+				}
+			}
+			for _, element := range methodPathMap.Route {
+				switch T := element.(type) {
+				case string:
+				case float64:
+					if T < 0 || T != math.Trunc(T) {
+						return fmt.Errorf("Route of %#v for host %#v has an invalid "+
+							"param index %v", methodPathMap.Path, hostMap.Host, T)
+					}
+				default:
+					return fmt.Errorf("Route of %#v for host %#v has element %#v "+
+						"that is neither string nor number", methodPathMap.Path,
+						hostMap.Host, T)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//buildProxyHandlerMap builds, validates and registers the routes file into a
+// proxyHanlderMap. The map and the upstreamPools of its routes are returned
+// only if every route made it through.
+func buildProxyHandlerMap(routeMapFilePath *string) (pHMap *proxyHanlderMap,
+	pools []*upstreamPool, err error) {
+	routeMap := &RouteMap{}
+	if err = buildRouteMap(routeMapFilePath, routeMap); err != nil {
+		return nil, nil, err
+	}
+	if err = validateRouteMap(routeMap); err != nil {
+		return nil, nil, err
+	}
+	// httprouter panics on conflicting or malformed paths. Such a routes file
+	// is rejected rather than allowed to bring down the process.
+	defer func() {
+		if r := recover(); r != nil {
+			pHMap, pools = nil, nil
+			err = fmt.Errorf("Route registration failed: %v", r)
+		}
+	}()
+	pHMap = newProxyHanlderMap()
+	pools = assignRoutes(pHMap, routeMap)
+	return pHMap, pools, nil
+}
+
+//reloadRouteMap polls the routes file every n seconds and swaps a freshly
+// built proxyHanlderMap into pHandler whenever the file changes on disk or a
+// reload is signalled. A routes file that fails to build is logged and
+// ignored so the current routes keep serving.
+func reloadRouteMap(routeMapFilePath *string, pHandler *proxyHandler,
+	reload <-chan os.Signal, quit <-chan struct{}, n uint) {
+	ticker := time.NewTicker(time.Duration(n) * time.Second)
+	lastModified := routeMapModTime(routeMapFilePath)
+	for {
+		select {
+		case <-quit:
+			ticker.Stop()
+			return
+		case <-reload:
+			lastModified = routeMapModTime(routeMapFilePath)
+			swapRouteMap(routeMapFilePath, pHandler)
+		case <-ticker.C:
+			modified := routeMapModTime(routeMapFilePath)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			swapRouteMap(routeMapFilePath, pHandler)
+		}
+	}
+}
+
+func swapRouteMap(routeMapFilePath *string, pHandler *proxyHandler) {
+	pHMap, pools, buildErr := buildProxyHandlerMap(routeMapFilePath)
+	if buildErr != nil {
+		log.Printf("RouteMap reload failed, continuing with current routes: %v", buildErr)
+		return
+	}
+	pHandler.swap(pHMap, pools)
+	log.Printf("RouteMap reloaded from %s", *routeMapFilePath)
+}
+
+func routeMapModTime(routeMapFilePath *string) time.Time {
+	info, statErr := os.Stat(*routeMapFilePath)
+	if statErr != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func stopReloadRouteMap(quit chan<- struct{}) {
+	quit <- struct{}{}
+}
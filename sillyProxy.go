@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
@@ -13,8 +14,17 @@ import (
 	"unsafe"
 )
 
-//MinTLSVer is the minimum version of TLS that Silly enforces for client
-// connections. Defaults to TLSv1.0
+//shutdownGracePeriod is how long Silly waits for in-flight requests to
+// complete when asked to shut down
+var shutdownGracePeriod = 30 * time.Second
+
+//proxyDrained reports the outcome of draining the SillyProxy server once it
+// has been asked to shut down
+var proxyDrained <-chan error
+
+//minVersionTLS is the minimum version of TLS that Silly enforces for client
+// connections unless the TLS policy sets one. SillyProxy sets it off
+// -minTLSver, which defaults to 1 for TLSv1.1; it holds TLSv1.0 until then
 var minVersionTLS uint16 = 0x0301
 
 /*
@@ -23,6 +33,7 @@ const (
 	VersionTLS10 = 0x0301
 	VersionTLS11 = 0x0302
 	VersionTLS12 = 0x0303
+	VersionTLS13 = 0x0304
 )
 */
 
@@ -30,82 +41,193 @@ const (
 func SillyProxy(keyStoreFile *string, keyStorePass *string,
 	minTLSVer *uint, bindAddr *string, routeMapFilePath *string) (*http.Server, error) {
 
-	//build routeMap
-	routeMap := &RouteMap{}
-	buildRouteMapError := buildRouteMap(routeMapFilePath, routeMap)
-	if buildRouteMapError != nil {
-		return nil, fmt.Errorf("RouteMap build failed with error: %#v", buildRouteMapError)
-	}
-
-	//build proxyHandlerMap
-	pHMap := make(proxyHanlderMap)
-	assignRoutes(&pHMap, routeMap)
-
-	// verify minTLSVer value supplied
+	// verify minTLSVer value supplied. The TLS policies of the routes file
+	// build on it
 	switch *minTLSVer {
-	case 2:
+	case 0:
+		minVersionTLS = 0x0301
+	case 1:
 		minVersionTLS = 0x0302
-	case 3:
+	case 2:
 		minVersionTLS = 0x0303
+	case 3:
+		minVersionTLS = 0x0304
 	default:
-		//log.Println("Minimum Version of TLS is set to 1")
-		minVersionTLS = 0x0301
+		return nil, fmt.Errorf("minTLSver %d is not one of 0 (TLS 1.0) to 3 (TLS 1.3)",
+			*minTLSVer)
+	}
+
+	//build routeMap and the proxyHandlerMap off it
+	pHMap, pools, buildRouteMapError := buildProxyHandlerMap(routeMapFilePath)
+	if buildRouteMapError != nil {
+		return nil, fmt.Errorf("RouteMap build failed with error: %#v", buildRouteMapError)
 	}
+	pHandler := newProxyHandler(pHMap, pools)
 
 	keyStorePassBytes = []byte(*keyStorePass)
 	zeroString(keyStorePass)
 
 	//load the keystore into the
 
-	certMap = make(map[string]tls.Certificate)
-	loadError := loadCertMap(keyStoreFile, keyStorePassBytes, &certMap)
+	loadError := loadCertMap(keyStoreFile, keyStorePassBytes, certMap)
 	if loadError != nil {
 		return nil, fmt.Errorf("Certificate load failed: %#v", loadError)
 	}
 
 	//use a goroutine to reload the certMap every 30 mins from the keyStore
 	quitReloadChannel := make(chan struct{})
-	go reloadCertMap(keyStoreFile, keyStorePassBytes, &certMap,
+	go reloadCertMap(keyStoreFile, keyStorePassBytes, certMap,
 		quitReloadChannel, uint(60*30))
 
-	//Graceful shutdown in case of interrupts
-	sigChannel := make(chan os.Signal, 1)
-	go func(sigChannel <-chan os.Signal) {
-		for {
-			select {
-			case <-sigChannel:
-				stopReloadKeyStore(quitReloadChannel)
-				zeroBytes(keyStorePassBytes)
-				for _, v := range certMap {
-					clearOut(&v)
-				}
-				clearOut(ECDSAdefault)
-				clearOut(RSAdefault)
-				log.Printf("\nReceived %#v, purged keystore secret and certificate map. Goodbye!\n", sigChannel)
-				os.Exit(1)
-			}
-		}
-	}(sigChannel)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT,
-		syscall.SIGIOT, syscall.SIGABRT, syscall.SIGQUIT, syscall.SIGTSTP,
-		os.Interrupt)
+	//staple the OCSP responses of the certificates. Cached responses are
+	// stapled right away and the rest fetched in the background
+	quitOCSPChannel := make(chan struct{})
+	if ocspStapling {
+		ocspStaples = newOCSPStore(ocspCacheDir)
+		ocspStaples.update(certMap.snapshot(), time.Now(), false)
+		go refreshOCSPStaples(certMap, ocspStaples, quitOCSPChannel, ocspRefreshInterval)
+	}
+
+	//session ticket keys shared through the keystore or a key file let
+	// requestors resume their sessions on any replica. They are reloaded off
+	// the keystore snapshot or the file every minute.
+	if ticketErr := loadTicketKeys(certMap, ticketKeyFile, sessionTicketKeys,
+		time.Now()); ticketErr != nil {
+		return nil, fmt.Errorf("Session ticket keys could not be loaded: %v", ticketErr)
+	}
+	quitTicketReloadChannel := make(chan struct{})
+	go reloadTicketKeys(certMap, ticketKeyFile, sessionTicketKeys,
+		quitTicketReloadChannel, ticketKeyReloadInterval)
+
+	//use a goroutine to watch the routes file every 10 seconds and reload it on
+	// SIGHUP. A valid routes file is swapped in without dropping connections
+	quitRouteReloadChannel := make(chan struct{})
+	routeReloadChannel := make(chan os.Signal, 1)
+	signal.Notify(routeReloadChannel, syscall.SIGHUP)
+	go reloadRouteMap(routeMapFilePath, pHandler, routeReloadChannel,
+		quitRouteReloadChannel, uint(10))
 
 	//Declare server properties
 	server := &http.Server{
-		ReadTimeout:  50 * time.Second,
-		WriteTimeout: 600 * time.Second,
-		IdleTimeout:  60 * time.Second,
-		Addr:         *bindAddr,
+		//only the header is bound here, bodies are streamed and bound per
+		// route by its Timeouts
+		ReadHeaderTimeout: 50 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		Addr:              *bindAddr,
 		TLSConfig: &tls.Config{
 			MinVersion:     minVersionTLS,
 			GetCertificate: returnCert,
+			//h2 and http/1.1 are added on by the server
+			NextProtos: []string{acmeALPNProto},
+			//the TLS policy of the host asked for takes over from here
+			GetConfigForClient: pHandler.tlsConfigForClient,
 		},
-		Handler: pHMap,
+		Handler: pHandler,
+		//handshakes are counted in the metrics as new connections complete them
+		ConnState: metrics.connState,
+	}
+
+	//the upstream health checks stop as soon as shutdown begins
+	server.RegisterOnShutdown(pHandler.stop)
+	server.RegisterOnShutdown(func() {
+		close(quitTicketReloadChannel)
+		close(quitOCSPChannel)
+	})
+
+	//fire up the admin listener if one is asked for. It goes down along with
+	// the proxy
+	if adminBindAddr != "" {
+		adminServer := newAdminServer(adminBindAddr, pHandler)
+		go func() {
+			if adminErr := adminServer.ListenAndServe(); adminErr != http.ErrServerClosed {
+				log.Printf("Admin listener failed with error: %v", adminErr)
+			}
+		}()
+		server.RegisterOnShutdown(func() {
+			adminServer.Close()
+		})
+	}
+
+	//fire up the cleartext listener if one is asked for. It drains along with
+	// the proxy
+	if httpBindAddr != "" {
+		plainServer := newPlainServer(httpBindAddr, pHandler)
+		go func() {
+			if plainErr := plainServer.ListenAndServe(); plainErr != http.ErrServerClosed {
+				log.Printf("Cleartext listener failed with error: %v", plainErr)
+			}
+		}()
+		server.RegisterOnShutdown(func() {
+			shutdownPlainServer(plainServer, shutdownGracePeriod)
+		})
+	}
+
+	//fire up the ACME client if a directory is given. HTTP-01 challenges can
+	// only be answered over the cleartext listener
+	if acmeSettings.directoryURL != "" {
+		options := acmeSettings
+		if httpBindAddr == "" {
+			options.challenges = nil
+			for _, challenge := range acmeSettings.challenges {
+				if challenge != acmeHTTP01 {
+					options.challenges = append(options.challenges, challenge)
+				}
+			}
+		}
+		manager, acmeErr := newACMEManager(options, pHandler, certMap, acmeChallenges,
+			keyStoreFile, keyStorePassBytes)
+		if acmeErr != nil {
+			return nil, fmt.Errorf("ACME client could not be set up: %v", acmeErr)
+		}
+		quitACMEChannel := make(chan struct{})
+		go manager.run(quitACMEChannel, acmeCheckInterval)
+		server.RegisterOnShutdown(func() {
+			close(quitACMEChannel)
+		})
 	}
 
+	//Graceful shutdown in case of interrupts. The signal is let go of once
+	// received so that a second interrupt terminates Silly without draining.
+	drained := make(chan error, 1)
+	sigChannel := make(chan os.Signal, 1)
+	go func(sigChannel chan os.Signal) {
+		sig := <-sigChannel
+		signal.Stop(sigChannel)
+		log.Printf("Received %v, draining connections for up to %v", sig,
+			shutdownGracePeriod)
+		drained <- drainSillyProxy(server, shutdownGracePeriod,
+			quitReloadChannel, quitRouteReloadChannel)
+	}(sigChannel)
+	signal.Notify(sigChannel, shutdownSignals...)
+	proxyDrained = drained
+
 	return server, nil
 }
 
+//drainSillyProxy stops the server from accepting new connections and waits up
+// to gracePeriod for in-flight requests to complete. The reload goroutines are
+// stopped and the access logs closed next and only then are the keystore
+// secret and certificates purged.
+// An error is returned if connections had to be cut off.
+func drainSillyProxy(server *http.Server, gracePeriod time.Duration,
+	quitReloadChannel chan<- struct{}, quitRouteReloadChannel chan<- struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	shutdownErr := server.Shutdown(ctx)
+	if shutdownErr != nil {
+		server.Close()
+		shutdownErr = fmt.Errorf("Connections did not drain within %v: %v",
+			gracePeriod, shutdownErr)
+	}
+	stopReloadKeyStore(quitReloadChannel)
+	stopReloadRouteMap(quitRouteReloadChannel)
+	closeAccessLogs()
+	zeroBytes(keyStorePassBytes)
+	certMap.purge()
+	log.Printf("Purged keystore secret and certificate map. Goodbye!")
+	return shutdownErr
+}
+
 func stopReloadKeyStore(quit chan<- struct{}) {
 	quit <- struct{}{}
 }
@@ -1,24 +1,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ChandraNarreddy/sillyproxy/utility"
 	"github.com/julienschmidt/httprouter"
 	keystore "github.com/pavel-v-chernykh/keystore-go/v4"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -348,7 +372,7 @@ func TestMain(m *testing.M) {
 			&pass)
 		log.Print("GenerateKeyStore() succeeded for non-default:DSA")
 	*/
-	certMap = make(map[string]tls.Certificate)
+	certMap = newCertStore()
 	runTests := m.Run()
 	os.Exit(runTests)
 }
@@ -409,13 +433,13 @@ func resetParams() {
 }
 
 func TestLoadCertMap(t *testing.T) {
-	certMap = make(map[string]tls.Certificate)
+	certMap = newCertStore()
 	var incorrectPassword = "incorrectPassword"
 	var invalidFileName = "invalidFileName"
-	if loadCertMap(&invalidFileName, []byte(KeyStorePass), &certMap) == nil {
+	if loadCertMap(&invalidFileName, []byte(KeyStorePass), certMap) == nil {
 		t.Errorf("loadCertMap() fail: failed to catch fileload error")
 	}
-	if loadCertMap(&KeyStore, []byte(incorrectPassword), &certMap) == nil {
+	if loadCertMap(&KeyStore, []byte(incorrectPassword), certMap) == nil {
 		t.Errorf("loadCertMap() fail: failed to catch incorrect password error")
 	}
 
@@ -443,16 +467,18 @@ func TestLoadCertMap(t *testing.T) {
 	utility.GenerateKeyStore(&incorrectKeyStore, &nonDefaultAlias, &ECDSA_Crt, &ECDSA_Key,
 		&tempPass)
 	tempPass = KeyStorePass
-	if loadCertMap(&incorrectKeyStore, []byte(tempPass), &certMap) == nil {
+	if loadCertMap(&incorrectKeyStore, []byte(tempPass), certMap) == nil {
 		t.Errorf("loadCertMap() fail: failed to catch error for keystore without Default alias")
 	}
 	//test for loading a non-defaulted keystore
 
-	certMap = make(map[string]tls.Certificate)
-	loadCertMapErr := loadCertMap(&KeyStore, []byte(KeyStorePass), &certMap)
+	certMap = newCertStore()
+	loadCertMapErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap)
 	if loadCertMapErr != nil {
 		t.Errorf("loadCertMap() fail: failed with error: %s", loadCertMapErr)
 	}
+	snapshot := certMap.snapshot()
+	ECDSAdefault := snapshot.ECDSAdefault
 	log.Printf("TestLoadCertMap() debug: ECDSAdefault - %#v", ECDSAdefault.Certificate[0])
 	// check if the default ECDSA has been loaded properly
 	x509Cert, certParseErr := x509.ParseCertificate(ECDSAdefault.Certificate[0])
@@ -483,13 +509,13 @@ func TestLoadCertMap(t *testing.T) {
 	}
 
 	//check if the non-default ECDSA has been loaded properly
-	x509Cert, certParseErr = x509.ParseCertificate(certMap[alias+":ECDSA"].Certificate[0])
+	x509Cert, certParseErr = x509.ParseCertificate(snapshot.certs[alias+":ECDSA"].Certificate[0])
 	if certParseErr != nil {
 		t.Errorf("loadCertMap() fail: failed to load certificates correctly")
 	}
 	switch pub := x509Cert.PublicKey.(type) {
 	case *rsa.PublicKey:
-		priv, ok := certMap[alias+":ECDSA"].PrivateKey.(*rsa.PrivateKey)
+		priv, ok := snapshot.certs[alias+":ECDSA"].PrivateKey.(*rsa.PrivateKey)
 		if !ok {
 			t.Errorf("loadCertMap() fail: private key type does not match public key type")
 		}
@@ -497,7 +523,7 @@ func TestLoadCertMap(t *testing.T) {
 			t.Errorf("loadCertMap() fail: private key does not match public key")
 		}
 	case *ecdsa.PublicKey:
-		priv, ok := certMap[alias+":ECDSA"].PrivateKey.(*ecdsa.PrivateKey)
+		priv, ok := snapshot.certs[alias+":ECDSA"].PrivateKey.(*ecdsa.PrivateKey)
 		if !ok {
 			t.Errorf("loadCertMap() fail: private key type does not match public key type")
 		}
@@ -507,14 +533,45 @@ func TestLoadCertMap(t *testing.T) {
 	default:
 		t.Errorf("loadCertMap() fail: unknown public key algorithm")
 	}
+
+	//a failed load must leave the published snapshot untouched
+	if loadCertMap(&KeyStore, []byte(incorrectPassword), certMap) == nil {
+		t.Errorf("loadCertMap() fail: failed to catch incorrect password error")
+	}
+	if certMap.snapshot() != snapshot {
+		t.Errorf("loadCertMap() fail: a failed load replaced the current snapshot")
+	}
+
+	//aliases that are no longer in the keystore must be evicted on reload
+	var evictionKeyStore = "eviction.keystore"
+	var evictionPass = KeyStorePass
+	os.Remove(evictionKeyStore)
+	defer os.Remove(evictionKeyStore)
+	utility.GenerateKeyStore(&evictionKeyStore, &alias_default, &ECDSA_Crt, &ECDSA_Key,
+		&evictionPass)
+	if loadCertMapErr = loadCertMap(&evictionKeyStore, []byte(KeyStorePass),
+		certMap); loadCertMapErr != nil {
+		t.Errorf("loadCertMap() fail: failed with error: %s", loadCertMapErr)
+	}
+	if _, exists := certMap.snapshot().certs[alias+":ECDSA"]; exists {
+		t.Errorf("loadCertMap() fail: failed to evict an alias removed from the keystore")
+	}
+	if certMap.snapshot().RSAdefault != nil {
+		t.Errorf("loadCertMap() fail: failed to evict a default removed from the keystore")
+	}
 }
 
 func TestReloadCertMap(t *testing.T) {
 	quitReloadChannel := make(chan struct{})
-	certMap = make(map[string]tls.Certificate)
-	go reloadCertMap(&KeyStore, []byte(KeyStorePass), &certMap,
+	certMap = newCertStore()
+	go reloadCertMap(&KeyStore, []byte(KeyStorePass), certMap,
 		quitReloadChannel, uint(1))
 	time.Sleep(2 * time.Second)
+	snapshot := certMap.snapshot()
+	if snapshot == nil {
+		t.Fatalf("reloadCertMap() fail: failed to publish a snapshot")
+	}
+	ECDSAdefault := snapshot.ECDSAdefault
 	log.Printf("TestReLoadCertMap() debug: ECDSAdefault is %#v", ECDSAdefault.Certificate[0])
 	// check if the default ECDSA has been loaded properly
 	x509Cert, certParseErr := x509.ParseCertificate(ECDSAdefault.Certificate[0])
@@ -544,13 +601,13 @@ func TestReloadCertMap(t *testing.T) {
 	}
 
 	// check if the non-default ECDSA has been loaded properly
-	x509Cert, certParseErr = x509.ParseCertificate(certMap[alias+":ECDSA"].Certificate[0])
+	x509Cert, certParseErr = x509.ParseCertificate(snapshot.certs[alias+":ECDSA"].Certificate[0])
 	if certParseErr != nil {
 		t.Errorf("reloadCertMap() fail: failed to load certificates correctly")
 	}
 	switch pub := x509Cert.PublicKey.(type) {
 	case *rsa.PublicKey:
-		priv, ok := certMap[alias+":ECDSA"].PrivateKey.(*rsa.PrivateKey)
+		priv, ok := snapshot.certs[alias+":ECDSA"].PrivateKey.(*rsa.PrivateKey)
 		if !ok {
 			t.Errorf("reloadCertMap() fail: private key type does not match public key type")
 		}
@@ -558,7 +615,7 @@ func TestReloadCertMap(t *testing.T) {
 			t.Errorf("reloadCertMap() fail: private key does not match public key")
 		}
 	case *ecdsa.PublicKey:
-		priv, ok := certMap[alias+":ECDSA"].PrivateKey.(*ecdsa.PrivateKey)
+		priv, ok := snapshot.certs[alias+":ECDSA"].PrivateKey.(*ecdsa.PrivateKey)
 		if !ok {
 			t.Errorf("reloadCertMap() fail: private key type does not match public key type")
 		}
@@ -570,14 +627,12 @@ func TestReloadCertMap(t *testing.T) {
 	}
 
 	stopReloadKeyStore(quitReloadChannel)
-	certMap = make(map[string]tls.Certificate)
-	ECDSAdefault = &tls.Certificate{}
-	ECDSAdefaultExists = false
+	certMap.purge()
 	time.Sleep(5 * time.Second)
-	if _, exists := certMap[alias+":ECDSA"]; exists {
+	if _, exists := certMap.snapshot().certs[alias+":ECDSA"]; exists {
 		t.Errorf("stopReloadKeyStore() fail: failed to stop reloadKeyStore goroutine.")
 	}
-	if ECDSAdefaultExists {
+	if certMap.snapshot().ECDSAdefault != nil {
 		t.Errorf("stopReloadKeyStore() fail: failed to stop reloadKeyStore goroutine.")
 	}
 }
@@ -633,7 +688,7 @@ func TestReturnCert(t *testing.T) {
 		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
 	}
-	loadCertMapErr := loadCertMap(&KeyStore, []byte(KeyStorePass), &certMap)
+	loadCertMapErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap)
 	if loadCertMapErr != nil {
 		t.Errorf("returnTLSConfig() fail: failed with error: %s", loadCertMapErr)
 	}
@@ -684,6 +739,178 @@ func TestReturnCert(t *testing.T) {
 	}
 }
 
+// newTestKeyPair returns a PEM encoded key of keyType along with a self
+// signed certificate for dnsNames
+func newTestKeyPair(keyType string, dnsNames ...string) ([]byte, [][]byte) {
+	var key crypto.Signer
+	var keyPEMBlock []byte
+	if keyType == "Ed25519" {
+		_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+		der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+		key, keyPEMBlock = edKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	} else {
+		key, keyPEMBlock, _ = generateKey(keyType)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: dnsNames[0]}, DNSNames: dnsNames,
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	return keyPEMBlock, [][]byte{der}
+}
+
+func TestReturnCertSANs(t *testing.T) {
+	sanKeyStore := "test_san.keystore"
+	keyStoreBytes, _ := ioutil.ReadFile(KeyStore)
+	ioutil.WriteFile(sanKeyStore, keyStoreBytes, 0600)
+	defer os.Remove(sanKeyStore)
+	for alias, dnsNames := range map[string][]string{
+		"*.wild.test:ECDSA":    {"*.wild.test"},
+		"*.wild.test:RSA":      {"*.wild.test"},
+		"exact.wild.test:RSA":  {"exact.wild.test"},
+		"multi.test:ECDSA":     {"multi.test", "a.multi.test", "B.Multi.Test"},
+		"starred.test:ECDSA":   {"*.starred.test"},
+		"unrelated.test:ECDSA": {"unrelated.test"},
+		"Aliased.Test:ECDSA":   {"san-only.test"},
+	} {
+		keyType := strings.Split(alias, ":")[1]
+		keyPEMBlock, chain := newTestKeyPair(keyType, dnsNames...)
+		if storeErr := utility.StoreKeyPair(sanKeyStore, alias, keyPEMBlock, chain,
+			[]byte(KeyStorePass)); storeErr != nil {
+			t.Fatalf("StoreKeyPair() fail: failed with error: %s", storeErr)
+		}
+	}
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&sanKeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	ecdsaAndRSA := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	rsaOnly := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	for _, testCase := range []struct {
+		serverName   string
+		cipherSuites []uint16
+		commonName   string
+	}{
+		{"api.wild.test", ecdsaAndRSA, "*.wild.test:ECDSA"},
+		{"api.wild.test", rsaOnly, "*.wild.test:RSA"},
+		{"API.wild.test.", ecdsaAndRSA, "*.wild.test:ECDSA"},
+		//an exact match wins over a wildcard, even an ECDSA one
+		{"exact.wild.test", ecdsaAndRSA, "exact.wild.test:RSA"},
+		{"a.multi.test", ecdsaAndRSA, "multi.test:ECDSA"},
+		{"b.multi.test", ecdsaAndRSA, "multi.test:ECDSA"},
+		{"any.starred.test", ecdsaAndRSA, "*.starred.test:ECDSA"},
+		//aliases match regardless of case too
+		{"aliased.TEST", ecdsaAndRSA, "san-only.test:ECDSA"},
+		//wildcards cover a single label only
+		{"deep.api.wild.test", ecdsaAndRSA, "default"},
+		{"multi.test.example", ecdsaAndRSA, "default"},
+	} {
+		cert, certErr := returnCert(&tls.ClientHelloInfo{ServerName: testCase.serverName,
+			CipherSuites: testCase.cipherSuites})
+		if certErr != nil {
+			t.Errorf("returnCert() fail: %s failed with error: %s", testCase.serverName, certErr)
+			continue
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		keyType := "RSA"
+		if _, isECDSA := leaf.PublicKey.(*ecdsa.PublicKey); isECDSA {
+			keyType = "ECDSA"
+		}
+		served := leaf.Subject.CommonName + ":" + keyType
+		if testCase.commonName == "default" {
+			if cert != certMap.snapshot().ECDSAdefault {
+				t.Errorf("returnCert() fail: %s was served %s in place of the default",
+					testCase.serverName, served)
+			}
+		} else if served != testCase.commonName {
+			t.Errorf("returnCert() fail: %s was served %s in place of %s", testCase.serverName,
+				served, testCase.commonName)
+		}
+	}
+}
+
+func TestReturnCertSignatureSchemes(t *testing.T) {
+	schemeKeyStore := "test_schemes.keystore"
+	keyStoreBytes, _ := ioutil.ReadFile(KeyStore)
+	ioutil.WriteFile(schemeKeyStore, keyStoreBytes, 0600)
+	defer os.Remove(schemeKeyStore)
+	for _, alias := range []string{"tls13.test:ECDSA", "tls13.test:RSA", "ed.test:Ed25519",
+		"ed.test:ECDSA", "edonly.test:Ed25519"} {
+		name, keyType := strings.Split(alias, ":")[0], strings.Split(alias, ":")[1]
+		keyPEMBlock, chain := newTestKeyPair(keyType, name)
+		if storeErr := utility.StoreKeyPair(schemeKeyStore, alias, keyPEMBlock, chain,
+			[]byte(KeyStorePass)); storeErr != nil {
+			t.Fatalf("StoreKeyPair() fail: failed with error: %s", storeErr)
+		}
+	}
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&schemeKeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	tls13 := []uint16{tls.VersionTLS13}
+	tls13Suites := []uint16{tls.TLS_AES_128_GCM_SHA256}
+	curves := []tls.CurveID{tls.X25519, tls.CurveP256}
+	for _, testCase := range []struct {
+		serverName string
+		versions   []uint16
+		suites     []uint16
+		schemes    []tls.SignatureScheme
+		keyType    x509.PublicKeyAlgorithm
+	}{
+		//TLS 1.3 cipher suites name no authentication type at all
+		{"tls13.test", tls13, tls13Suites,
+			[]tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256}, x509.ECDSA},
+		{"tls13.test", tls13, tls13Suites, []tls.SignatureScheme{tls.PSSWithSHA256}, x509.RSA},
+		{"ed.test", tls13, tls13Suites,
+			[]tls.SignatureScheme{tls.Ed25519, tls.ECDSAWithP256AndSHA256}, x509.Ed25519},
+		{"ed.test", tls13, tls13Suites, []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}, x509.ECDSA},
+		{"ed.test", []uint16{tls.VersionTLS12}, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			[]tls.SignatureScheme{tls.Ed25519}, x509.Ed25519},
+		//a host whose Ed25519 cert the requestor cannot verify is not served an
+		// Ed25519 default either, the ECDSA default stands in
+		{"edonly.test", tls13, tls13Suites,
+			[]tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}, x509.ECDSA},
+	} {
+		cert, certErr := returnCert(&tls.ClientHelloInfo{ServerName: testCase.serverName,
+			SupportedVersions: testCase.versions, CipherSuites: testCase.suites,
+			SignatureSchemes: testCase.schemes, SupportedCurves: curves,
+			SupportedPoints: []uint8{0}})
+		if certErr != nil {
+			t.Errorf("returnCert() fail: %s with %v failed with error: %s", testCase.serverName,
+				testCase.schemes, certErr)
+			continue
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if leaf.PublicKeyAlgorithm != testCase.keyType {
+			t.Errorf("returnCert() fail: %s with %v was served a %v cert in place of %v",
+				testCase.serverName, testCase.schemes, leaf.PublicKeyAlgorithm, testCase.keyType)
+		}
+	}
+	_, certErr := returnCert(&tls.ClientHelloInfo{ServerName: "edonly.test",
+		SupportedVersions: tls13, CipherSuites: tls13Suites, SupportedCurves: curves,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP521AndSHA512}})
+	if certErr == nil {
+		t.Errorf("returnCert() fail: failed to refuse a requestor verifying none of the certs")
+	}
+
+	//a full TLS 1.3 handshake picks the Ed25519 cert for a client that offers it
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go tls.Server(serverConn, &tls.Config{GetCertificate: returnCert}).Handshake()
+	client := tls.Client(clientConn, &tls.Config{ServerName: "ed.test", InsecureSkipVerify: true,
+		MinVersion: tls.VersionTLS13})
+	if handshakeErr := client.Handshake(); handshakeErr != nil {
+		t.Fatalf("returnCert() fail: TLS 1.3 handshake failed with error: %s", handshakeErr)
+	}
+	if algorithm := client.ConnectionState().PeerCertificates[0].PublicKeyAlgorithm; algorithm != x509.Ed25519 {
+		t.Errorf("returnCert() fail: TLS 1.3 handshake was served a %v cert in place of Ed25519",
+			algorithm)
+	}
+}
+
 func TestBuildRouteMap(t *testing.T) {
 	testRouteMap := &RouteMap{}
 	if buildRouteMap(&RouteMapFilePath, testRouteMap) != nil {
@@ -719,123 +946,2522 @@ func TestBuildRouteMap(t *testing.T) {
 	}
 }
 
-func TestAssignRoutes(t *testing.T) {
+func TestReloadRouteMap(t *testing.T) {
+	reloadRouteMapPath := "test_reload_routemap.json"
+	routeMapForHost := func(host string) string {
+		return `{"Routes":[{"Host":"` + host + `","MethodPathMaps":[` +
+			`{"Method":"GET","Path":"/reload/","Route":["http://127.0.0.1:1/"]}]}]}`
+	}
+	ioutil.WriteFile(reloadRouteMapPath, []byte(routeMapForHost("first.host")), 0644)
+	defer os.Remove(reloadRouteMapPath)
+
+	pHMap, pools, buildErr := buildProxyHandlerMap(&reloadRouteMapPath)
+	if buildErr != nil {
+		t.Fatalf("buildProxyHandlerMap() fail: failed with error: %s", buildErr)
+	}
+	pHandler := newProxyHandler(pHMap, pools)
+	quit := make(chan struct{})
+	reload := make(chan os.Signal, 1)
+	earlier := time.Now().Add(-time.Hour)
+	os.Chtimes(reloadRouteMapPath, earlier, earlier)
+	go reloadRouteMap(&reloadRouteMapPath, pHandler, reload, quit, uint(1))
+	defer stopReloadRouteMap(quit)
+	time.Sleep(100 * time.Millisecond)
+
+	//a change on disk is picked up by the watcher
+	ioutil.WriteFile(reloadRouteMapPath, []byte(routeMapForHost("second.host")), 0644)
+	later := time.Now().Add(5 * time.Second)
+	os.Chtimes(reloadRouteMapPath, later, later)
+	time.Sleep(2 * time.Second)
+	if _, exists := pHandler.load().hosts["second.host"]; !exists {
+		t.Errorf("reloadRouteMap() fail: failed to pick up a modified routes file")
+	}
+
+	//an invalid routes file is rejected and the current routes keep serving
+	ioutil.WriteFile(reloadRouteMapPath, []byte(`{"Routes":[{"Host":"",}]}`), 0644)
+	reload <- syscall.SIGHUP
+	time.Sleep(500 * time.Millisecond)
+	ioutil.WriteFile(reloadRouteMapPath,
+		[]byte(`{"Routes":[{"Host":"third.host","MethodPathMaps":[`+
+			`{"Method":"GET","Path":"/a/:b","Route":[0]},`+
+			`{"Method":"GET","Path":"/a/:c","Route":[0]}]}]}`), 0644)
+	reload <- syscall.SIGHUP
+	time.Sleep(500 * time.Millisecond)
+	if _, exists := pHandler.load().hosts["second.host"]; !exists {
+		t.Errorf("reloadRouteMap() fail: an invalid routes file replaced the current routes")
+	}
 
+	//a reload on signal swaps in the new routes
+	ioutil.WriteFile(reloadRouteMapPath, []byte(routeMapForHost("fourth.host")), 0644)
+	reload <- syscall.SIGHUP
+	time.Sleep(500 * time.Millisecond)
+	if _, exists := pHandler.load().hosts["fourth.host"]; !exists {
+		t.Errorf("reloadRouteMap() fail: failed to reload routes on signal")
+	}
 }
 
-func TestProxyHandlerMapServeHTTP(t *testing.T) {
-	testpHMap := make(proxyHanlderMap)
-	testRouter := httprouter.New()
-	testRouter.GET("/", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		fmt.Fprint(w, "Welcome!\n")
-	})
-	testpHMap["www.donkeys.com"] = testRouter
-	testServer := httptest.NewUnstartedServer(testpHMap)
-	testServer.Start()
-	defer testServer.Close()
-	testClient := &http.Client{
-		//first create a transport that is tolerant to SSL errors
-		Transport: &http.Transport{
-			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-			DisableKeepAlives: false,
+func TestUpstreamBalancer(t *testing.T) {
+	upstreams := []Upstream{
+		{Target: "http://10.0.0.1:8080", Weight: 3},
+		{Target: "http://10.0.0.2:8080/"},
+	}
+	testRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	newTestBalancer := func(balancer Balancer) (upstreamBalancer, error) {
+		targets, targetsErr := newUpstreamTargets(upstreams)
+		if targetsErr != nil {
+			return nil, targetsErr
+		}
+		return newUpstreamBalancer(targets, balancer)
+	}
+
+	weighted, weightedErr := newTestBalancer(Balancer{})
+	if weightedErr != nil {
+		t.Fatalf("newUpstreamBalancer() fail: failed with error: %s", weightedErr)
+	}
+	picks := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		picks[weighted.next(testRequest).target]++
+	}
+	if picks["http://10.0.0.1:8080"] != 6 || picks["http://10.0.0.2:8080/"] != 2 {
+		t.Errorf("weightedBalancer.next() fail: picks not proportional to weights: %#v", picks)
+	}
+
+	roundRobin, _ := newTestBalancer(Balancer{Strategy: "round-robin"})
+	if roundRobin.next(testRequest) == roundRobin.next(testRequest) {
+		t.Errorf("roundRobinBalancer.next() fail: picked the same target twice in a row")
+	}
+
+	leastOutstanding, _ := newTestBalancer(Balancer{Strategy: "least-outstanding"})
+	busy := leastOutstanding.next(testRequest)
+	release := busy.acquire()
+	for i := 0; i < 4; i++ {
+		if leastOutstanding.next(testRequest) == busy {
+			t.Errorf("leastOutstandingBalancer.next() fail: picked the busier target")
+		}
+	}
+	release()
+
+	hashed, _ := newTestBalancer(
+		Balancer{Strategy: "consistent-hash", HashOn: "header:X-Silly-User"})
+	testRequest.Header.Set("X-Silly-User", "silly")
+	sticky := hashed.next(testRequest)
+	for i := 0; i < 4; i++ {
+		if hashed.next(testRequest) != sticky {
+			t.Errorf("consistentHashBalancer.next() fail: same key landed on a different target")
+		}
+	}
+	if sticky.upstreamURL("search?q=silly") != strings.TrimSuffix(sticky.target, "/")+"/search?q=silly" {
+		t.Errorf("upstreamURL() fail: got %#v", sticky.upstreamURL("search?q=silly"))
+	}
+
+	invalidBalancers := []Balancer{
+		{Strategy: "random"},
+		{Strategy: "consistent-hash"},
+		{Strategy: "consistent-hash", HashOn: "header:"},
+	}
+	for _, invalidBalancer := range invalidBalancers {
+		if _, balancerErr := newTestBalancer(invalidBalancer); balancerErr == nil {
+			t.Errorf("newUpstreamBalancer() fail: failed to reject %#v", invalidBalancer)
+		}
+	}
+	if _, targetsErr := newUpstreamTargets([]Upstream{{Target: "10.0.0.1:8080"}}); targetsErr == nil {
+		t.Errorf("newUpstreamTargets() fail: failed to reject a target without scheme")
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	var probeStatus int64 = http.StatusServiceUnavailable
+	testBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt64(&probeStatus)))
+	}))
+	defer testBackend.Close()
+	testMap := MethodPathMap{
+		Method: "GET",
+		Path:   "/health/",
+		Upstreams: []Upstream{
+			{Target: testBackend.URL},
+			{Target: "http://127.0.0.1:1"},
 		},
-		// we will not follow any redirect rather pass the instructions to
-		// the client
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+		Balancer: Balancer{Strategy: "round-robin"},
+		HealthCheck: HealthCheck{
+			Path:               "/healthz",
+			Interval:           1,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+			Consecutive5xx:     2,
+			ConsecutiveErrors:  1,
 		},
-		//we will declare a reasonable timeout value here. Alternatively we
-		// can look to parameterize this to fetch its value from routeMap
-		Timeout: 5 * time.Second,
 	}
-	testResponse, _ := testClient.Get(testServer.URL + "/")
-	if testResponse.StatusCode != 403 {
-		t.Errorf("\nPHMap.ServeHTTP() fail: failed to handle non-Mapped hosts")
+	pool, poolErr := newUpstreamPool("127.0.0.1", testMap, http.DefaultClient)
+	if poolErr != nil {
+		t.Fatalf("newUpstreamPool() fail: failed with error: %s", poolErr)
 	}
-}
+	testRequest := httptest.NewRequest(http.MethodGet, "/health/", nil)
+	live, dead := pool.targets[0], pool.targets[1]
 
-func TestRouteBuilder(t *testing.T) {
+	//passive outlier detection ejects the target refusing connections
+	_, connectErr := http.Get(dead.target)
+	pool.observe(dead, nil, connectErr)
+	for i := 0; i < 4; i++ {
+		if pool.pick(testRequest) != live {
+			t.Errorf("upstreamPool.pick() fail: picked an ejected target")
+		}
+	}
+	//and the one answering with consecutive server errors
+	pool.observe(live, &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	pool.observe(live, &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	if pool.pick(testRequest) != nil {
+		t.Errorf("upstreamPool.pick() fail: picked a target while all were ejected")
+	}
 
+	//active probes take the live target out and bring it back
+	live.health.ejectedUntil = time.Time{}
+	pool.start()
+	defer pool.stop()
+	time.Sleep(1500 * time.Millisecond)
+	if live.health.available(time.Now()) {
+		t.Errorf("upstreamPool.probe() fail: failed to mark a failing target unhealthy")
+	}
+	atomic.StoreInt64(&probeStatus, http.StatusOK)
+	time.Sleep(1 * time.Second)
+	if !live.health.available(time.Now()) {
+		t.Errorf("upstreamPool.probe() fail: failed to bring a recovered target back")
+	}
+
+	//the admin listener reports the state of each upstream
+	testpHandler := newProxyHandler(newProxyHanlderMap(), []*upstreamPool{pool})
+	recorder := httptest.NewRecorder()
+	upstreamsHandler(testpHandler)(recorder, httptest.NewRequest(http.MethodGet, "/upstreams", nil))
+	var statuses []upstreamHealthStatus
+	if decodeErr := json.NewDecoder(recorder.Body).Decode(&statuses); decodeErr != nil ||
+		len(statuses) != 2 {
+		t.Fatalf("upstreamsHandler() fail: unexpected status report %#v", recorder.Body.String())
+	}
+	if !statuses[0].Healthy || statuses[0].Ejected || !statuses[1].Ejected {
+		t.Errorf("upstreamsHandler() fail: reported wrong health %#v", statuses)
+	}
+
+	//a target that accepts connections and drops them is ejected too, and
+	// its errors do not clear the count of server errors
+	droppingBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer droppingBackend.Close()
+	droppingMap := MethodPathMap{Method: "GET", Path: "/dropping/",
+		Upstreams:   []Upstream{{Target: droppingBackend.URL}},
+		HealthCheck: HealthCheck{Consecutive5xx: 2, ConsecutiveErrors: 2}}
+	droppingPool, _ := newUpstreamPool("127.0.0.1", droppingMap, http.DefaultClient)
+	dropping := droppingPool.targets[0]
+	droppingPool.observe(dropping, &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	_, dropErr := http.Get(dropping.target)
+	if dropErr == nil || isConnectError(dropErr) {
+		t.Fatalf("dropping backend fail: expected a reset rather than %v", dropErr)
+	}
+	droppingPool.observe(dropping, nil, dropErr)
+	droppingPool.observe(dropping, &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	if dropping.health.available(time.Now()) {
+		t.Errorf("upstreamPool.observe() fail: a transport error cleared the server errors")
+	}
+	dropping.health.ejectedUntil = time.Time{}
+	droppingPool.observe(dropping, nil, dropErr)
+	droppingPool.observe(dropping, nil, dropErr)
+	if dropping.health.available(time.Now()) {
+		t.Errorf("upstreamPool.observe() fail: failed to eject a target dropping connections")
+	}
+
+	//a reload keeps the health of unchanged pools and starts changed ones afresh
+	reloadedPool, _ := newUpstreamPool("127.0.0.1", droppingMap, http.DefaultClient)
+	changedMap := droppingMap
+	changedMap.Upstreams = []Upstream{{Target: droppingBackend.URL}, {Target: testBackend.URL}}
+	changedPool, _ := newUpstreamPool("127.0.0.1", changedMap, http.DefaultClient)
+	reloadHandler := newProxyHandler(newProxyHanlderMap(), []*upstreamPool{droppingPool})
+	reloadHandler.swap(newProxyHanlderMap(), []*upstreamPool{reloadedPool})
+	if reloadedPool.targets[0].health.available(time.Now()) {
+		t.Errorf("proxyHandler.swap() fail: an ejection was lost across a reload")
+	}
+	reloadHandler.swap(newProxyHanlderMap(), []*upstreamPool{changedPool})
+	if !changedPool.targets[0].health.available(time.Now()) {
+		t.Errorf("proxyHandler.swap() fail: a changed pool took over the health of the old one")
+	}
 }
 
-func TestIsSigAlgSupported(t *testing.T) {
+func TestErrorResponder(t *testing.T) {
+	release := make(chan struct{})
+	slowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slowBackend.Close()
+	defer close(release)
+
+	errorTemplatePath := "test_error.tmpl"
+	ioutil.WriteFile(errorTemplatePath,
+		[]byte(`<p>{{.Status}} {{.StatusText}} for {{.Host}}{{.Path}}: {{.RequestID}}</p>`), 0644)
+	defer os.Remove(errorTemplatePath)
+
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		{
+			Host:          "127.0.0.1",
+			ErrorResponse: ErrorResponse{Format: "json"},
+			MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/refused", Route: []interface{}{"http://127.0.0.1:1/"}},
+				{Method: "GET", Path: "/params/", Route: []interface{}{"http://127.0.0.1:1/", float64(0)}},
+			},
+		},
+		{
+			Host:          "localhost",
+			ErrorResponse: ErrorResponse{Format: "template", Template: errorTemplatePath},
+			MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/refused", Route: []interface{}{"http://127.0.0.1:1/"}},
+				{Method: "GET", Path: "/refused/*rest", Route: []interface{}{"http://127.0.0.1:1/"}},
+			},
+		},
+		{
+			Host: "plain.test",
+			ErrorResponse: ErrorResponse{Format: "template", Template: errorTemplatePath,
+				ContentType: "text/plain"},
+			MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/refused/*rest", Route: []interface{}{"http://127.0.0.1:1/"}},
+			},
+		},
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+
+	testCases := []struct {
+		host, path string
+		status     int
+	}{
+		{"127.0.0.1", "/refused", http.StatusBadGateway},
+		{"127.0.0.1", "/params/", http.StatusInternalServerError},
+	}
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		testRequest := httptest.NewRequest(http.MethodGet, "http://"+testCase.host+testCase.path, nil)
+		testpHMap.ServeHTTP(recorder, testRequest)
+		var details errorDetails
+		json.NewDecoder(recorder.Body).Decode(&details)
+		if recorder.Code != testCase.status || details.Status != testCase.status ||
+			details.RequestID == "" || details.RequestID != recorder.Header().Get(requestIDHeader) {
+			t.Errorf("errorResponder.respond() fail: got %d %#v for %s", recorder.Code,
+				details, testCase.path)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	testpHMap.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/refused", nil))
+	expectedBody := "<p>502 Bad Gateway for localhost/refused: " +
+		recorder.Header().Get(requestIDHeader) + "</p>"
+	if recorder.Code != http.StatusBadGateway || recorder.Body.String() != expectedBody {
+		t.Errorf("errorResponder.respond() fail: template rendered %#v", recorder.Body.String())
+	}
+	//the path is the requestor's to choose and is escaped in HTML error pages
+	recorder = httptest.NewRecorder()
+	testpHMap.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		"http://localhost/refused/%3Cscript%3Ealert(1)%3C/script%3E", nil))
+	if body := recorder.Body.String(); strings.Contains(body, "<script>") ||
+		!strings.Contains(body, "/refused/&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("errorResponder.respond() fail: HTML template rendered %#v", body)
+	}
+	recorder = httptest.NewRecorder()
+	testpHMap.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		"http://plain.test/refused/%3Cb%3E", nil))
+	if body := recorder.Body.String(); !strings.Contains(body, "plain.test/refused/<b>:") ||
+		recorder.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("errorResponder.respond() fail: plain text template rendered %#v", body)
+	}
+
+	timeoutClient := &http.Client{Timeout: 100 * time.Millisecond}
+	_, timeoutErr := timeoutClient.Get(slowBackend.URL)
+	if statusForUpstreamError(timeoutErr) != http.StatusGatewayTimeout {
+		t.Errorf("statusForUpstreamError() fail: timeout not mapped to 504: %#v", timeoutErr)
+	}
 
+	if _, responderErr := newErrorResponder(ErrorResponse{Format: "template"}); responderErr == nil {
+		t.Errorf("newErrorResponder() fail: failed to reject a template format without template")
+	}
+	if _, responderErr := newErrorResponder(ErrorResponse{Format: "xml"}); responderErr == nil {
+		t.Errorf("newErrorResponder() fail: failed to reject an unknown format")
+	}
 }
 
-func TestSillyProxy(t *testing.T) {
+func TestForwardedHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Backend-End", "end")
+	}))
+	defer backend.Close()
 
-	for _, ver := range minTLSver {
-		resetParams()
-		TLSVersion := ver
-		invalidRouteMapFilePath := "invalidfilepath"
-		_, err := SillyProxy(&KeyStore, &KeyStorePass, &TLSVersion,
-			&Addr, &invalidRouteMapFilePath)
-		if err == nil {
-			t.Errorf("\nTestSillyProxy() fail: failed to catch buildRouteMap() error")
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		{
+			Host: "proxy.example.com",
+			MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/fwd", Route: []interface{}{backend.URL + "/fwd"}},
+			},
+		},
+	}}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+
+	newTestRequest := func() *http.Request {
+		testRequest := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/fwd", nil)
+		testRequest.RemoteAddr = "192.0.2.1:4321"
+		testRequest.Header.Set("X-Forwarded-For", "203.0.113.7")
+		testRequest.Header.Set("X-Forwarded-Proto", "http")
+		testRequest.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		testRequest.Header.Set("Forwarded", "for=203.0.113.7")
+		testRequest.Header.Set("Connection", "X-Client-Hop, keep-alive")
+		testRequest.Header.Set("X-Client-Hop", "hop")
+		testRequest.Header.Set("Proxy-Authorization", "Basic c2lsbHk6cHJveHk=")
+		testRequest.Header.Set("Te", "trailers, deflate")
+		testRequest.Header.Set("X-Client-End", "end")
+		return testRequest
+	}
+	defer func() { trustedProxies = nil }()
+
+	//a requestor outside trustedProxies cannot plant forwarding headers
+	trustedProxies = nil
+	recorder := httptest.NewRecorder()
+	testpHMap.ServeHTTP(recorder, newTestRequest())
+	expected := map[string]string{
+		"X-Forwarded-For":     "192.0.2.1",
+		"X-Forwarded-Proto":   "https",
+		"X-Forwarded-Host":    "proxy.example.com",
+		"Forwarded":           "for=192.0.2.1;host=proxy.example.com;proto=https",
+		"X-Client-Hop":        "",
+		"Proxy-Authorization": "",
+		"Te":                  "trailers",
+		"X-Client-End":        "end",
+	}
+	for key, value := range expected {
+		if received.Get(key) != value {
+			t.Errorf("setForwardedHeaders() fail: untrusted %s is %#v, expected %#v", key,
+				received.Get(key), value)
 		}
-		resetParams()
-		TLSVersion = ver
-		invalidKeyStoreFilePath := "invalidfilepath"
-		_, err = SillyProxy(&invalidKeyStoreFilePath, &KeyStorePass, &TLSVersion,
-			&Addr, &RouteMapFilePath)
-		if err == nil {
-			t.Errorf("\nTestSillyProxy() fail: failed to catch loadCertMap() error")
+	}
+	for _, key := range []string{"Connection", "X-Backend-Hop", "Keep-Alive"} {
+		if recorder.Header().Get(key) != "" {
+			t.Errorf("writeResponse() fail: hop-by-hop header %s was passed on", key)
 		}
-		resetParams()
-		TLSVersion = ver
-		sp, spError := SillyProxy(&KeyStore, &KeyStorePass,
-			&TLSVersion, &Addr, &RouteMapFilePath)
-		if spError != nil {
-			t.Errorf("\nTestSillyProxy() fail: failed with error: %s", spError)
+	}
+	if recorder.Header().Get("X-Backend-End") != "end" {
+		t.Errorf("writeResponse() fail: end-to-end header was not passed on")
+	}
+
+	//a trusted proxy's forwarding headers are extended
+	var parseErr error
+	if trustedProxies, parseErr = parseTrustedProxies("10.0.0.0/8, 192.0.2.1"); parseErr != nil {
+		t.Fatalf("parseTrustedProxies() fail: failed with error: %s", parseErr)
+	}
+	testpHMap.ServeHTTP(httptest.NewRecorder(), newTestRequest())
+	expected = map[string]string{
+		"X-Forwarded-For":   "203.0.113.7, 192.0.2.1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "spoofed.example.com",
+		"Forwarded":         "for=203.0.113.7, for=192.0.2.1;host=proxy.example.com;proto=https",
+	}
+	for key, value := range expected {
+		if received.Get(key) != value {
+			t.Errorf("setForwardedHeaders() fail: trusted %s is %#v, expected %#v", key,
+				received.Get(key), value)
 		}
-		testServer := httptest.NewUnstartedServer(sp.Handler)
-		testServer.Config = sp
-		testServer.StartTLS()
-		defer testServer.Close()
-		//log.Printf("\nTest log - Test server URL:%#v", testServer.URL+"/wild/qssum/index.html")
-		testClient := &http.Client{
-			//first create a transport that is tolerant to SSL errors
-			Transport: &http.Transport{
-				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-				DisableKeepAlives: false,
-			},
-			// we will not follow any redirect rather pass the instructions to
-			// the client
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			//we will declare a reasonable timeout value here. Alternatively we
-			// can look to parameterize this to fetch its value from routeMap
-			Timeout: 5 * time.Second,
+	}
+
+	if element := forwardedElement("2001:db8::1", "[2001:db8::2]:8443", "https"); element !=
+		`for="[2001:db8::1]";host="[2001:db8::2]:8443";proto=https` {
+		t.Errorf("forwardedElement() fail: IPv6 element rendered as %s", element)
+	}
+	if _, parseErr := parseTrustedProxies("10.0.0.0/33"); parseErr == nil {
+		t.Errorf("parseTrustedProxies() fail: failed to reject an invalid CIDR")
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	var presented []*x509.Certificate
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = r.TLS.PeerCertificates
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caBundle := "test_upstream_ca.pem"
+	ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: backend.Certificate().Raw}), 0644)
+	defer os.Remove(caBundle)
+	spki := sha256.Sum256(backend.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "silly-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, _ := x509.CreateCertificate(rand.Reader, clientTemplate, clientTemplate,
+		&clientKey.PublicKey, clientKey)
+	previousCertMap := certMap
+	defer func() { certMap = previousCertMap }()
+	certMap = newCertStore()
+	certMap.publish(&certSnapshot{certs: make(map[string]*tls.Certificate),
+		clientCerts: map[string]*tls.Certificate{
+			"backend": {Certificate: [][]byte{clientDER}, PrivateKey: clientKey},
+		}})
+
+	testCases := []struct {
+		path        string
+		upstreamTLS *UpstreamTLS
+		status      int
+	}{
+		{"/default", nil, http.StatusBadGateway},
+		{"/ca", &UpstreamTLS{CABundle: caBundle}, http.StatusOK},
+		{"/sni", &UpstreamTLS{CABundle: caBundle, ServerName: "example.com"}, http.StatusOK},
+		{"/badsni", &UpstreamTLS{CABundle: caBundle, ServerName: "wrong.test"}, http.StatusBadGateway},
+		{"/pinned", &UpstreamTLS{InsecureSkipVerify: true, PinnedSPKI: []string{wrongPin, pin}}, http.StatusOK},
+		{"/badpin", &UpstreamTLS{CABundle: caBundle, PinnedSPKI: []string{wrongPin}}, http.StatusBadGateway},
+		{"/mtls", &UpstreamTLS{CABundle: caBundle, ClientCert: "backend"}, http.StatusOK},
+	}
+	testHostMap := HostMap{Host: "127.0.0.1"}
+	for _, testCase := range testCases {
+		testHostMap.MethodPathMaps = append(testHostMap.MethodPathMaps, MethodPathMap{
+			Method:      "GET",
+			Path:        testCase.path,
+			Route:       []interface{}{backend.URL + testCase.path},
+			UpstreamTLS: testCase.upstreamTLS,
+		})
+	}
+	testRouteMap := &RouteMap{Routes: []HostMap{testHostMap}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	for _, testCase := range testCases {
+		presented = nil
+		recorder := httptest.NewRecorder()
+		testpHMap.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+			"https://127.0.0.1"+testCase.path, nil))
+		if recorder.Code != testCase.status {
+			t.Errorf("newUpstreamTLSConfig() fail: %s answered %d, expected %d",
+				testCase.path, recorder.Code, testCase.status)
 		}
-		testURIMaps := make(map[int][]string)
-		testURIMaps[200] = append(testURIMaps[200], "/google/wonderful")
-		testURIMaps[404] = append(testURIMaps[404], "/pattern/not/caught/by/proxy")
-		testURIMaps[301] = append(testURIMaps[301], "/redirect/")
-		testURIMaps[http.StatusBadRequest] = append(testURIMaps[http.StatusBadRequest], "/wild/notexistingdomain/validPathButNotExistingDownstream")
-		testURIMaps[http.StatusBadRequest] = append(testURIMaps[http.StatusBadRequest], "/failureCase/RoutePathIncorrect")
-		testURIMaps[http.StatusBadRequest] = append(testURIMaps[http.StatusBadRequest], "/invalid/")
+		if testCase.path == "/mtls" && (len(presented) == 0 ||
+			presented[0].Subject.CommonName != "silly-client") {
+			t.Errorf("newUpstreamTLSConfig() fail: client certificate was not presented")
+		}
+	}
 
-		for testStatus, testURIMap := range testURIMaps {
-			for _, testURI := range testURIMap {
-				testReq, _ := http.NewRequest(http.MethodGet, testServer.URL+testURI, nil)
-				testReq.Header.Add("Silly", "first value")
-				testReq.Header.Add("Silly", "second value")
-				testResponse, testResponseErr := testClient.Do(testReq)
-				if testResponseErr != nil {
-					t.Errorf("\nTest Request failed: %#v", testResponseErr.Error())
-				}
-				if testResponse.StatusCode != testStatus {
-					t.Errorf("\nTest Request failed for %#v: %#v", testURI, testResponse)
+	for _, invalid := range []UpstreamTLS{
+		{CABundle: "test_missing_ca.pem"},
+		{CABundle: RouteMapFilePath},
+		{PinnedSPKI: []string{"not-a-pin"}},
+	} {
+		invalidTLS := invalid
+		invalidRouteMap := &RouteMap{Routes: []HostMap{{Host: "127.0.0.1",
+			MethodPathMaps: []MethodPathMap{{Method: "GET", Path: "/",
+				Route: []interface{}{backend.URL}, UpstreamTLS: &invalidTLS}}}}}
+		if validateRouteMap(invalidRouteMap) == nil {
+			t.Errorf("validateRouteMap() fail: failed to reject UpstreamTLS %#v", invalid)
+		}
+	}
+
+	//client certificates are imported under the "client:" alias namespace
+	clientKeyStore := "test_client.keystore"
+	os.Remove(clientKeyStore)
+	defer os.Remove(clientKeyStore)
+	clientAlias := utility.ClientCertAliasPrefix + "backend"
+	pass := KeyStorePass
+	utility.GenerateKeyStore(&clientKeyStore, &alias_default, &ECDSA_Crt, &ECDSA_Key, &pass)
+	pass = KeyStorePass
+	utility.GenerateKeyStore(&clientKeyStore, &clientAlias, &RSA_Crt, &RSA_Key, &pass)
+	clientStore := newCertStore()
+	if loadErr := loadCertMap(&clientKeyStore, []byte(KeyStorePass), clientStore); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	if clientStore.snapshot().clientCerts["backend"] == nil ||
+		len(clientStore.snapshot().certs) != 0 {
+		t.Errorf("loadCertMap() fail: client certificate was not kept apart, got %#v",
+			clientStore.snapshot())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+			return
+		}
+		//streams go on for as long as they keep moving, stalled ones are cut off
+		if r.URL.Path == "/stream" || r.URL.Path == "/stalled" {
+			for i := 0; i < 6; i++ {
+				w.Write([]byte("tick\n"))
+				w.(http.Flusher).Flush()
+				if r.URL.Path == "/stalled" {
+					select {
+					case <-release:
+					case <-r.Context().Done():
+					}
+					return
 				}
-				//log.Printf("\nTest log - Test Response: %#v", testResponse)
-				//log.Printf("\nTest log - Test Response Body: %#v", testResponse.Body)
-				testResponse.Body.Close()
+				time.Sleep(300 * time.Millisecond)
 			}
+			return
 		}
+		if atomic.AddInt32(&hits, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	retry := RetryPolicy{Attempts: 3, Backoff: 1, RetryOn: []int{http.StatusServiceUnavailable}}
+	testRouteMap := &RouteMap{Routes: []HostMap{{
+		Host: "127.0.0.1",
+		MethodPathMaps: []MethodPathMap{
+			{Method: "GET", Path: "/flaky", Route: []interface{}{backend.URL + "/flaky"}, Retry: retry},
+			{Method: "POST", Path: "/flaky", Route: []interface{}{backend.URL + "/flaky"}, Retry: retry},
+			{Method: "GET", Path: "/slow", Route: []interface{}{backend.URL + "/slow"},
+				Timeouts: Timeouts{Total: 1}},
+			{Method: "HEAD", Path: "/slow", Route: []interface{}{backend.URL + "/slow"},
+				Timeouts: Timeouts{ResponseHeader: 1}},
+			{Method: "GET", Path: "/stream", Route: []interface{}{backend.URL + "/stream"},
+				Timeouts: Timeouts{Idle: 1}},
+			{Method: "GET", Path: "/stalled", Route: []interface{}{backend.URL + "/stalled"},
+				Timeouts: Timeouts{Idle: 1}},
+		},
+	}}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
 
+	testCases := []struct {
+		method, path string
+		status       int
+		hits         int32
+	}{
+		{http.MethodGet, "/flaky", http.StatusOK, 3},
+		{http.MethodPost, "/flaky", http.StatusServiceUnavailable, 1},
+		{http.MethodGet, "/slow", http.StatusGatewayTimeout, 0},
+		{http.MethodHead, "/slow", http.StatusGatewayTimeout, 0},
+	}
+	for _, testCase := range testCases {
+		atomic.StoreInt32(&hits, 0)
+		recorder := httptest.NewRecorder()
+		testpHMap.ServeHTTP(recorder, httptest.NewRequest(testCase.method,
+			"http://127.0.0.1"+testCase.path, nil))
+		if recorder.Code != testCase.status || atomic.LoadInt32(&hits) != testCase.hits {
+			t.Errorf("RetryPolicy fail: %s %s answered %d after %d attempts, expected %d after %d",
+				testCase.method, testCase.path, recorder.Code, atomic.LoadInt32(&hits),
+				testCase.status, testCase.hits)
+		}
+	}
+
+	//the idle timeout cuts off a stalled stream only, however long a moving one
+	// takes
+	for path, body := range map[string]string{"/stream": strings.Repeat("tick\n", 6),
+		"/stalled": "tick\n"} {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		testpHMap.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+			"http://127.0.0.1"+path, nil))
+		if recorder.Body.String() != body || time.Since(start) > 5*time.Second {
+			t.Errorf("Timeouts fail: %s streamed %#v in %s, expected %#v", path,
+				recorder.Body.String(), time.Since(start), body)
+		}
+	}
+
+	//the budget allows BudgetPercent of the requests in the window, but never
+	// fewer than MinRetriesPerSecond for each of its seconds
+	now := time.Unix(1000, 0)
+	budget := newRetryBudget(RetryPolicy{BudgetPercent: 20, MinRetriesPerSecond: 1})
+	budget.timeSource = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		budget.request()
+	}
+	for i := 0; i < 20; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("retryBudget.withdraw() fail: retry %d refused within budget", i+1)
+		}
+	}
+	if budget.withdraw() {
+		t.Errorf("retryBudget.withdraw() fail: retry allowed over budget")
+	}
+	now = now.Add(retryBudgetWindow * time.Second)
+	for i := 0; i < 10; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("retryBudget.withdraw() fail: minimum retries refused in a fresh window")
+		}
+	}
+	if budget.withdraw() {
+		t.Errorf("retryBudget.withdraw() fail: retry allowed over the minimum")
+	}
+
+	policy := RetryPolicy{Backoff: 10, MaxBackoff: 40}.withDefaults()
+	for n := uint(1); n < 10; n++ {
+		if wait := policy.backoff(n); wait > 40*time.Millisecond {
+			t.Errorf("RetryPolicy.backoff() fail: waited %s over MaxBackoff", wait)
+		}
+	}
+	if validateRetryPolicy(RetryPolicy{RetryOn: []int{42}}) == nil {
+		t.Errorf("validateRetryPolicy() fail: failed to reject an invalid status")
+	}
+}
+
+func TestUpgradeProxying(t *testing.T) {
+	var plainRequests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "silly" || !headerHasToken(r.Header, "Connection", "upgrade") {
+			atomic.AddInt32(&plainRequests, 1)
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n" +
+			"Upgrade: silly\r\nX-Echo: on\r\n\r\n")
+		buf.Flush()
+		//echo every line back until the proxy goes away
+		for {
+			line, readErr := buf.ReadString('\n')
+			if readErr != nil {
+				return
+			}
+			buf.WriteString(line)
+			buf.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	testRouteMap := &RouteMap{Routes: []HostMap{{
+		Host:             "127.0.0.1",
+		MaxUpgradedConns: 1,
+		MethodPathMaps: []MethodPathMap{
+			{Method: "GET", Path: "/tunnel", Route: []interface{}{backend.URL + "/tunnel"},
+				Upgrade: UpgradePolicy{Protocols: []string{"silly"}, IdleTimeout: 1}},
+			{Method: "GET", Path: "/plain", Route: []interface{}{backend.URL + "/plain"},
+				Upgrade: UpgradePolicy{Disabled: true}},
+		},
+	}}}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	//tunnels outlive the deadlines of the request that switched them
+	testProxy := httptest.NewUnstartedServer(testpHMap)
+	testProxy.Config.ReadTimeout = 500 * time.Millisecond
+	testProxy.Config.WriteTimeout = 500 * time.Millisecond
+	testProxy.Start()
+	defer testProxy.Close()
+
+	dialUpgrade := func(path string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, dialErr := net.Dial("tcp", testProxy.Listener.Addr().String())
+		if dialErr != nil {
+			t.Fatalf("upgrade fail: proxy could not be dialled: %s", dialErr)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: 127.0.0.1\r\n"+
+			"Connection: keep-alive, Upgrade\r\nUpgrade: silly\r\n\r\n", path)
+		reader := bufio.NewReader(conn)
+		resp, readErr := http.ReadResponse(reader, nil)
+		if readErr != nil {
+			t.Fatalf("upgrade fail: response could not be read: %s", readErr)
+		}
+		return conn, reader, resp
+	}
+
+	conn, reader, resp := dialUpgrade("/tunnel")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "silly" ||
+		resp.Header.Get("X-Echo") != "on" {
+		t.Fatalf("proxyUpgrade() fail: handshake answered with %#v", resp)
+	}
+	for _, message := range []string{"ping\n", "pong\n", "past the server's deadlines\n"} {
+		io.WriteString(conn, message)
+		if echoed, _ := reader.ReadString('\n'); echoed != message {
+			t.Errorf("proxyUpgrade() fail: echoed %#v for %#v", echoed, message)
+		}
+		time.Sleep(400 * time.Millisecond)
+	}
+
+	//the host allows a single upgraded connection at a time
+	secondConn, _, secondResp := dialUpgrade("/tunnel")
+	secondConn.Close()
+	if secondResp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("upgradeLimiter fail: second upgrade answered %d", secondResp.StatusCode)
+	}
+
+	//an idle tunnel is closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, readErr := reader.ReadString('\n'); readErr != io.EOF {
+		t.Errorf("proxyUpgrade() fail: idle tunnel was not closed, read returned %v", readErr)
+	}
+
+	//routes opting out of upgrades proxy the request as a plain one
+	plainConn, _, plainResp := dialUpgrade("/plain")
+	plainConn.Close()
+	if plainResp.StatusCode != http.StatusUpgradeRequired || atomic.LoadInt32(&plainRequests) != 1 {
+		t.Errorf("UpgradePolicy fail: opted out route answered %d", plainResp.StatusCode)
+	}
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	grpcHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Proto", r.Proto)
+		//HTTP/1.1 servers read the request body through before responding,
+		// only HTTP/2 streams both ways
+		if r.ProtoMajor == 2 {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		//echo the request body back as it streams in
+		io.Copy(newFlushWriter(w), r.Body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	})
+	h2Backend := httptest.NewUnstartedServer(grpcHandler)
+	h2Backend.EnableHTTP2 = true
+	h2Backend.StartTLS()
+	defer h2Backend.Close()
+	http1Backend := httptest.NewTLSServer(grpcHandler)
+	defer http1Backend.Close()
+	h2cBackend := httptest.NewServer(h2c.NewHandler(grpcHandler, &http2.Server{}))
+	defer h2cBackend.Close()
+
+	insecure := &UpstreamTLS{InsecureSkipVerify: true}
+	testRouteMap := &RouteMap{Routes: []HostMap{{
+		Host: "127.0.0.1",
+		MethodPathMaps: []MethodPathMap{
+			{Method: "POST", Path: "/h2", Route: []interface{}{h2Backend.URL + "/h2"},
+				UpstreamTLS: insecure, Protocol: "h2"},
+			{Method: "POST", Path: "/h2c", Route: []interface{}{h2cBackend.URL + "/h2c"},
+				Protocol: "h2c"},
+			{Method: "POST", Path: "/http1", Route: []interface{}{h2Backend.URL + "/http1"},
+				UpstreamTLS: insecure},
+			{Method: "POST", Path: "/noh2", Route: []interface{}{http1Backend.URL + "/noh2"},
+				UpstreamTLS: insecure, Protocol: "h2"},
+			{Method: "POST", Path: "/unreachable", Route: []interface{}{"http://127.0.0.1:1/"},
+				Protocol: "h2c"},
+			{Method: "POST", Path: "/slow", Route: []interface{}{h2cBackend.URL + "/slow"},
+				Protocol: "h2c", Timeouts: Timeouts{ResponseHeader: 1}},
+		},
+	}}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testProxy := httptest.NewUnstartedServer(testpHMap)
+	testProxy.EnableHTTP2 = true
+	testProxy.StartTLS()
+	defer testProxy.Close()
+	testClient := testProxy.Client()
+
+	call := func(path string, body io.Reader) *http.Response {
+		testRequest, _ := http.NewRequest(http.MethodPost, testProxy.URL+path, body)
+		testRequest.Header.Set("Content-Type", "application/grpc+proto")
+		testRequest.Header.Set("Te", "trailers")
+		testResponse, testResponseErr := testClient.Do(testRequest)
+		if testResponseErr != nil {
+			t.Fatalf("%s fail: request failed with error: %s", path, testResponseErr)
+		}
+		return testResponse
+	}
+
+	for path, proto := range map[string]string{"/h2": "HTTP/2.0", "/h2c": "HTTP/2.0"} {
+		//the request body streams through while the response streams back
+		bodyReader, bodyWriter := io.Pipe()
+		testResponse := call(path, bodyReader)
+		reader := bufio.NewReader(testResponse.Body)
+		for _, message := range []string{"first\n", "second\n"} {
+			io.WriteString(bodyWriter, message)
+			if echoed, _ := reader.ReadString('\n'); echoed != message {
+				t.Errorf("%s fail: echoed %#v for %#v", path, echoed, message)
+			}
+		}
+		bodyWriter.Close()
+		ioutil.ReadAll(reader)
+		testResponse.Body.Close()
+		if testResponse.ProtoMajor != 2 || testResponse.Header.Get("X-Proto") != proto {
+			t.Errorf("%s fail: proxied over %s to %s, expected HTTP/2.0 to %s", path,
+				testResponse.Proto, testResponse.Header.Get("X-Proto"), proto)
+		}
+		if testResponse.Trailer.Get("Grpc-Status") != "0" ||
+			testResponse.Trailer.Get("Grpc-Message") != "done" {
+			t.Errorf("%s fail: trailers arrived as %#v", path, testResponse.Trailer)
+		}
+	}
+
+	//HTTP/1.1 downstreams stay the default
+	testResponse := call("/http1", strings.NewReader("first\n"))
+	echoed, _ := ioutil.ReadAll(testResponse.Body)
+	testResponse.Body.Close()
+	if string(echoed) != "first\n" || testResponse.Header.Get("X-Proto") != "HTTP/1.1" ||
+		testResponse.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("/http1 fail: proxied to %s with trailers %#v",
+			testResponse.Header.Get("X-Proto"), testResponse.Trailer)
+	}
+
+	//failures are answered in gRPC's terms
+	for path, grpcStatus := range map[string]string{"/noh2": "14", "/unreachable": "14",
+		"/slow": "4"} {
+		testResponse := call(path, strings.NewReader("call"))
+		testResponse.Body.Close()
+		if testResponse.StatusCode != http.StatusOK ||
+			testResponse.Header.Get("Grpc-Status") != grpcStatus ||
+			testResponse.Header.Get(requestIDHeader) == "" {
+			t.Errorf("%s fail: gRPC failure answered with %d and grpc-status %#v", path,
+				testResponse.StatusCode, testResponse.Header.Get("Grpc-Status"))
+		}
+	}
+	if validateProtocol("spdy") == nil {
+		t.Errorf("validateProtocol() fail: failed to reject an unknown protocol")
+	}
+}
+
+func TestPlainHTTPListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		{Host: "secure.host", HTTPRedirect: HTTPRedirect{Status: 308, Port: 8443},
+			MethodPathMaps: []MethodPathMap{{Method: "GET", Path: "/app",
+				Route: []interface{}{backend.URL + "/app"}}}},
+		{Host: "moved.host", HTTPRedirect: HTTPRedirect{Host: "new.host"},
+			MethodPathMaps: []MethodPathMap{{Method: "GET", Path: "/app",
+				Route: []interface{}{backend.URL + "/app"}}}},
+		{Host: "plain.host", HTTPRedirect: HTTPRedirect{Disabled: true},
+			MethodPathMaps: []MethodPathMap{{Method: "GET", Path: "/app",
+				Route: []interface{}{backend.URL + "/app"}}}},
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	pools := assignRoutes(testpHMap, testRouteMap)
+
+	webroot, _ := ioutil.TempDir("", "test_webroot")
+	defer os.RemoveAll(webroot)
+	ioutil.WriteFile(filepath.Join(webroot, "fileToken"), []byte("fileToken.thumbprint\n"), 0600)
+	acmeWebroot = webroot
+	defer func() { acmeWebroot = "" }()
+	acmeChallenges.set("storeToken", "storeToken.thumbprint")
+	defer acmeChallenges.remove("storeToken")
+
+	plainServer := newPlainServer("", newProxyHandler(testpHMap, pools))
+	testPlain := httptest.NewServer(plainServer.Handler)
+	defer testPlain.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(host, path string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", testPlain.URL+path, nil)
+		req.Host = host
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			t.Fatalf("cleartext listener fail: request failed with error: %s", respErr)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, _ := get("secure.host:80", "/app?q=1"); resp.StatusCode != 308 ||
+		resp.Header.Get("Location") != "https://secure.host:8443/app?q=1" {
+		t.Errorf("serveCleartext() fail: redirected with %d to %#v", resp.StatusCode,
+			resp.Header.Get("Location"))
+	}
+	if resp, _ := get("moved.host", "/app"); resp.StatusCode != 301 ||
+		resp.Header.Get("Location") != "https://new.host/app" {
+		t.Errorf("serveCleartext() fail: redirected with %d to %#v", resp.StatusCode,
+			resp.Header.Get("Location"))
+	}
+	if resp, body := get("plain.host", "/app"); resp.StatusCode != 200 || body != "/app http" {
+		t.Errorf("serveCleartext() fail: opted out host answered with %d: %#v",
+			resp.StatusCode, body)
+	}
+	if resp, _ := get("unknown.host", "/app"); resp.StatusCode != 403 {
+		t.Errorf("cleartext listener fail: unknown host answered with %d", resp.StatusCode)
+	}
+	for token, keyAuth := range map[string]string{"storeToken": "storeToken.thumbprint",
+		"fileToken": "fileToken.thumbprint"} {
+		if resp, body := get("unknown.host", acmeChallengePath+token); resp.StatusCode != 200 ||
+			body != keyAuth {
+			t.Errorf("acmeChallengeHandler() fail: %s answered with %d: %#v", token,
+				resp.StatusCode, body)
+		}
+	}
+	for _, token := range []string{"missingToken", "..%2Fsecret", ""} {
+		if resp, _ := get("secure.host", acmeChallengePath+token); resp.StatusCode != 404 {
+			t.Errorf("acmeChallengeHandler() fail: %#v answered with %d", token, resp.StatusCode)
+		}
+	}
+	if validateHTTPRedirect(HTTPRedirect{Status: 200}) == nil {
+		t.Errorf("validateHTTPRedirect() fail: failed to reject a non redirect status")
+	}
+}
+
+// fakeACMEServer is a bare bones RFC 8555 server. It checks no signatures and
+// validates challenges by handing them to validate. Hosts beginning with
+// "http." are offered HTTP-01 alone, any other host TLS-ALPN-01 alone.
+type fakeACMEServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	orders   []*fakeACMEOrder
+	nonces   int
+	validate func(host, challengeType, token string) error
+}
+
+type fakeACMEOrder struct {
+	host, authz, status, certificate string
+	chain                            []byte
+}
+
+func newFakeACMEServer(validate func(host, challengeType, token string) error) *fakeACMEServer {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "Fake ACME CA"}, NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(24 * time.Hour), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caCert, _ := x509.ParseCertificate(caDER)
+	fake := &fakeACMEServer{caKey: caKey, caCert: caCert, validate: validate}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (fake *fakeACMEServer) serve(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.nonces++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", fake.nonces))
+	var jws struct{ Payload string }
+	var payload []byte
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+	reply := func(status int, location string, body interface{}) {
+		if location != "" {
+			w.Header().Set("Location", fake.URL+location)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var order *fakeACMEOrder
+	var id int
+	if len(parts) > 1 {
+		fmt.Sscanf(parts[1], "%d", &id)
+		if id < len(fake.orders) {
+			order = fake.orders[id]
+		}
+	}
+	orderBody := func(id int) map[string]interface{} {
+		order := fake.orders[id]
+		return map[string]interface{}{"status": order.status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": order.host}},
+			"authorizations": []string{fmt.Sprintf("%s/authz/%d", fake.URL, id)},
+			"finalize":       fmt.Sprintf("%s/finalize/%d", fake.URL, id),
+			"certificate":    order.certificate}
+	}
+	challengeBody := func(id int, status string) map[string]string {
+		challengeType := acmeTLSALPN01
+		if strings.HasPrefix(fake.orders[id].host, "http.") {
+			challengeType = acmeHTTP01
+		}
+		return map[string]string{"type": challengeType, "status": status,
+			"url":   fmt.Sprintf("%s/challenge/%d", fake.URL, id),
+			"token": fmt.Sprintf("token%d", id)}
+	}
+	switch {
+	case parts[0] == "directory":
+		reply(http.StatusOK, "", map[string]string{"newNonce": fake.URL + "/nonce",
+			"newAccount": fake.URL + "/account", "newOrder": fake.URL + "/order"})
+	case parts[0] == "nonce":
+		w.WriteHeader(http.StatusOK)
+	case parts[0] == "account":
+		reply(http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+	case parts[0] == "order" && order == nil:
+		var request struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &request)
+		fake.orders = append(fake.orders, &fakeACMEOrder{host: request.Identifiers[0].Value,
+			authz: "pending", status: "pending"})
+		id = len(fake.orders) - 1
+		reply(http.StatusCreated, fmt.Sprintf("/order/%d", id), orderBody(id))
+	case parts[0] == "order":
+		reply(http.StatusOK, fmt.Sprintf("/order/%d", id), orderBody(id))
+	case parts[0] == "authz" && order != nil:
+		reply(http.StatusOK, "", map[string]interface{}{"status": order.authz,
+			"identifier": map[string]string{"type": "dns", "value": order.host},
+			"challenges": []map[string]string{challengeBody(id, order.authz)}})
+	case parts[0] == "challenge" && order != nil:
+		challenge := challengeBody(id, "valid")
+		order.authz, order.status = "valid", "ready"
+		if validateErr := fake.validate(order.host, challenge["type"],
+			challenge["token"]); validateErr != nil {
+			log.Printf("fake ACME server: %s validation failed: %v", order.host, validateErr)
+			challenge["status"], order.authz, order.status = "invalid", "invalid", "invalid"
+		}
+		reply(http.StatusOK, "", challenge)
+	case parts[0] == "finalize" && order != nil && order.status == "ready":
+		var request struct{ CSR string }
+		json.Unmarshal(payload, &request)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, csrErr := x509.ParseCertificateRequest(csrDER)
+		if csrErr != nil {
+			reply(http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+			return
+		}
+		template := &x509.Certificate{SerialNumber: big.NewInt(int64(id + 2)),
+			Subject: pkix.Name{CommonName: order.host}, DNSNames: csr.DNSNames,
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		leafDER, _ := x509.CreateCertificate(rand.Reader, template, fake.caCert, csr.PublicKey, fake.caKey)
+		order.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.caCert.Raw})...)
+		order.status, order.certificate = "valid", fmt.Sprintf("%s/cert/%d", fake.URL, id)
+		reply(http.StatusOK, fmt.Sprintf("/order/%d", id), orderBody(id))
+	case parts[0] == "cert" && order != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.chain)
+	default:
+		reply(http.StatusNotFound, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		{Host: "alpn.acme.test", ACME: ACMEHost{Enabled: true, KeyTypes: []string{"ECDSA", "RSA"}}},
+		{Host: "http.acme.test", ACME: ACMEHost{Enabled: true}},
+		{Host: "manual.acme.test"},
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	pHandler := newProxyHandler(testpHMap, assignRoutes(testpHMap, testRouteMap))
+
+	//the listeners ACME servers validate challenges against
+	plainServer := httptest.NewServer(newPlainServer("", pHandler).Handler)
+	defer plainServer.Close()
+	alpnListener, listenErr := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: returnCert, NextProtos: []string{acmeALPNProto, "http/1.1"}})
+	if listenErr != nil {
+		t.Fatalf("TLS listener could not be started: %s", listenErr)
+	}
+	defer alpnListener.Close()
+	go func() {
+		for {
+			conn, acceptErr := alpnListener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	acmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	fake := newFakeACMEServer(func(host, challengeType, token string) error {
+		if challengeType == acmeHTTP01 {
+			req, _ := http.NewRequest("GET", plainServer.URL+acmeChallengePath+token, nil)
+			req.Host = host
+			resp, respErr := http.DefaultClient.Do(req)
+			if respErr != nil {
+				return respErr
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if !strings.HasPrefix(string(body), token+".") {
+				return fmt.Errorf("key authorization %#v served for %s", body, token)
+			}
+			return nil
+		}
+		conn, dialErr := tls.Dial("tcp", alpnListener.Addr().String(), &tls.Config{
+			ServerName: host, NextProtos: []string{acmeALPNProto}, InsecureSkipVerify: true})
+		if dialErr != nil {
+			return dialErr
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != acmeALPNProto {
+			return fmt.Errorf("negotiated %#v", state.NegotiatedProtocol)
+		}
+		for _, extension := range state.PeerCertificates[0].Extensions {
+			if extension.Id.Equal(acmeIdentifier) && extension.Critical {
+				return nil
+			}
+		}
+		return fmt.Errorf("challenge certificate lacks the acmeIdentifier extension")
+	})
+	defer fake.Close()
+
+	acmeKeyStore := "test_acme.keystore"
+	keyStoreBytes, _ := ioutil.ReadFile(KeyStore)
+	ioutil.WriteFile(acmeKeyStore, keyStoreBytes, 0600)
+	defer os.Remove(acmeKeyStore)
+	accountKeyFile := "test_acme_account.key"
+	defer os.Remove(accountKeyFile)
+	store := newCertStore()
+	if loadErr := loadCertMap(&acmeKeyStore, []byte(KeyStorePass), store); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+
+	manager, managerErr := newACMEManager(acmeOptions{directoryURL: fake.URL + "/directory",
+		accountKeyFile: accountKeyFile, challenges: []string{acmeTLSALPN01, acmeHTTP01}},
+		pHandler, store, acmeChallenges, &acmeKeyStore, []byte(KeyStorePass))
+	if managerErr != nil {
+		t.Fatalf("newACMEManager() fail: failed with error: %s", managerErr)
+	}
+	manager.renew(context.Background())
+
+	snapshot := store.snapshot()
+	for _, alias := range []string{"alpn.acme.test:ECDSA", "alpn.acme.test:RSA", "http.acme.test:ECDSA"} {
+		cert, exists := snapshot.certs[alias]
+		if !exists {
+			t.Errorf("acmeManager.renew() fail: %s was not picked up off the keystore", alias)
+			continue
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if leaf.VerifyHostname(strings.Split(alias, ":")[0]) != nil || len(cert.Certificate) != 2 {
+			t.Errorf("acmeManager.renew() fail: %s holds an unexpected certificate", alias)
+		}
+	}
+	if _, isRSA := snapshot.certs["alpn.acme.test:RSA"].PrivateKey.(*rsa.PrivateKey); !isRSA {
+		t.Errorf("acmeManager.renew() fail: RSA certificate was not issued to an RSA key")
+	}
+	if _, exists := snapshot.certs["manual.acme.test:ECDSA"]; exists || len(fake.orders) != 3 {
+		t.Errorf("acmeManager.renew() fail: placed %d orders", len(fake.orders))
+	}
+	if _, pending := acmeChallenges.getCert("alpn.acme.test"); pending {
+		t.Errorf("acmeManager.authorize() fail: challenge certificate left behind")
+	}
+
+	//certificates are not renewed until they are into the last third of their
+	// validity
+	manager.renew(context.Background())
+	if len(fake.orders) != 3 {
+		t.Errorf("acmeManager.renew() fail: renewed a fresh certificate")
+	}
+	leaf, _ := x509.ParseCertificate(snapshot.certs["http.acme.test:ECDSA"].Certificate[0])
+	if dueForRenewal(snapshot, "http.acme.test:ECDSA", leaf.NotAfter.Add(-40*24*time.Hour)) ||
+		!dueForRenewal(snapshot, "http.acme.test:ECDSA", leaf.NotAfter.Add(-20*24*time.Hour)) {
+		t.Errorf("dueForRenewal() fail: renewal not due in the last third of validity")
+	}
+	if _, statErr := os.Stat(accountKeyFile); statErr != nil {
+		t.Errorf("newACMEManager() fail: account key was not written: %s", statErr)
+	}
+	for _, invalid := range []HostMap{{Host: "default", ACME: ACMEHost{Enabled: true}},
+		{Host: "dsa.acme.test", ACME: ACMEHost{Enabled: true, KeyTypes: []string{"DSA"}}}} {
+		if validateRouteMap(&RouteMap{Routes: []HostMap{invalid}}) == nil {
+			t.Errorf("validateRouteMap() fail: failed to reject ACME for %#v", invalid)
+		}
+	}
+}
+
+func TestAssignRoutes(t *testing.T) {
+
+}
+
+func TestWriteResponse(t *testing.T) {
+	release := make(chan struct{})
+	testBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Silly-Trailer")
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second")
+		w.Header().Set("Silly-Trailer", "done")
+	}))
+	defer testBackend.Close()
+
+	testRouteMap := &RouteMap{Routes: []HostMap{{
+		Host: "127.0.0.1",
+		MethodPathMaps: []MethodPathMap{{
+			Method: "GET",
+			Path:   "/stream",
+			Route:  []interface{}{testBackend.URL + "/stream"},
+		}},
+	}}}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testProxy := httptest.NewServer(testpHMap)
+	defer testProxy.Close()
+
+	testResponse, testResponseErr := http.Get(testProxy.URL + "/stream")
+	if testResponseErr != nil {
+		close(release)
+		t.Fatalf("writeResponse() fail: request failed with error: %s", testResponseErr)
+	}
+	defer testResponse.Body.Close()
+	// the first chunk must reach the client while the backend is still holding
+	// on to the rest of the body
+	firstChunk := make([]byte, len("first"))
+	if _, readErr := io.ReadFull(testResponse.Body, firstChunk); readErr != nil ||
+		string(firstChunk) != "first" {
+		t.Errorf("writeResponse() fail: first chunk was not streamed, got %#v", string(firstChunk))
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(testResponse.Body)
+	if string(rest) != "second" {
+		t.Errorf("writeResponse() fail: expected remainder \"second\", got %#v", string(rest))
+	}
+	if testResponse.Trailer.Get("Silly-Trailer") != "done" {
+		t.Errorf("writeResponse() fail: trailer was not relayed, got %#v", testResponse.Trailer)
+	}
+}
+
+func TestCopyHeader(t *testing.T) {
+	responseHeaders := http.Header{
+		"Set-Cookie": {
+			"session=abc; Path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Secure; HttpOnly",
+			"theme=dark; Max-Age=3600; SameSite=Strict",
+			"lang=en-US; Domain=example.com; Path=/docs",
+		},
+		"Www-Authenticate": {`Basic realm="silly"`, `Bearer realm="silly", error="invalid_token"`},
+		"X-Multi":          {"a", "b, c"},
+		"Vary":             {"Accept", "Accept-Encoding"},
+	}
+	var received http.Header
+	testBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		for key, values := range responseHeaders {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		//a key set bypassing canonicalisation goes on the wire as is
+		w.Header()["x-raw-key"] = []string{"raw"}
+	}))
+	defer testBackend.Close()
+
+	testRouteMap := &RouteMap{Routes: []HostMap{{
+		Host: "127.0.0.1",
+		MethodPathMaps: []MethodPathMap{{
+			Method: "GET",
+			Path:   "/headers",
+			Route:  []interface{}{testBackend.URL + "/headers"},
+		}},
+	}}}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testProxy := httptest.NewServer(testpHMap)
+	defer testProxy.Close()
+
+	testRequest, _ := http.NewRequest(http.MethodGet, testProxy.URL+"/headers", nil)
+	requestHeaders := http.Header{
+		"X-Dup":     {"one", "two"},
+		"Cookie":    {"a=1; b=2", "c=3"},
+		"Accept":    {"text/html", "application/json;q=0.9"},
+		"X-Comma":   {"keep, as, one"},
+		"X-Empty":   {""},
+		"X-Unicode": {"caf\u00e9"},
+	}
+	for key, values := range requestHeaders {
+		testRequest.Header[key] = values
+	}
+	testRequest.Header["x-lower-case"] = []string{"lower"}
+	testRequest.Header["X_Under_Score"] = []string{"under"}
+	testResponse, testResponseErr := http.DefaultClient.Do(testRequest)
+	if testResponseErr != nil {
+		t.Fatalf("copyHeader() fail: request failed with error: %s", testResponseErr)
+	}
+	testResponse.Body.Close()
+
+	requestHeaders["X-Lower-Case"] = []string{"lower"}
+	requestHeaders["X_under_score"] = []string{"under"}
+	for key, values := range requestHeaders {
+		if strings.Join(received[key], "|") != strings.Join(values, "|") {
+			t.Errorf("copyHeader() fail: request header %s arrived as %#v, expected %#v",
+				key, received[key], values)
+		}
+	}
+	responseHeaders["X-Raw-Key"] = []string{"raw"}
+	for key, values := range responseHeaders {
+		if strings.Join(testResponse.Header[key], "|") != strings.Join(values, "|") {
+			t.Errorf("copyHeader() fail: response header %s arrived as %#v, expected %#v",
+				key, testResponse.Header[key], values)
+		}
+	}
+	cookies := testResponse.Cookies()
+	if len(cookies) != 3 || cookies[0].Name != "session" || !cookies[0].HttpOnly ||
+		!cookies[0].Secure || cookies[0].Expires.Day() != 21 || cookies[1].MaxAge != 3600 ||
+		cookies[1].SameSite != http.SameSiteStrictMode || cookies[2].Domain != "example.com" {
+		t.Errorf("copyHeader() fail: cookies arrived as %#v", cookies)
+	}
+
+	//copyHeader keeps keys as they are and adds to values already present
+	dst := http.Header{"X-Present": {"first"}}
+	copyHeader(dst, http.Header{"X-Present": {"second"}, "x-odd-Key": {"odd"}})
+	if strings.Join(dst["X-Present"], "|") != "first|second" || dst["x-odd-Key"][0] != "odd" {
+		t.Errorf("copyHeader() fail: copied into %#v", dst)
+	}
+}
+
+func TestProxyHandlerMapServeHTTP(t *testing.T) {
+	testpHMap := newProxyHanlderMap()
+	testRouter := httprouter.New()
+	testRouter.GET("/", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		fmt.Fprint(w, "Welcome!\n")
+	})
+	testpHMap.hosts["www.donkeys.com"] = testRouter
+	testServer := httptest.NewUnstartedServer(testpHMap)
+	testServer.Start()
+	defer testServer.Close()
+	testClient := &http.Client{
+		//first create a transport that is tolerant to SSL errors
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: false,
+		},
+		// we will not follow any redirect rather pass the instructions to
+		// the client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		//we will declare a reasonable timeout value here. Alternatively we
+		// can look to parameterize this to fetch its value from routeMap
+		Timeout: 5 * time.Second,
+	}
+	testResponse, _ := testClient.Get(testServer.URL + "/")
+	if testResponse.StatusCode != 403 {
+		t.Errorf("\nPHMap.ServeHTTP() fail: failed to handle non-Mapped hosts")
+	}
+}
+
+func TestHostMatching(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	hostMap := func(host, label string) HostMap {
+		return HostMap{Host: host, MethodPathMaps: []MethodPathMap{{Method: "GET", Path: "/",
+			Route: []interface{}{backend.URL + "/" + label}}}}
+	}
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		hostMap("*", "default"),
+		hostMap("~.*\\.example\\.org", "anyOrg"),
+		hostMap("api.example.test", "exact"),
+		hostMap("*.example.test", "wildcard"),
+		hostMap("*.deep.example.test", "deepWildcard"),
+		hostMap("~tenant-[0-9]+\\.example\\.org", "tenant"),
+		hostMap("Mixed.Example.test", "mixed"),
+		hostMap("::1", "ipv6"),
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(serverURL, host string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", serverURL+"/", nil)
+		req.Host = host
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			t.Fatalf("host matching fail: request failed with error: %s", respErr)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testServer := httptest.NewServer(testpHMap)
+	defer testServer.Close()
+	for host, label := range map[string]string{
+		"api.example.test:8443": "/exact",
+		"www.example.test":      "/wildcard",
+		"a.deep.example.test":   "/deepWildcard",
+		"b.a.deep.example.test": "/deepWildcard",
+		"example.test":          "/default",
+		"www.example.org":       "/anyOrg",
+		//regex hosts are tried in the order of the routes file
+		"tenant-7.example.org":          "/anyOrg",
+		"tenant-7.example.org.evil.com": "/default",
+		"unknown.host":                  "/default",
+		//names match regardless of case, port and trailing dot
+		"API.Example.Test":      "/exact",
+		"api.example.test.":     "/exact",
+		"API.example.test.:443": "/exact",
+		"WWW.Example.test":      "/wildcard",
+		"mixed.example.TEST":    "/mixed",
+		"TENANT-7.Example.org":  "/anyOrg",
+		"[::1]:8443":            "/ipv6",
+		"[::1]":                 "/ipv6",
+	} {
+		if _, body := get(testServer.URL, host); body != label {
+			t.Errorf("proxyHanlderMap.lookup() fail: %s was routed to %#v in place of %#v",
+				host, body, label)
+		}
+	}
+
+	//without a default host, unmatched hosts are rejected or redirected
+	testRouteMap.Routes = testRouteMap.Routes[2:]
+	for _, testCase := range []struct {
+		unmatched UnmatchedHost
+		status    int
+		location  string
+	}{
+		{UnmatchedHost{}, 403, ""},
+		{UnmatchedHost{Action: "reject"}, 403, ""},
+		{UnmatchedHost{Action: "redirect", Location: "https://www.example.test/"}, 302,
+			"https://www.example.test/"},
+		{UnmatchedHost{Action: "redirect", Location: "https://www.example.test/", Status: 301},
+			301, "https://www.example.test/"},
+	} {
+		testRouteMap.Unmatched = testCase.unmatched
+		unmatchedpHMap := newProxyHanlderMap()
+		assignRoutes(unmatchedpHMap, testRouteMap)
+		unmatchedServer := httptest.NewServer(unmatchedpHMap)
+		if resp, _ := get(unmatchedServer.URL, "unknown.host"); resp.StatusCode != testCase.status ||
+			resp.Header.Get("Location") != testCase.location {
+			t.Errorf("UnmatchedHost.serve() fail: %#v answered with %d to %#v", testCase.unmatched,
+				resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if _, body := get(unmatchedServer.URL, "www.example.test"); body != "/wildcard" {
+			t.Errorf("UnmatchedHost.serve() fail: matched host was routed to %#v", body)
+		}
+		unmatchedServer.Close()
+	}
+
+	for _, invalid := range []*RouteMap{
+		{Routes: []HostMap{{Host: "www.*.example.test"}}},
+		{Routes: []HostMap{{Host: "*."}}},
+		{Routes: []HostMap{{Host: "~tenant-(["}}},
+		{Unmatched: UnmatchedHost{Action: "redirect", Location: "/relative"}},
+		{Unmatched: UnmatchedHost{Action: "redirect", Location: "https://a.test/", Status: 200}},
+		{Unmatched: UnmatchedHost{Action: "drop"}},
+	} {
+		if validateRouteMap(invalid) == nil {
+			t.Errorf("validateRouteMap() fail: failed to reject %#v", invalid)
+		}
+	}
+}
+
+func TestRouteBuilder(t *testing.T) {
+
+}
+
+func TestTLSPolicy(t *testing.T) {
+	for preset := range tlsPresets {
+		if presetErr := validateTLSPolicy(TLSPolicy{Preset: preset}.withPreset()); presetErr != nil {
+			t.Errorf("validateTLSPolicy() fail: preset %s failed with error: %s", preset, presetErr)
+		}
+	}
+	for _, invalid := range []TLSPolicy{
+		{Preset: "paranoid"},
+		{MinVersion: "1.4"},
+		{MaxVersion: "3.0"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_512_GCM"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{Preset: "modern", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		{Curves: []string{"P224"}},
+		{ALPN: []string{"spdy/3"}},
+		//TLS 1.1 has no use for suites of TLS 1.2 only
+		{Preset: "intermediate", MinVersion: "1.0", MaxVersion: "1.1"},
+	} {
+		if validateTLSPolicy(invalid.withPreset()) == nil {
+			t.Errorf("validateTLSPolicy() fail: failed to catch invalid policy %#v", invalid)
+		}
+	}
+	global := TLSPolicy{Preset: "intermediate", Curves: []string{"P256"},
+		DisableSessionTickets: true}
+	refined := resolveTLSPolicy(global, TLSPolicy{MaxVersion: "1.2"})
+	if refined.MinVersion != "1.2" || refined.MaxVersion != "1.2" ||
+		len(refined.CipherSuites) != len(tlsPresets["intermediate"].CipherSuites) ||
+		len(refined.Curves) != 1 || !refined.DisableSessionTickets {
+		t.Errorf("resolveTLSPolicy() fail: host policy did not build on the global one: %#v",
+			refined)
+	}
+	startedOver := resolveTLSPolicy(global, TLSPolicy{Preset: "legacy"})
+	if startedOver.MinVersion != "1.0" ||
+		len(startedOver.Curves) != len(tlsPresets["legacy"].Curves) ||
+		!startedOver.DisableSessionTickets {
+		t.Errorf("resolveTLSPolicy() fail: host preset did not start over: %#v", startedOver)
+	}
+	if invalidRouteMap := (&RouteMap{TLS: TLSPolicy{Preset: "paranoid"}}); validateRouteMap(
+		invalidRouteMap) == nil {
+		t.Errorf("validateRouteMap() fail: failed to catch an invalid global TLS policy")
+	}
+
+	//handshakes get the policy of the host they ask for
+	if loadErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	hostMap := func(host string, policy TLSPolicy) HostMap {
+		return HostMap{Host: host, TLS: policy, MethodPathMaps: []MethodPathMap{{Method: "GET",
+			Path: "/", Route: []interface{}{"http://127.0.0.1:1/"}}}}
+	}
+	testRouteMap := &RouteMap{TLS: TLSPolicy{Preset: "intermediate"}, Routes: []HostMap{
+		hostMap("global.test", TLSPolicy{}),
+		hostMap("modern.test", TLSPolicy{Preset: "modern"}),
+		hostMap("old.test", TLSPolicy{Preset: "legacy", MaxVersion: "1.1"}),
+		hostMap("h1only.test", TLSPolicy{ALPN: []string{"http/1.1"}}),
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	pHandler := newProxyHandler(testpHMap, nil)
+	handshake := func(serverName string, minVersion, maxVersion uint16) (tls.ConnectionState, error) {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go tls.Server(serverConn, &tls.Config{GetCertificate: returnCert,
+			GetConfigForClient: pHandler.tlsConfigForClient}).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName,
+			InsecureSkipVerify: true, MinVersion: minVersion, MaxVersion: maxVersion,
+			NextProtos: []string{"h2", "http/1.1"}})
+		handshakeErr := client.Handshake()
+		return client.ConnectionState(), handshakeErr
+	}
+	for _, testCase := range []struct {
+		serverName string
+		minVersion uint16
+		maxVersion uint16
+		version    uint16
+		protocol   string
+	}{
+		{"global.test", tls.VersionTLS12, tls.VersionTLS13, tls.VersionTLS13, "h2"},
+		{"global.test", tls.VersionTLS10, tls.VersionTLS11, 0, ""},
+		{"modern.test", tls.VersionTLS12, tls.VersionTLS12, 0, ""},
+		{"modern.test", tls.VersionTLS12, tls.VersionTLS13, tls.VersionTLS13, "h2"},
+		{"old.test", tls.VersionTLS10, tls.VersionTLS13, tls.VersionTLS11, "h2"},
+		{"h1only.test", tls.VersionTLS12, tls.VersionTLS13, tls.VersionTLS13, "http/1.1"},
+	} {
+		state, handshakeErr := handshake(testCase.serverName, testCase.minVersion,
+			testCase.maxVersion)
+		if testCase.version == 0 {
+			if handshakeErr == nil {
+				t.Errorf("tlsConfigForClient() fail: %s accepted TLS %x to %x",
+					testCase.serverName, testCase.minVersion, testCase.maxVersion)
+			}
+			continue
+		}
+		if handshakeErr != nil {
+			t.Errorf("tlsConfigForClient() fail: handshake with %s failed with error: %s",
+				testCase.serverName, handshakeErr)
+			continue
+		}
+		if state.Version != testCase.version || state.NegotiatedProtocol != testCase.protocol {
+			t.Errorf("tlsConfigForClient() fail: %s negotiated TLS %x and %#v in place of %x "+
+				"and %#v", testCase.serverName, state.Version, state.NegotiatedProtocol,
+				testCase.version, testCase.protocol)
+		}
+	}
+}
+
+func TestSessionTicketKeys(t *testing.T) {
+	now := time.Now()
+	keyOf := func(b byte) [32]byte {
+		var key [32]byte
+		key[0] = b
+		return key
+	}
+	ordered := orderTicketKeys([]ticketKey{
+		{keyOf(1), now.Add(-3 * time.Hour)},
+		{keyOf(3), now.Add(-10 * time.Minute)},
+		{keyOf(2), now.Add(-90 * time.Minute)},
+	}, now)
+	if len(ordered) != 3 || ordered[0] != keyOf(2) || ordered[1] != keyOf(3) ||
+		ordered[2] != keyOf(1) {
+		t.Errorf("orderTicketKeys() fail: keys ordered as %v", ordered)
+	}
+	//with no key old enough to be promoted the oldest encrypts
+	ordered = orderTicketKeys([]ticketKey{{keyOf(3), now}, {keyOf(2), now.Add(-time.Minute)}}, now)
+	if ordered[0] != keyOf(2) {
+		t.Errorf("orderTicketKeys() fail: fresh keys ordered as %v", ordered)
+	}
+
+	keyFile := "test_ticket.keys"
+	defer os.Remove(keyFile)
+	encoded := func(b byte) string {
+		key := keyOf(b)
+		return base64.StdEncoding.EncodeToString(key[:])
+	}
+	ioutil.WriteFile(keyFile, []byte("# current\n"+encoded(7)+"\n\n"+encoded(8)+"\n"), 0600)
+	fileKeys, readErr := readTicketKeyFile(keyFile)
+	if readErr != nil || len(fileKeys) != 2 || fileKeys[0] != keyOf(7) {
+		t.Errorf("readTicketKeyFile() fail: read %v with error %v", fileKeys, readErr)
+	}
+	for _, invalid := range []string{"", "# none\n", "c2hvcnQ=\n", "not base64\n"} {
+		ioutil.WriteFile(keyFile, []byte(invalid), 0600)
+		if _, readErr = readTicketKeyFile(keyFile); readErr == nil {
+			t.Errorf("readTicketKeyFile() fail: failed to catch invalid key file %#v", invalid)
+		}
+	}
+
+	//ticket keys added to the keystore come in with the certificates
+	ticketKeyStore := "test_ticket.keystore"
+	keyStoreBytes, _ := ioutil.ReadFile(KeyStore)
+	ioutil.WriteFile(ticketKeyStore, keyStoreBytes, 0600)
+	defer os.Remove(ticketKeyStore)
+	for i := 0; i < 2; i++ {
+		if addErr := utility.AddTicketKey(ticketKeyStore, []byte(KeyStorePass), 3); addErr != nil {
+			t.Fatalf("AddTicketKey() fail: failed with error: %s", addErr)
+		}
+	}
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&ticketKeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	if keys := certMap.snapshot().ticketKeys; len(keys) != 2 {
+		t.Errorf("loadCertMap() fail: loaded %d session ticket keys in place of 2", len(keys))
+	}
+	ring := newTicketKeyRing()
+	if loadErr := loadTicketKeys(certMap, "", ring, time.Now()); loadErr != nil ||
+		len(ring.load().keys) != 2 {
+		t.Errorf("loadTicketKeys() fail: ring holds %d keys with error %v",
+			len(ring.load().keys), loadErr)
+	}
+
+	//two replicas sharing ticket keys resume each other's sessions
+	previousRing := sessionTicketKeys
+	sessionTicketKeys = newTicketKeyRing()
+	defer func() { sessionTicketKeys = previousRing }()
+	sessionTicketKeys.set([][32]byte{keyOf(1)})
+	testRouteMap := &RouteMap{TLS: TLSPolicy{MinVersion: "1.2", MaxVersion: "1.2"},
+		Routes: []HostMap{{Host: "ticket.test", MethodPathMaps: []MethodPathMap{{Method: "GET",
+			Path: "/", Route: []interface{}{"http://127.0.0.1:1/"}}}}}}
+	var replicas []*proxyHandler
+	for i := 0; i < 2; i++ {
+		replicapHMap := newProxyHanlderMap()
+		assignRoutes(replicapHMap, testRouteMap)
+		replicas = append(replicas, newProxyHandler(replicapHMap, nil))
+	}
+	sessionCache := tls.NewLRUClientSessionCache(4)
+	//the client goes back to when the test certificates were valid as it does
+	// not resume sessions of expired certificates
+	var certValidAt time.Time
+	resumed := func(replica *proxyHandler) bool {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go tls.Server(serverConn, &tls.Config{GetCertificate: returnCert,
+			GetConfigForClient: replica.tlsConfigForClient}).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: "ticket.test",
+			InsecureSkipVerify: true, ClientSessionCache: sessionCache,
+			Time: func() time.Time { return certValidAt }})
+		if handshakeErr := client.Handshake(); handshakeErr != nil {
+			t.Fatalf("session ticket fail: handshake failed with error: %s", handshakeErr)
+		}
+		certValidAt = client.ConnectionState().PeerCertificates[0].NotBefore.Add(time.Hour)
+		return client.ConnectionState().DidResume
+	}
+	if resumed(replicas[0]) || !resumed(replicas[1]) {
+		t.Errorf("session ticket fail: session was not resumed on the other replica")
+	}
+	//the previous key still decrypts once a new one takes over
+	sessionTicketKeys.set([][32]byte{keyOf(2), keyOf(1)})
+	if !resumed(replicas[0]) {
+		t.Errorf("session ticket fail: session was not resumed with the previous key")
+	}
+	//tickets of the previous key were renewed with the new one
+	sessionTicketKeys.set([][32]byte{keyOf(2)})
+	if !resumed(replicas[1]) {
+		t.Errorf("session ticket fail: renewed ticket was not resumed with the new key")
+	}
+	sessionTicketKeys.set([][32]byte{keyOf(3)})
+	if resumed(replicas[0]) {
+		t.Errorf("session ticket fail: session was resumed with a key no longer in use")
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "OCSP Test CA"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage:  x509.KeyUsageCertSign,
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	//the responder stand-in answers with status or fails when it is -1
+	var requests int32
+	var status int32 = ocsp.Good
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		request, parseErr := ocsp.ParseRequest(body)
+		if parseErr != nil || atomic.LoadInt32(&status) == -1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, _ := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status: int(atomic.LoadInt32(&status)), SerialNumber: request.SerialNumber,
+			ThisUpdate: time.Now(), NextUpdate: time.Now().Add(4 * time.Hour),
+			RevokedAt: time.Now()}, caKey)
+		w.Write(response)
+	}))
+	defer responder.Close()
+
+	issue := func(name string, mustStaple bool) *tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject: pkix.Name{CommonName: name}, DNSNames: []string{name},
+			OCSPServer: []string{responder.URL},
+			NotBefore:  time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+		if mustStaple {
+			feature, _ := asn1.Marshal([]int{5})
+			template.ExtraExtensions = []pkix.Extension{{Id: oidTLSFeature, Value: feature}}
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+		return &tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}
+	}
+	stapledCert := issue("ocsp.test", false)
+	mustStapleCert := issue("muststaple.test", true)
+	snapshot := &certSnapshot{certs: map[string]*tls.Certificate{
+		"ocsp.test:ECDSA": stapledCert, "muststaple.test:ECDSA": mustStapleCert},
+		sanCerts: make(map[string]*tls.Certificate), clientCerts: make(map[string]*tls.Certificate),
+		ECDSAdefault: issue("default.test", false)}
+	snapshot.indexSANs()
+
+	cacheDir, _ := ioutil.TempDir("", "test_ocsp")
+	defer os.RemoveAll(cacheDir)
+	staples := newOCSPStore(cacheDir)
+	now := time.Now()
+	if _, servable := staples.staple(mustStapleCert, now); servable {
+		t.Errorf("OCSP stapling fail: Must-Staple certificate servable without a staple")
+	}
+	if cert, servable := staples.staple(stapledCert, now); !servable || cert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: certificate without a staple not served as is")
+	}
+	staples.update(snapshot, now, false)
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Errorf("OCSP stapling fail: responses fetched without being asked to")
+	}
+	staples.update(snapshot, now, true)
+	if fetched := atomic.LoadInt32(&requests); fetched != 3 {
+		t.Errorf("OCSP stapling fail: %d responses fetched in place of 3", fetched)
+	}
+	cert, servable := staples.staple(stapledCert, now)
+	if !servable || len(cert.OCSPStaple) == 0 || stapledCert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: fetched response not stapled on a copy of the certificate")
+	}
+	if _, servable = staples.staple(mustStapleCert, now); !servable {
+		t.Errorf("OCSP stapling fail: stapled Must-Staple certificate not servable")
+	}
+
+	//responses are refreshed halfway to their nextUpdate
+	staples.update(snapshot, now.Add(time.Hour), true)
+	if fetched := atomic.LoadInt32(&requests); fetched != 3 {
+		t.Errorf("OCSP stapling fail: responses refreshed before they were due")
+	}
+	staples.update(snapshot, now.Add(2*time.Hour+time.Minute), true)
+	if fetched := atomic.LoadInt32(&requests); fetched != 6 {
+		t.Errorf("OCSP stapling fail: responses due were not refreshed")
+	}
+
+	//a restart picks the responses up from the cache
+	restarted := newOCSPStore(cacheDir)
+	restarted.update(snapshot, now, false)
+	if cert, _ = restarted.staple(stapledCert, now); len(cert.OCSPStaple) == 0 ||
+		atomic.LoadInt32(&requests) != 6 {
+		t.Errorf("OCSP stapling fail: cached response not stapled after a restart")
+	}
+
+	//a response that fails to refresh is served until it expires
+	atomic.StoreInt32(&status, -1)
+	staples.update(snapshot, now.Add(3*time.Hour), true)
+	if cert, _ = staples.staple(stapledCert, now.Add(3*time.Hour)); len(cert.OCSPStaple) == 0 {
+		t.Errorf("OCSP stapling fail: staple dropped before it expired")
+	}
+	staples.update(snapshot, now.Add(5*time.Hour), true)
+	if cert, _ = staples.staple(stapledCert, now.Add(5*time.Hour)); cert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: expired staple served")
+	}
+	if _, servable = staples.staple(mustStapleCert, now.Add(5*time.Hour)); servable {
+		t.Errorf("OCSP stapling fail: Must-Staple certificate servable with an expired staple")
+	}
+
+	//a certificate revoked after it was stapled loses its staple, cached copy
+	// included, rather than keeping it until it expires
+	atomic.StoreInt32(&status, ocsp.Good)
+	revokedLater := newOCSPStore(cacheDir)
+	revokedLater.update(snapshot, now, true)
+	atomic.StoreInt32(&status, ocsp.Revoked)
+	revokedLater.update(snapshot, now.Add(2*time.Hour+time.Minute), true)
+	if cert, _ = revokedLater.staple(stapledCert, now.Add(2*time.Hour+time.Minute)); cert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: staple kept after the certificate was revoked")
+	}
+	fromCache := newOCSPStore(cacheDir)
+	fromCache.update(snapshot, now, false)
+	if cert, _ = fromCache.staple(stapledCert, now); cert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: cached response of a revoked certificate stapled")
+	}
+
+	//revoked certificates are not stapled
+	revoked := newOCSPStore("")
+	revoked.update(snapshot, now, true)
+	if cert, _ = revoked.staple(stapledCert, now); cert.OCSPStaple != nil {
+		t.Errorf("OCSP stapling fail: revoked response stapled")
+	}
+
+	//requestors get the staple in the handshake and Must-Staple certificates
+	// without one are passed over for the default
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	certMap.publish(snapshot)
+	defer func(previous *ocspStore) { ocspStaples = previous }(ocspStaples)
+	ocspStaples = restarted
+	handshake := func(serverName string) tls.ConnectionState {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go tls.Server(serverConn, &tls.Config{GetCertificate: returnCert}).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName,
+			InsecureSkipVerify: true})
+		if handshakeErr := client.Handshake(); handshakeErr != nil {
+			t.Fatalf("OCSP stapling fail: handshake failed with error: %s", handshakeErr)
+		}
+		return client.ConnectionState()
+	}
+	if state := handshake("ocsp.test"); len(state.OCSPResponse) == 0 {
+		t.Errorf("OCSP stapling fail: no OCSP response stapled in the handshake")
+	} else if response, parseErr := ocsp.ParseResponseForCert(state.OCSPResponse,
+		state.PeerCertificates[0], caCert); parseErr != nil || response.Status != ocsp.Good {
+		t.Errorf("OCSP stapling fail: stapled response did not verify: %v", parseErr)
+	}
+	ocspStaples = staples
+	if state := handshake("muststaple.test"); state.PeerCertificates[0].Subject.CommonName !=
+		"default.test" {
+		t.Errorf("OCSP stapling fail: Must-Staple certificate served without a staple")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	newCA := func(name string) (*x509.Certificate, crypto.Signer) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1),
+			Subject: pkix.Name{CommonName: name}, IsCA: true, BasicConstraintsValid: true,
+			KeyUsage:  x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+		der, _ := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		caCert, _ := x509.ParseCertificate(der)
+		return caCert, key
+	}
+	issue := func(caCert *x509.Certificate, caKey crypto.Signer, serial int64) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(serial),
+			Subject:     pkix.Name{CommonName: fmt.Sprintf("client %d", serial)},
+			DNSNames:    []string{fmt.Sprintf("client%d.test", serial)},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			NotBefore:   time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+		der, _ := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	clientCA, clientCAKey := newCA("Client CA")
+	otherCA, otherCAKey := newCA("Other CA")
+	validCert := issue(clientCA, clientCAKey, 10)
+	revokedCert := issue(clientCA, clientCAKey, 11)
+	otherCert := issue(otherCA, otherCAKey, 12)
+
+	crlDER, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour), NextUpdate: time.Now().Add(24 * time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{{SerialNumber: big.NewInt(11),
+			RevocationTime: time.Now().Add(-time.Minute)}}}, clientCA, clientCAKey)
+	crlFile := "test_clients.crl"
+	ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600)
+	defer os.Remove(crlFile)
+
+	//the CA bundles are imported as trusted certificate entries
+	clientAuthKeyStore := "test_clientauth.keystore"
+	keyStoreBytes, _ := ioutil.ReadFile(KeyStore)
+	ioutil.WriteFile(clientAuthKeyStore, keyStoreBytes, 0600)
+	defer os.Remove(clientAuthKeyStore)
+	for name, caCert := range map[string]*x509.Certificate{"clients": clientCA, "others": otherCA} {
+		if storeErr := utility.StoreTrustedCerts(clientAuthKeyStore, name, [][]byte{caCert.Raw},
+			[]byte(KeyStorePass)); storeErr != nil {
+			t.Fatalf("StoreTrustedCerts() fail: failed with error: %s", storeErr)
+		}
+	}
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&clientAuthKeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	if bundle := certMap.snapshot().caBundles["clients"]; len(bundle) != 1 ||
+		!bundle[0].Equal(clientCA) {
+		t.Errorf("loadCertMap() fail: CA bundle \"clients\" loaded as %v", bundle)
+	}
+
+	for _, invalid := range []HostMap{
+		{ClientAuth: ClientAuth{Mode: "optional", CAs: []string{"clients"}}},
+		{ClientAuth: ClientAuth{Mode: "require"}},
+		{MethodPathMaps: []MethodPathMap{{Path: "/", ClientAuth: "require"}}},
+		{ClientAuth: ClientAuth{Mode: "require", CAs: []string{"clients"}},
+			MethodPathMaps: []MethodPathMap{{Path: "/", ClientAuth: "request"}}},
+		{ClientAuth: ClientAuth{Mode: "request", CAs: []string{"clients"},
+			CRLs: []string{"test_missing.crl"}}},
+	} {
+		if validateClientAuth(invalid) == nil {
+			t.Errorf("validateClientAuth() fail: failed to catch invalid ClientAuth %#v", invalid)
+		}
+	}
+
+	var upstreamHeader atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader.Store(r.Header.Clone())
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	route := func(path, mode string) MethodPathMap {
+		return MethodPathMap{Method: "GET", Path: path, Route: []interface{}{upstream.URL + "/"},
+			ClientAuth: mode}
+	}
+	testRouteMap := &RouteMap{Routes: []HostMap{
+		{Host: "mtls.test", ClientAuth: ClientAuth{Mode: "require", CAs: []string{"clients"},
+			CRLs: []string{crlFile}}, MethodPathMaps: []MethodPathMap{route("/", "")}},
+		{Host: "mixed.test", ClientAuth: ClientAuth{CAs: []string{"clients"},
+			Headers: ClientCertHeaders{Subject: "X-Client-Subject", SANs: "X-Client-SANs",
+				Serial: "X-Client-Serial", Fingerprint: "X-Client-Fingerprint",
+				XFCC: "X-Forwarded-Client-Cert"}},
+			MethodPathMaps: []MethodPathMap{route("/public", ""), route("/admin", "require")}},
+		{Host: "others.test", ClientAuth: ClientAuth{Mode: "request", CAs: []string{"others"}},
+			MethodPathMaps: []MethodPathMap{route("/", "")}},
+	}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testpHandler := newProxyHandler(testpHMap, nil)
+	server := httptest.NewUnstartedServer(testpHandler)
+	server.TLS = &tls.Config{GetCertificate: returnCert,
+		GetConfigForClient: testpHandler.tlsConfigForClient}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		serverName string
+		host       string
+		path       string
+		cert       *tls.Certificate
+		status     int
+	}{
+		{"mtls.test", "mtls.test", "/", nil, 0},
+		{"mtls.test", "mtls.test", "/", &validCert, http.StatusOK},
+		{"mtls.test", "mtls.test", "/", &revokedCert, 0},
+		{"mtls.test", "mtls.test", "/", &otherCert, 0},
+		{"mixed.test", "mixed.test", "/public", nil, http.StatusOK},
+		{"mixed.test", "mixed.test", "/admin", nil, http.StatusForbidden},
+		{"mixed.test", "mixed.test", "/admin", &validCert, http.StatusOK},
+		{"mixed.test", "mixed.test", "/admin", &otherCert, 0},
+		//certificates presented to another host are verified afresh
+		{"others.test", "others.test", "/", &otherCert, http.StatusOK},
+		{"others.test", "mixed.test", "/admin", &otherCert, http.StatusForbidden},
+		{"others.test", "mtls.test", "/", nil, http.StatusForbidden},
+	} {
+		tlsConfig := &tls.Config{ServerName: testCase.serverName, InsecureSkipVerify: true}
+		if testCase.cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*testCase.cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig,
+			DisableKeepAlives: true}}
+		req, _ := http.NewRequest("GET", server.URL+testCase.path, nil)
+		req.Host = testCase.host
+		resp, respErr := client.Do(req)
+		status := 0
+		if respErr == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		if status != testCase.status {
+			t.Errorf("client auth fail: %s%s over %s answered %d in place of %d (%v)",
+				testCase.host, testCase.path, testCase.serverName, status, testCase.status, respErr)
+		}
+	}
+
+	//the identity of verified certificates replaces the requestor's claims
+	forwardedHeaders := func(path string, cert *tls.Certificate) http.Header {
+		tlsConfig := &tls.Config{ServerName: "mixed.test", InsecureSkipVerify: true}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig,
+			DisableKeepAlives: true}}
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = "mixed.test"
+		for _, name := range []string{"X-Client-Subject", "X-Client-SANs", "X-Client-Serial",
+			"X-Client-Fingerprint", "X-Forwarded-Client-Cert"} {
+			req.Header.Set(name, "spoofed")
+		}
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			t.Fatalf("client cert headers fail: request failed with error: %s", respErr)
+		}
+		resp.Body.Close()
+		return upstreamHeader.Load().(http.Header)
+	}
+	header := forwardedHeaders("/admin", &validCert)
+	leaf, _ := x509.ParseCertificate(validCert.Certificate[0])
+	fingerprint := sha256.Sum256(leaf.Raw)
+	for name, expected := range map[string]string{
+		"X-Client-Subject":     "CN=client 10",
+		"X-Client-SANs":        "DNS=client10.test",
+		"X-Client-Serial":      "a",
+		"X-Client-Fingerprint": fmt.Sprintf("%x", fingerprint),
+	} {
+		if values := header.Values(name); len(values) != 1 || values[0] != expected {
+			t.Errorf("client cert headers fail: %s forwarded as %v in place of %#v", name,
+				values, expected)
+		}
+	}
+	xfcc := header.Get("X-Forwarded-Client-Cert")
+	if !strings.HasPrefix(xfcc, fmt.Sprintf("Hash=%x;Cert=\"", fingerprint)) ||
+		!strings.HasSuffix(xfcc, ";Subject=\"CN=client 10\";DNS=client10.test") {
+		t.Errorf("client cert headers fail: X-Forwarded-Client-Cert forwarded as %#v", xfcc)
+	} else {
+		encoded := strings.SplitN(strings.SplitN(xfcc, "Cert=\"", 2)[1], "\"", 2)[0]
+		certPEM, _ := url.PathUnescape(encoded)
+		if block, _ := pem.Decode([]byte(certPEM)); block == nil ||
+			!bytes.Equal(block.Bytes, leaf.Raw) {
+			t.Errorf("client cert headers fail: X-Forwarded-Client-Cert carries no PEM of the certificate")
+		}
+	}
+	header = forwardedHeaders("/public", nil)
+	for _, name := range []string{"X-Client-Subject", "X-Client-SANs", "X-Client-Serial",
+		"X-Client-Fingerprint", "X-Forwarded-Client-Cert"} {
+		if values := header.Values(name); len(values) != 0 {
+			t.Errorf("client cert headers fail: spoofed %s forwarded as %v", name, values)
+		}
+	}
+	invalidHeaders := HostMap{ClientAuth: ClientAuth{Headers: ClientCertHeaders{
+		Subject: "X-Client", Serial: "x-client"}}}
+	if validateClientAuth(invalidHeaders) == nil {
+		t.Errorf("validateClientAuth() fail: failed to catch a header named twice")
+	}
+	invalidHeaders.ClientAuth.Headers = ClientCertHeaders{XFCC: "Bad Header"}
+	if validateClientAuth(invalidHeaders) == nil {
+		t.Errorf("validateClientAuth() fail: failed to catch an invalid header name")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	previousMetrics := metrics
+	metrics = newProxyMetrics()
+	defer func() { metrics = previousMetrics }()
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	//nothing listens on the address of a closed listener
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	testRouteMap := &RouteMap{Routes: []HostMap{{Host: "localhost",
+		MethodPathMaps: []MethodPathMap{
+			{Method: "GET", Path: "/ok", Route: []interface{}{upstream.URL + "/ok"}},
+			{Method: "GET", Path: "/down", Route: []interface{}{"http://" + closed.Addr().String() + "/"}},
+		}}}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	testpHandler := newProxyHandler(testpHMap, nil)
+	server := httptest.NewUnstartedServer(testpHandler)
+	server.TLS = &tls.Config{GetCertificate: returnCert}
+	server.Config.ConnState = metrics.connState
+	server.StartTLS()
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		serverName string
+		path       string
+	}{
+		{"localhost", "/ok"},
+		{"localhost", "/ok"},
+		//a server name with no certificate is answered off the defaults
+		{"unknown.test", "/down"},
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName: testCase.serverName, InsecureSkipVerify: true}, DisableKeepAlives: true}}
+		req, _ := http.NewRequest("GET", server.URL+testCase.path, nil)
+		req.Host = "localhost"
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			t.Fatalf("metrics fail: request for %s failed with error: %s", testCase.path, respErr)
+		}
+		resp.Body.Close()
+	}
+	//requests no route answers are counted too, whether or not their host
+	// matched
+	for _, host := range []string{"localhost", "unknown.test"} {
+		testpHandler.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest("GET", "http://"+host+"/missing", nil))
+	}
+	//a handshake is counted whether or not a request follows it, and so is
+	// one given up on
+	idle, dialErr := tls.Dial("tcp", server.Listener.Addr().String(),
+		&tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if dialErr != nil {
+		t.Fatalf("metrics fail: handshake failed with error: %s", dialErr)
+	}
+	idle.Close()
+	abandoned, dialErr := net.Dial("tcp", server.Listener.Addr().String())
+	if dialErr != nil {
+		t.Fatalf("metrics fail: dial failed with error: %s", dialErr)
+	}
+	abandoned.Close()
+
+	//handshakes are counted as they finish, alongside the requests
+	var exposition string
+	handshakes := 0
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		newAdminServer("", testpHandler).Handler.ServeHTTP(recorder,
+			httptest.NewRequest("GET", "/metrics", nil))
+		exposition = recorder.Body.String()
+		handshakes = 0
+		for _, line := range strings.Split(exposition, "\n") {
+			if strings.HasPrefix(line, "sillyproxy_tls_handshakes_total{") {
+				count, _ := strconv.Atoi(line[strings.LastIndex(line, " ")+1:])
+				handshakes += count
+			}
+		}
+		if (handshakes == 4 && strings.Contains(exposition,
+			"sillyproxy_tls_handshake_failures_total{reason=\"closed\"} 1\n")) || time.Now().After(deadline) {
+			break
+		}
+	}
+	downStatus := strconv.Itoa(statusForUpstreamError(&net.OpError{Op: "dial"}))
+	for _, expected := range []string{
+		"sillyproxy_requests_total{host=\"localhost\",route=\"GET /ok\",status=\"201\"} 2\n",
+		"sillyproxy_request_duration_seconds_count{host=\"localhost\",route=\"GET /ok\",status=\"201\"} 2\n",
+		"sillyproxy_request_duration_seconds_bucket{host=\"localhost\",route=\"GET /ok\",status=\"201\",le=\"+Inf\"} 2\n",
+		"sillyproxy_requests_total{host=\"localhost\",route=\"GET /down\",status=\"" + downStatus + "\"} 1\n",
+		"sillyproxy_requests_total{host=\"localhost\",route=\"unmatched\",status=\"404\"} 1\n",
+		"sillyproxy_requests_total{host=\"unmatched\",route=\"unmatched\",status=\"403\"} 1\n",
+		"sillyproxy_requests_in_flight{host=\"localhost\"} 0\n",
+		"sillyproxy_upstream_connect_errors_total{host=\"localhost\",route=\"GET /down\"} ",
+		"sillyproxy_tls_sni_misses_total 1\n",
+		"sillyproxy_tls_handshake_failures_total{reason=\"closed\"} 1\n",
+		"sillyproxy_certificate_expiry_timestamp_seconds{alias=\"default:ECDSA\"} ",
+		"sillyproxy_certificate_expiry_timestamp_seconds{alias=\"default:RSA\"} ",
+	} {
+		if !strings.Contains(exposition, expected) {
+			t.Errorf("metrics fail: %#v missing from the exposition:\n%s", expected, exposition)
+		}
+	}
+	//every handshake served the ECDSA certificate, whatever the cipher suite
+	for _, line := range strings.Split(exposition, "\n") {
+		if strings.HasPrefix(line, "sillyproxy_tls_handshakes_total{") &&
+			(!strings.Contains(line, "version=\"1.3\"") || !strings.Contains(line, "cert_type=\"ECDSA\"")) {
+			t.Errorf("metrics fail: unexpected handshakes counted: %s", line)
+		}
+	}
+	if handshakes != 4 {
+		t.Errorf("metrics fail: %d handshakes counted in place of 4", handshakes)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	previous := certMap.snapshot()
+	defer certMap.publish(previous)
+	if loadErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("loadCertMap() fail: failed with error: %s", loadErr)
+	}
+	logDir, _ := ioutil.TempDir("", "test_accesslog")
+	defer os.RemoveAll(logDir)
+	defer closeAccessLogs()
+
+	for _, invalid := range []AccessLog{
+		{Output: "stderr"},
+		{Output: "file"},
+		{Output: "stdout", Format: "clf"},
+		{Output: "stdout", Format: "template"},
+		{Output: "stdout", Format: "template", Template: "{{.Status"},
+		{Output: "syslog", SyslogAddr: "10.0.0.1:514"},
+	} {
+		if validateAccessLog(invalid) == nil {
+			t.Errorf("validateAccessLog() fail: failed to catch invalid AccessLog %#v", invalid)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	jsonLog := filepath.Join(logDir, "json.log")
+	templateLog := filepath.Join(logDir, "template.log")
+	testRouteMap := &RouteMap{
+		AccessLog: AccessLog{Output: "file", File: jsonLog, Format: "json"},
+		Routes: []HostMap{
+			{Host: "localhost", MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/hello/:name", Route: []interface{}{upstream.URL + "/", float64(0)}}}},
+			{Host: "templated.test", AccessLog: AccessLog{Output: "file", File: templateLog,
+				Format: "template", Template: "{{.Host}} {{.Route}} {{.Status}} {{.BytesSent}}"},
+				MethodPathMaps: []MethodPathMap{
+					{Method: "GET", Path: "/", Route: []interface{}{upstream.URL + "/"}}}},
+			{Host: "quiet.test", AccessLog: AccessLog{Output: "off"}, MethodPathMaps: []MethodPathMap{
+				{Method: "GET", Path: "/", Route: []interface{}{upstream.URL + "/"}}}},
+		}}
+	if validateErr := validateRouteMap(testRouteMap); validateErr != nil {
+		t.Fatalf("validateRouteMap() fail: failed with error: %s", validateErr)
+	}
+	testpHMap := newProxyHanlderMap()
+	assignRoutes(testpHMap, testRouteMap)
+	server := httptest.NewUnstartedServer(newProxyHandler(testpHMap, nil))
+	server.TLS = &tls.Config{GetCertificate: returnCert}
+	server.StartTLS()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		ServerName: "localhost", InsecureSkipVerify: true}}}
+	for _, target := range []string{"localhost/hello/silly?x=1", "templated.test/",
+		"quiet.test/", "templated.test/missing"} {
+		host := target[:strings.Index(target, "/")]
+		req, _ := http.NewRequest("GET", server.URL+target[len(host):], nil)
+		req.Host = host
+		req.Header.Set("User-Agent", "access-log-test")
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			t.Fatalf("access log fail: request to %s failed with error: %s", host, respErr)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	jsonLines, _ := ioutil.ReadFile(jsonLog)
+	var entry map[string]interface{}
+	if unmarshalErr := json.Unmarshal(jsonLines, &entry); unmarshalErr != nil {
+		t.Fatalf("access log fail: JSON log %#v does not hold a single entry: %s", string(jsonLines),
+			unmarshalErr)
+	}
+	for field, expected := range map[string]interface{}{
+		"host": "localhost", "sni": "localhost", "tls_version": "1.3", "method": "GET",
+		"uri": "/hello/silly?x=1", "route": "GET /hello/:name", "upstream": upstream.URL + "/silly?x=1",
+		"status": float64(200), "bytes_sent": float64(5), "remote_addr": "127.0.0.1",
+		"user_agent": "access-log-test",
+	} {
+		if entry[field] != expected {
+			t.Errorf("access log fail: JSON field %s logged as %#v in place of %#v", field,
+				entry[field], expected)
+		}
+	}
+	if latency, _ := entry["upstream_latency"].(float64); latency <= 0 {
+		t.Errorf("access log fail: upstream latency logged as %#v", entry["upstream_latency"])
+	}
+	//requests no route answers are logged too
+	if templated, _ := ioutil.ReadFile(templateLog); string(templated) !=
+		"templated.test GET / 200 5\ntemplated.test unmatched 404 19\n" {
+		t.Errorf("access log fail: templated log written as %#v", string(templated))
+	}
+
+	//the Common and Combined Log Formats
+	logged := &accessLogEntry{Time: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+		RemoteAddr: "10.0.0.1", Method: "GET", URI: "/a\"b", Proto: "HTTP/1.1", Status: 404,
+		UserAgent: "curl/7.0"}
+	if line := logged.combinedLogLine(); line != "10.0.0.1 - - [02/Jan/2019:03:04:05 +0000] "+
+		"\"GET /a\\\"b HTTP/1.1\" 404 - \"-\" \"curl/7.0\"" {
+		t.Errorf("combinedLogLine() fail: rendered %s", line)
+	}
+
+	//files are rotated by size and only maxBackups of them are kept
+	rotated := newRotatingFile(filepath.Join(logDir, "rotated.log"), 10, 0, 2)
+	for i := 0; i < 5; i++ {
+		rotated.Write([]byte("line " + strconv.Itoa(i) + "\n"))
+	}
+	rotated.Close()
+	if backups := rotated.backups(); len(backups) != 2 {
+		t.Errorf("rotatingFile fail: %d backups kept in place of 2", len(backups))
+	} else if newest, _ := ioutil.ReadFile(backups[1]); string(newest) != "line 3\n" {
+		t.Errorf("rotatingFile fail: newest backup holds %#v", string(newest))
+	}
+	if current, _ := ioutil.ReadFile(rotated.path); string(current) != "line 4\n" {
+		t.Errorf("rotatingFile fail: current file holds %#v", string(current))
+	}
+	//and by time
+	rotated.configure(0, time.Hour, 0)
+	rotated.Write([]byte("line 5\n"))
+	rotated.opened = rotated.opened.Add(-2 * time.Hour)
+	rotated.Write([]byte("line 6\n"))
+	rotated.Close()
+	if backups := rotated.backups(); len(backups) != 3 {
+		t.Errorf("rotatingFile fail: %d backups after rotating by time in place of 3", len(backups))
+	}
+}
+
+func TestIsSigAlgSupported(t *testing.T) {
+
+}
+
+func TestSillyProxy(t *testing.T) {
+
+	for _, ver := range minTLSver {
+		resetParams()
+		TLSVersion := ver
+		invalidRouteMapFilePath := "invalidfilepath"
+		_, err := SillyProxy(&KeyStore, &KeyStorePass, &TLSVersion,
+			&Addr, &invalidRouteMapFilePath)
+		if err == nil {
+			t.Errorf("\nTestSillyProxy() fail: failed to catch buildRouteMap() error")
+		}
+		resetParams()
+		TLSVersion = ver
+		invalidKeyStoreFilePath := "invalidfilepath"
+		_, err = SillyProxy(&invalidKeyStoreFilePath, &KeyStorePass, &TLSVersion,
+			&Addr, &RouteMapFilePath)
+		if err == nil {
+			t.Errorf("\nTestSillyProxy() fail: failed to catch loadCertMap() error")
+		}
+		resetParams()
+		TLSVersion = ver
+		sp, spError := SillyProxy(&KeyStore, &KeyStorePass,
+			&TLSVersion, &Addr, &RouteMapFilePath)
+		if spError != nil {
+			t.Errorf("\nTestSillyProxy() fail: failed with error: %s", spError)
+		}
+		testServer := httptest.NewUnstartedServer(sp.Handler)
+		testServer.Config = sp
+		testServer.StartTLS()
+		defer testServer.Close()
+		//log.Printf("\nTest log - Test server URL:%#v", testServer.URL+"/wild/qssum/index.html")
+		testClient := &http.Client{
+			//first create a transport that is tolerant to SSL errors
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				DisableKeepAlives: false,
+			},
+			// we will not follow any redirect rather pass the instructions to
+			// the client
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			//we will declare a reasonable timeout value here. Alternatively we
+			// can look to parameterize this to fetch its value from routeMap
+			Timeout: 5 * time.Second,
+		}
+		testURIMaps := make(map[int][]string)
+		testURIMaps[200] = append(testURIMaps[200], "/google/wonderful")
+		testURIMaps[404] = append(testURIMaps[404], "/pattern/not/caught/by/proxy")
+		testURIMaps[301] = append(testURIMaps[301], "/redirect/")
+		testURIMaps[http.StatusBadGateway] = append(testURIMaps[http.StatusBadGateway], "/wild/notexistingdomain/validPathButNotExistingDownstream")
+		testURIMaps[http.StatusInternalServerError] = append(testURIMaps[http.StatusInternalServerError], "/failureCase/RoutePathIncorrect")
+		testURIMaps[http.StatusInternalServerError] = append(testURIMaps[http.StatusInternalServerError], "/invalid/")
+
+		for testStatus, testURIMap := range testURIMaps {
+			for _, testURI := range testURIMap {
+				testReq, _ := http.NewRequest(http.MethodGet, testServer.URL+testURI, nil)
+				testReq.Header.Add("Silly", "first value")
+				testReq.Header.Add("Silly", "second value")
+				testResponse, testResponseErr := testClient.Do(testReq)
+				if testResponseErr != nil {
+					t.Errorf("\nTest Request failed: %#v", testResponseErr.Error())
+				}
+				if testResponse.StatusCode != testStatus {
+					t.Errorf("\nTest Request failed for %#v: %#v", testURI, testResponse)
+				}
+				//log.Printf("\nTest log - Test Response: %#v", testResponse)
+				//log.Printf("\nTest log - Test Response Body: %#v", testResponse.Body)
+				testResponse.Body.Close()
+			}
+		}
+
+	}
+	//syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+}
+
+func TestDrainSillyProxy(t *testing.T) {
+	resetParams()
+	drainServer := func(release <-chan struct{}, started chan<- struct{}) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			io.WriteString(w, "drained")
+		}))
+	}
+	startReloads := func() (chan struct{}, chan struct{}) {
+		quitReload, quitRouteReload := make(chan struct{}), make(chan struct{})
+		go reloadCertMap(&KeyStore, []byte(KeyStorePass), certMap, quitReload, uint(60))
+		go reloadRouteMap(&RouteMapFilePath, newProxyHandler(newProxyHanlderMap(), nil),
+			nil, quitRouteReload, uint(60))
+		return quitReload, quitRouteReload
+	}
+
+	//an in-flight request completes before the certificates are purged
+	release, started := make(chan struct{}), make(chan struct{}, 1)
+	testServer := drainServer(release, started)
+	defer testServer.Close()
+	if loadErr := loadCertMap(&KeyStore, []byte(KeyStorePass), certMap); loadErr != nil {
+		t.Fatalf("drainSillyProxy() fail: loadCertMap failed with error: %s", loadErr)
+	}
+	quitReload, quitRouteReload := startReloads()
+	responses := make(chan string, 1)
+	go func() {
+		testResponse, testResponseErr := http.Get(testServer.URL)
+		if testResponseErr != nil {
+			responses <- testResponseErr.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(testResponse.Body)
+		testResponse.Body.Close()
+		responses <- string(body)
+	}()
+	<-started
+	drainErrs := make(chan error, 1)
+	go func() {
+		drainErrs <- drainSillyProxy(testServer.Config, 5*time.Second,
+			quitReload, quitRouteReload)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if certMap.snapshot().ECDSAdefault == nil {
+		t.Errorf("drainSillyProxy() fail: certificates purged before requests drained")
+	}
+	close(release)
+	if body := <-responses; body != "drained" {
+		t.Errorf("drainSillyProxy() fail: in-flight request was cut off: %#v", body)
+	}
+	if drainErr := <-drainErrs; drainErr != nil {
+		t.Errorf("drainSillyProxy() fail: failed with error: %s", drainErr)
+	}
+	if snapshot := certMap.snapshot(); snapshot.ECDSAdefault != nil || len(snapshot.certs) != 0 {
+		t.Errorf("drainSillyProxy() fail: failed to purge the certificate map")
+	}
+
+	//requests outliving the grace period are cut off and reported
+	stuck, stuckStarted := make(chan struct{}), make(chan struct{}, 1)
+	stuckServer := drainServer(stuck, stuckStarted)
+	defer stuckServer.Close()
+	defer close(stuck)
+	quitReload, quitRouteReload = startReloads()
+	go http.Get(stuckServer.URL)
+	<-stuckStarted
+	if drainSillyProxy(stuckServer.Config, 100*time.Millisecond,
+		quitReload, quitRouteReload) == nil {
+		t.Errorf("drainSillyProxy() fail: failed to report connections left undrained")
 	}
-	//syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 }
 
 func BenchmarkSillyProxy(b *testing.B) {
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChandraNarreddy/sillyproxy/utility"
+)
+
+//ticketKeyFile is a file of base64 encoded 32 byte session ticket keys, one
+// per line, the first of which encrypts new tickets while all of them decrypt.
+// Keys are taken from the keystore's "ticket:" entries when it is left blank.
+var ticketKeyFile string
+
+//ticketKeyPromotion is how old a keystore ticket key has to be before it
+// encrypts new tickets. Until then it only decrypts them, so that every
+// replica sharing the keystore has reloaded it by the time tickets encrypted
+// with the key reach them. It is twice the keystore reload interval.
+const ticketKeyPromotion = time.Hour
+
+//ticketKeyReloadInterval is how often, in seconds, the ticket keys are
+// reloaded from the key file or the last keystore snapshot
+const ticketKeyReloadInterval = 60
+
+//ticketKey is a session ticket key off the keystore along with the time its
+// entry was created
+type ticketKey struct {
+	key     [32]byte
+	created time.Time
+}
+
+//parseTicketKey decodes the PEM encoded key of a "ticket:" keystore entry
+func parseTicketKey(keyPEMBlock []byte) ([32]byte, error) {
+	var key [32]byte
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	if keyDERBlock == nil || keyDERBlock.Type != utility.TicketKeyPEMType {
+		return key, fmt.Errorf("Entry does not hold a %s PEM block", utility.TicketKeyPEMType)
+	}
+	defer zeroBytes(keyDERBlock.Bytes)
+	if len(keyDERBlock.Bytes) != len(key) {
+		return key, fmt.Errorf("Session ticket key is %d bytes long in place of %d",
+			len(keyDERBlock.Bytes), len(key))
+	}
+	copy(key[:], keyDERBlock.Bytes)
+	return key, nil
+}
+
+//orderTicketKeys returns keys in the order SetSessionTicketKeys takes them.
+// The newest key older than ticketKeyPromotion comes first as it encrypts new
+// tickets, or the oldest key if all of them are newer. The rest follow newest
+// first.
+func orderTicketKeys(keys []ticketKey, now time.Time) [][32]byte {
+	sorted := append([]ticketKey{}, keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].created.After(sorted[j].created)
+	})
+	active := len(sorted) - 1
+	for i, key := range sorted {
+		if now.Sub(key.created) >= ticketKeyPromotion {
+			active = i
+			break
+		}
+	}
+	ordered := make([][32]byte, 0, len(sorted))
+	for i, key := range sorted {
+		if i == active {
+			ordered = append([][32]byte{key.key}, ordered...)
+		} else {
+			ordered = append(ordered, key.key)
+		}
+	}
+	return ordered
+}
+
+//readTicketKeyFile reads the keys of ticketKeyFile. Blank lines and lines
+// starting with "#" are skipped.
+func readTicketKeyFile(file string) ([][32]byte, error) {
+	content, readErr := ioutil.ReadFile(file)
+	if readErr != nil {
+		return nil, fmt.Errorf("Session ticket key file %#v could not be read: %v", file, readErr)
+	}
+	defer zeroBytes(content)
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		decoded, decodeErr := base64.StdEncoding.DecodeString(text)
+		var key [32]byte
+		if decodeErr != nil || len(decoded) != len(key) {
+			zeroBytes(decoded)
+			return nil, fmt.Errorf("Line %d of session ticket key file %#v is not a base64 "+
+				"encoded 32 byte key", line, file)
+		}
+		copy(key[:], decoded)
+		zeroBytes(decoded)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Session ticket key file %#v holds no keys", file)
+	}
+	return keys, nil
+}
+
+//ticketKeySet is a set of session ticket keys along with a generation that
+// goes up whenever the set changes
+type ticketKeySet struct {
+	keys       [][32]byte
+	generation uint64
+}
+
+//ticketKeyRing holds the session ticket keys currently in use. The ring is
+// empty until keys are set, in which case crypto/tls rotates keys of its own.
+type ticketKeyRing struct {
+	current atomic.Value
+}
+
+func newTicketKeyRing() *ticketKeyRing {
+	ring := &ticketKeyRing{}
+	ring.current.Store(ticketKeySet{})
+	return ring
+}
+
+//sessionTicketKeys are the session ticket keys set on every tls.Config that
+// Silly serves requestors with
+var sessionTicketKeys = newTicketKeyRing()
+
+func (ring *ticketKeyRing) load() ticketKeySet {
+	return ring.current.Load().(ticketKeySet)
+}
+
+//set swaps keys in if they differ from the current ones. It returns whether
+// they did.
+func (ring *ticketKeyRing) set(keys [][32]byte) bool {
+	current := ring.load()
+	if len(keys) == 0 || equalTicketKeys(current.keys, keys) {
+		return false
+	}
+	ring.current.Store(ticketKeySet{keys: keys, generation: current.generation + 1})
+	return true
+}
+
+func equalTicketKeys(a, b [][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//serverTLSConfig is a tls.Config requestors are served with, kept up to date
+// with the session ticket keys of a ticketKeyRing
+type serverTLSConfig struct {
+	config     *tls.Config
+	generation uint64
+}
+
+//withTicketKeys sets the current keys of ring on the tls.Config, unless it
+// has them already, and returns it. The keys are set on each tls.Config
+// rather than the server's own as the server serves off a clone of that.
+func (serverConfig *serverTLSConfig) withTicketKeys(ring *ticketKeyRing) *tls.Config {
+	keySet := ring.load()
+	if keySet.generation != atomic.LoadUint64(&serverConfig.generation) {
+		serverConfig.config.SetSessionTicketKeys(keySet.keys)
+		atomic.StoreUint64(&serverConfig.generation, keySet.generation)
+	}
+	return serverConfig.config
+}
+
+//loadTicketKeys sets the keys of keyFile on ring, or those of the current
+// keystore snapshot of store if keyFile is blank. The ring is left as is if
+// there are no keys to set.
+func loadTicketKeys(store *certStore, keyFile string, ring *ticketKeyRing, now time.Time) error {
+	var keys [][32]byte
+	if keyFile != "" {
+		var readErr error
+		if keys, readErr = readTicketKeyFile(keyFile); readErr != nil {
+			return readErr
+		}
+	} else if snapshot := store.snapshot(); snapshot != nil {
+		keys = orderTicketKeys(snapshot.ticketKeys, now)
+	}
+	if ring.set(keys) {
+		log.Printf("Session ticket keys rotated, %d in use", len(keys))
+	}
+	return nil
+}
+
+//reloadTicketKeys reloads the session ticket keys once every n seconds so
+// that new keys are picked up and promoted on time
+func reloadTicketKeys(store *certStore, keyFile string, ring *ticketKeyRing,
+	quit <-chan struct{}, n uint) {
+	ticker := time.NewTicker(time.Duration(n) * time.Second)
+	for {
+		select {
+		case <-quit:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if loadErr := loadTicketKeys(store, keyFile, ring, time.Now()); loadErr != nil {
+				log.Printf("Session ticket key reload failed with error: %v", loadErr)
+			}
+		}
+	}
+}
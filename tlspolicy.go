@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+//TLSPolicy governs the TLS connections requestors make to Silly. The policy
+// of the routes file applies to every host and a host's own policy refines it.
+// Preset names a base policy, "modern", "intermediate" or "legacy", that the
+// other fields override. MinVersion and MaxVersion are "1.0" through "1.3";
+// MinVersion falls back to -minTLSver when left blank. CipherSuites are the
+// TLS 1.2 and earlier suites allowed, by their IANA names, as TLS 1.3 suites
+// are not configurable. Curves are the key exchange curves in order of
+// preference: "X25519", "P256", "P384" and "P521". DisableSessionTickets turns
+// session resumption off. ALPN lists the protocols offered to requestors,
+// "h2" and/or "http/1.1".
+type TLSPolicy struct {
+	Preset                string
+	MinVersion            string
+	MaxVersion            string
+	CipherSuites          []string
+	Curves                []string
+	DisableSessionTickets bool
+	ALPN                  []string
+}
+
+//tlsPresets are the named base policies, after Mozilla's server side TLS
+// recommendations
+var tlsPresets = map[string]TLSPolicy{
+	"modern": {
+		MinVersion: "1.3",
+		Curves:     []string{"X25519", "P256", "P384"},
+	},
+	"intermediate": {
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves: []string{"X25519", "P256", "P384"},
+	},
+	"legacy": {
+		MinVersion: "1.0",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_3DES_EDE_CBC_SHA"},
+		Curves: []string{"X25519", "P256", "P384", "P521"},
+	},
+}
+
+//tlsVersions maps the versions of a TLSPolicy onto crypto/tls's
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//tlsCurves maps the curves of a TLSPolicy onto crypto/tls's
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+//defaultALPN is offered when a policy lists no ALPN protocols
+var defaultALPN = []string{"h2", "http/1.1"}
+
+//withPreset fills the fields the policy leaves blank off its Preset
+func (policy TLSPolicy) withPreset() TLSPolicy {
+	return policy.over(tlsPresets[policy.Preset])
+}
+
+//over returns policy with the fields it leaves blank taken from base. Session
+// tickets stay disabled if either disables them.
+func (policy TLSPolicy) over(base TLSPolicy) TLSPolicy {
+	if policy.MinVersion == "" {
+		policy.MinVersion = base.MinVersion
+	}
+	if policy.MaxVersion == "" {
+		policy.MaxVersion = base.MaxVersion
+	}
+	if len(policy.CipherSuites) == 0 {
+		policy.CipherSuites = base.CipherSuites
+	}
+	if len(policy.Curves) == 0 {
+		policy.Curves = base.Curves
+	}
+	if len(policy.ALPN) == 0 {
+		policy.ALPN = base.ALPN
+	}
+	policy.DisableSessionTickets = policy.DisableSessionTickets || base.DisableSessionTickets
+	return policy
+}
+
+//resolveTLSPolicy returns the policy a host ends up with. A host naming a
+// Preset of its own starts over from that preset, any other builds on the
+// global policy. Session tickets disabled globally stay disabled either way.
+func resolveTLSPolicy(global, host TLSPolicy) TLSPolicy {
+	if host.Preset != "" {
+		host = host.withPreset()
+		host.DisableSessionTickets = host.DisableSessionTickets || global.DisableSessionTickets
+		return host
+	}
+	return host.over(global.withPreset())
+}
+
+//cipherSuitesByName maps the names of the cipher suites crypto/tls implements
+// for TLS 1.2 and earlier onto them
+func cipherSuitesByName() map[string]*tls.CipherSuite {
+	byName := make(map[string]*tls.CipherSuite)
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			for _, version := range suite.SupportedVersions {
+				if version < tls.VersionTLS13 {
+					byName[suite.Name] = suite
+					break
+				}
+			}
+		}
+	}
+	return byName
+}
+
+//validateTLSPolicy checks a resolved policy
+func validateTLSPolicy(policy TLSPolicy) error {
+	if _, exists := tlsPresets[policy.Preset]; !exists && policy.Preset != "" {
+		return fmt.Errorf("Preset %#v is neither \"modern\", \"intermediate\" nor \"legacy\"",
+			policy.Preset)
+	}
+	minVersion, maxVersion := minVersionTLS, uint16(tls.VersionTLS13)
+	if policy.MinVersion != "" {
+		version, exists := tlsVersions[policy.MinVersion]
+		if !exists {
+			return fmt.Errorf("MinVersion %#v is not one of \"1.0\" to \"1.3\"", policy.MinVersion)
+		}
+		minVersion = version
+	}
+	if policy.MaxVersion != "" {
+		version, exists := tlsVersions[policy.MaxVersion]
+		if !exists {
+			return fmt.Errorf("MaxVersion %#v is not one of \"1.0\" to \"1.3\"", policy.MaxVersion)
+		}
+		maxVersion = version
+	}
+	if minVersion > maxVersion {
+		return fmt.Errorf("MinVersion is above MaxVersion")
+	}
+	byName := cipherSuitesByName()
+	usable := len(policy.CipherSuites) == 0 || maxVersion == tls.VersionTLS13
+	for _, name := range policy.CipherSuites {
+		suite, exists := byName[name]
+		if !exists {
+			return fmt.Errorf("CipherSuite %#v is not a TLS 1.2 or earlier suite Silly supports",
+				name)
+		}
+		for _, version := range suite.SupportedVersions {
+			usable = usable || version >= minVersion && version <= maxVersion
+		}
+	}
+	if len(policy.CipherSuites) > 0 && minVersion == tls.VersionTLS13 {
+		return fmt.Errorf("CipherSuites are set but only TLS 1.3 is allowed, whose suites " +
+			"are not configurable")
+	}
+	if !usable {
+		return fmt.Errorf("None of the CipherSuites can be used with the versions allowed")
+	}
+	for _, curve := range policy.Curves {
+		if _, exists := tlsCurves[curve]; !exists {
+			return fmt.Errorf("Curve %#v is not one of \"X25519\", \"P256\", \"P384\" or \"P521\"",
+				curve)
+		}
+	}
+	for _, protocol := range policy.ALPN {
+		if protocol != "h2" && protocol != "http/1.1" {
+			return fmt.Errorf("ALPN protocol %#v is neither \"h2\" nor \"http/1.1\"", protocol)
+		}
+	}
+	return nil
+}
+
+//newServerTLSConfig builds the tls.Config a resolved policy stands for.
+// Session ticket keys are set on it as they rotate, see serverTLSConfig.
+func newServerTLSConfig(policy TLSPolicy) (*tls.Config, error) {
+	if validateErr := validateTLSPolicy(policy); validateErr != nil {
+		return nil, validateErr
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:             minVersionTLS,
+		GetCertificate:         returnCert,
+		SessionTicketsDisabled: policy.DisableSessionTickets,
+	}
+	if policy.MinVersion != "" {
+		tlsConfig.MinVersion = tlsVersions[policy.MinVersion]
+	}
+	if policy.MaxVersion != "" {
+		tlsConfig.MaxVersion = tlsVersions[policy.MaxVersion]
+	}
+	byName := cipherSuitesByName()
+	for _, name := range policy.CipherSuites {
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, byName[name].ID)
+	}
+	for _, curve := range policy.Curves {
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, tlsCurves[curve])
+	}
+	//the server adds h2 and http/1.1 to its own tls.Config only, so they are
+	// offered here. TLS-ALPN-01 challenges are answered whatever the policy.
+	alpn := policy.ALPN
+	if len(alpn) == 0 {
+		alpn = defaultALPN
+	}
+	tlsConfig.NextProtos = append(append([]string{}, alpn...), acmeALPNProto)
+	return tlsConfig, nil
+}
+
+//tlsConfigForClient returns the tls.Config of the host hello asks for, the
+// global one if the host has no policy of its own. ACME servers validating a
+// TLS-ALPN-01 challenge get the global one too as they present no client
+// certificate.
+func (pHandler *proxyHandler) tlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	pHMap := pHandler.load()
+	_, isChallenge := alpnChallengeCert(hello)
+	if host, isHost := pHMap.lookup(hello.ServerName).(*hostHandler); isHost &&
+		host.tlsConfig != nil && !isChallenge {
+		return host.tlsConfig.withTicketKeys(sessionTicketKeys), nil
+	}
+	if pHMap.tlsConfig == nil {
+		return nil, nil
+	}
+	return pHMap.tlsConfig.withTicketKeys(sessionTicketKeys), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//UpgradePolicy governs requests to a route asking to switch protocols, such
+// as WebSocket handshakes. Upgrades are tunnelled to the downstream unless
+// Disabled is set, in which case the Upgrade is dropped and the request is
+// proxied as a plain one. Protocols limits the protocols that may be switched
+// to, "websocket" for instance; any protocol is allowed if left empty. An
+// upgraded connection that sees no traffic in either direction for
+// IdleTimeout seconds is closed.
+type UpgradePolicy struct {
+	Disabled    bool
+	Protocols   []string
+	IdleTimeout uint
+}
+
+//defaultUpgradeIdleTimeout applies when IdleTimeout is left at 0
+const defaultUpgradeIdleTimeout = 300
+
+func (policy UpgradePolicy) withDefaults() UpgradePolicy {
+	if policy.IdleTimeout == 0 {
+		policy.IdleTimeout = defaultUpgradeIdleTimeout
+	}
+	return policy
+}
+
+//upgradeProtocol returns the protocol r asks to be upgraded to or blank if r
+// is not an upgrade request
+func upgradeProtocol(r *http.Request) string {
+	if !headerHasToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get("Upgrade"))
+}
+
+//allows reports whether the policy lets a connection switch to protocol
+func (policy UpgradePolicy) allows(protocol string) bool {
+	if policy.Disabled || protocol == "" {
+		return false
+	}
+	if len(policy.Protocols) == 0 {
+		return true
+	}
+	for _, allowed := range policy.Protocols {
+		if strings.EqualFold(allowed, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+//upgradeLimiter caps the upgraded connections a host keeps open at a time.
+// A limit of 0 leaves them uncapped.
+type upgradeLimiter struct {
+	limit int64
+	open  int64
+}
+
+func newUpgradeLimiter(limit uint) *upgradeLimiter {
+	return &upgradeLimiter{limit: int64(limit)}
+}
+
+//acquire takes a slot for an upgraded connection. It returns false if the
+// host is at its limit.
+func (limiter *upgradeLimiter) acquire() bool {
+	if open := atomic.AddInt64(&limiter.open, 1); limiter.limit > 0 && open > limiter.limit {
+		atomic.AddInt64(&limiter.open, -1)
+		return false
+	}
+	return true
+}
+
+func (limiter *upgradeLimiter) release() {
+	atomic.AddInt64(&limiter.open, -1)
+}
+
+//proxyUpgrade relays the downstream's 101 response to the requestor and then
+// tunnels bytes both ways between the requestor's hijacked connection and the
+// downstream until either side closes or the tunnel idles for idleTimeout.
+func proxyUpgrade(w http.ResponseWriter, resp *http.Response, idleTimeout time.Duration) error {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return fmt.Errorf("Switched connection to the downstream is not writable")
+	}
+	defer backConn.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("Connection to the requestor cannot be hijacked")
+	}
+	clientConn, clientBuf, hijackErr := hijacker.Hijack()
+	if hijackErr != nil {
+		return fmt.Errorf("Connection to the requestor could not be hijacked: %v", hijackErr)
+	}
+	defer clientConn.Close()
+	//the deadlines the server set for the request may outlast the hijack; the
+	// tunnel's idle timeout alone bounds it from here on
+	clientConn.SetDeadline(time.Time{})
+
+	//only the headers switching the protocol survive of the hop-by-hop ones
+	protocol := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if flushErr := clientBuf.Flush(); flushErr != nil {
+		return fmt.Errorf("Switching protocols could not be relayed: %v", flushErr)
+	}
+
+	tunnel := newUpgradeTunnel(idleTimeout, clientConn, backConn)
+	defer tunnel.stop()
+	errs := make(chan error, 2)
+	go tunnel.copy(backConn, clientBuf.Reader, errs)
+	go tunnel.copy(clientConn, backConn, errs)
+	//either side closing ends the tunnel; closing both unblocks the other copy
+	firstErr := <-errs
+	clientConn.Close()
+	backConn.Close()
+	<-errs
+	if tunnel.idled() {
+		return nil
+	}
+	return firstErr
+}
+
+//upgradeTunnel closes the connections it tunnels between once neither
+// carries traffic for idleTimeout
+type upgradeTunnel struct {
+	lastActivity int64
+	idleTimeout  time.Duration
+	closers      []io.Closer
+	timer        *time.Timer
+	mutex        sync.Mutex
+	idle         bool
+}
+
+func newUpgradeTunnel(idleTimeout time.Duration, closers ...io.Closer) *upgradeTunnel {
+	tunnel := &upgradeTunnel{idleTimeout: idleTimeout, closers: closers,
+		lastActivity: time.Now().UnixNano()}
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.timer = time.AfterFunc(idleTimeout, tunnel.checkIdle)
+	return tunnel
+}
+
+//checkIdle closes the tunnel if it idled since the last check or re-arms the
+// timer for the remainder
+func (tunnel *upgradeTunnel) checkIdle() {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&tunnel.lastActivity)))
+	if idleFor < tunnel.idleTimeout {
+		tunnel.timer.Reset(tunnel.idleTimeout - idleFor)
+		return
+	}
+	tunnel.idle = true
+	for _, closer := range tunnel.closers {
+		closer.Close()
+	}
+}
+
+func (tunnel *upgradeTunnel) idled() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.idle
+}
+
+func (tunnel *upgradeTunnel) stop() {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.timer.Stop()
+}
+
+//copy copies src to dst, marking the tunnel active on every write
+func (tunnel *upgradeTunnel) copy(dst io.Writer, src io.Reader, errs chan<- error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&tunnel.lastActivity, time.Now().UnixNano())
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				errs <- writeErr
+				return
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF || isClosedConnError(readErr) {
+				readErr = nil
+			}
+			errs <- readErr
+			return
+		}
+	}
+}
+
+//isClosedConnError reports whether err comes of using a closed connection
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+//protocols a route can speak to its downstream. HTTP/1.1 is the default,
+// "h2" is HTTP/2 over TLS and "h2c" HTTP/2 over cleartext with prior knowledge.
+const (
+	protocolHTTP1 = "http1"
+	protocolH2    = "h2"
+	protocolH2C   = "h2c"
+)
+
+func validateProtocol(protocol string) error {
+	switch protocol {
+	case "", protocolHTTP1, protocolH2, protocolH2C:
+		return nil
+	}
+	return fmt.Errorf("Unknown Protocol %#v", protocol)
+}
+
+//configureProtocol sets transport up to speak protocol to downstreams and
+// returns the RoundTripper to send requests through. Timeouts and TLS
+// settings of transport carry over to HTTP/2.
+func configureProtocol(transport *http.Transport, dialer *net.Dialer,
+	protocol string) (http.RoundTripper, error) {
+	switch protocol {
+	case protocolH2:
+		//downstreams that do not agree on h2 are refused rather than
+		// silently spoken to over HTTP/1.1
+		tlsConfig := transport.TLSClientConfig.Clone()
+		verifyConnection := tlsConfig.VerifyConnection
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if state.NegotiatedProtocol != http2.NextProtoTLS {
+				return fmt.Errorf("Downstream did not negotiate h2")
+			}
+			if verifyConnection != nil {
+				return verifyConnection(state)
+			}
+			return nil
+		}
+		transport.TLSClientConfig = tlsConfig
+		if _, configureErr := http2.ConfigureTransports(transport); configureErr != nil {
+			return nil, configureErr
+		}
+		return transport, nil
+	case protocolH2C:
+		h2Transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string,
+				_ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+		//a standalone http2.Transport knows no ResponseHeaderTimeout
+		return &responseHeaderTimeoutTransport{h2Transport,
+			transport.ResponseHeaderTimeout}, nil
+	}
+	return transport, nil
+}
+
+//responseHeaderTimeoutTransport fails requests whose response header does not
+// arrive within timeout
+type responseHeaderTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+//errResponseHeaderTimeout is a net.Error so that it is reported as a timeout
+type errResponseHeaderTimeout struct{}
+
+func (errResponseHeaderTimeout) Error() string   { return "timeout awaiting response headers" }
+func (errResponseHeaderTimeout) Timeout() bool   { return true }
+func (errResponseHeaderTimeout) Temporary() bool { return true }
+
+func (rt *responseHeaderTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.timeout <= 0 {
+		return rt.transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(rt.timeout, cancel)
+	resp, err := rt.transport.RoundTrip(req.WithContext(ctx))
+	//a timer that already fired has cancelled the request, even if the
+	// response header made it in the meantime
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errResponseHeaderTimeout{}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{resp.Body, cancel}
+	return resp, nil
+}
+
+//cancelOnCloseBody releases the context of its request once closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+//gRPC status codes Silly answers failed gRPC requests with
+const (
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+)
+
+//isGRPCRequest reports whether r is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+//grpcStatusFor maps the HTTP status of a failure onto the gRPC status code
+// a gRPC client understands
+func grpcStatusFor(status int) int {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return grpcPermissionDenied
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return grpcUnimplemented
+	}
+	return grpcInternal
+}
+
+//writeGRPCError answers a gRPC call with a trailers-only response carrying
+// the gRPC equivalent of status. gRPC clients expect HTTP 200 and read the
+// outcome off grpc-status.
+func writeGRPCError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	contentType := r.Header.Get("Content-Type")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusFor(status)))
+	//grpc-message is percent encoded as per the gRPC HTTP/2 protocol
+	w.Header().Set("Grpc-Message", strings.Replace(url.QueryEscape(message), "+", "%20", -1))
+	w.WriteHeader(http.StatusOK)
+}
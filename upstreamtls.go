@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/ChandraNarreddy/sillyproxy/utility"
+)
+
+//UpstreamTLS configures the TLS connections Silly makes to downstreams.
+// Certificates are verified against the system roots unless CABundle names a
+// PEM file of CAs to trust instead. ServerName overrides the name sent as SNI
+// and verified against the certificate. PinnedSPKI lists base64 encoded
+// SHA-256 hashes of SubjectPublicKeyInfos; when set, one of the certificates
+// presented must match one of them. ClientCert names the keystore entry
+// imported under the "client:" alias namespace that is presented to
+// downstreams asking for a client certificate.
+type UpstreamTLS struct {
+	InsecureSkipVerify bool
+	CABundle           string
+	ServerName         string
+	PinnedSPKI         []string
+	ClientCert         string
+}
+
+//newUpstreamTLSConfig builds the tls.Config for connections to downstreams
+// from config. Client certificates are looked up in store on each handshake
+// so that keystore reloads are picked up.
+func newUpstreamTLSConfig(config UpstreamTLS, store *certStore) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         config.ServerName,
+	}
+	if config.CABundle != "" {
+		bundle, readErr := ioutil.ReadFile(config.CABundle)
+		if readErr != nil {
+			return nil, fmt.Errorf("CABundle %#v could not be read: %v", config.CABundle, readErr)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("CABundle %#v holds no PEM certificates", config.CABundle)
+		}
+	}
+	if len(config.PinnedSPKI) > 0 {
+		var pins [][]byte
+		for _, pin := range config.PinnedSPKI {
+			hash, decodeErr := base64.StdEncoding.DecodeString(pin)
+			if decodeErr != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("PinnedSPKI %#v is not a base64 encoded SHA-256 hash", pin)
+			}
+			pins = append(pins, hash)
+		}
+		//VerifyConnection runs after the chain is verified, or in its place
+		// when InsecureSkipVerify is set
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(hash[:], pin) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("No certificate presented by %s matches a pinned SPKI",
+				state.ServerName)
+		}
+	}
+	if config.ClientCert != "" {
+		name := config.ClientCert
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if snapshot := store.snapshot(); snapshot != nil {
+				if cert, exists := snapshot.clientCerts[name]; exists {
+					return cert, nil
+				}
+			}
+			//an empty certificate lets the downstream decide whether to carry on
+			log.Printf("Client certificate %#v is not in the keystore", name)
+			return &tls.Certificate{}, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+//upstreamTLSFor returns the UpstreamTLS that applies to methodPathMap, its
+// own if set or else the one of its host
+func upstreamTLSFor(hostMap HostMap, methodPathMap MethodPathMap) UpstreamTLS {
+	if methodPathMap.UpstreamTLS != nil {
+		return *methodPathMap.UpstreamTLS
+	}
+	return hostMap.UpstreamTLS
+}
+
+//clientCertName returns the name a "client:" namespaced keystore alias such as
+// "client:billing:ECDSA" is referred to by in UpstreamTLS, "billing" here
+func clientCertName(alias string) (string, bool) {
+	if !strings.HasPrefix(alias, utility.ClientCertAliasPrefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(alias, utility.ClientCertAliasPrefix)
+	if separator := strings.LastIndex(name, ":"); separator > 0 {
+		name = name[:separator]
+	}
+	return name, true
+}
@@ -3,15 +3,22 @@ package utility
 import (
 	"bufio"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -20,6 +27,21 @@ import (
 
 const (
 	defaultHostname = "default"
+	// ClientCertAliasPrefix namespaces the aliases of client certificates that
+	// SillyProxy presents to downstreams. These are imported with a hostname of
+	// "client:name" and never stand in as the default certificate.
+	ClientCertAliasPrefix = "client:"
+	// TicketKeyAliasPrefix namespaces the session ticket keys that SillyProxy
+	// replicas sharing the keystore encrypt session tickets with. Their entries
+	// hold a PEM block of TicketKeyPEMType and no certificate.
+	TicketKeyAliasPrefix = "ticket:"
+	// TicketKeyPEMType is the PEM block type of session ticket keys
+	TicketKeyPEMType = "SESSION TICKET KEY"
+	// TrustedCertAliasPrefix namespaces the trusted certificate entries of the
+	// CA bundles that client certificates are verified against. The
+	// certificates of a bundle named "name" are stored as "ca:name:0",
+	// "ca:name:1" and so on.
+	TrustedCertAliasPrefix = "ca:"
 )
 
 // GenerateKeyStore generates the keyStore and saves it to disk. It requires
@@ -64,6 +86,7 @@ func GenerateKeyStore(keyStoreFile *string, hostname *string,
 		*hostname = defaultHostname
 	}
 
+	isClientCert := strings.HasPrefix(*hostname, ClientCertAliasPrefix)
 	keyStorePassBytes := []byte(*keyStorePass)
 
 	// zeroing out the password and its bytes
@@ -97,8 +120,11 @@ func GenerateKeyStore(keyStoreFile *string, hostname *string,
 	case *ecdsa.PublicKey:
 		alias = *hostname + ":ECDSA"
 		certType = "ECDSA"
+	case ed25519.PublicKey:
+		alias = *hostname + ":Ed25519"
+		certType = "Ed25519"
 	default:
-		log.Fatal(errors.New("unsupported public key algorithm"))
+		return fmt.Errorf("Unsupported public key algorithm %v", x509Cert.PublicKeyAlgorithm)
 	}
 
 	// check if the keystore already exists at the location
@@ -127,9 +153,10 @@ func GenerateKeyStore(keyStoreFile *string, hostname *string,
 			}
 		}
 
-		if !(*hostname == defaultHostname) &&
+		if !(*hostname == defaultHostname) && !isClientCert &&
 			!aliasExists(&keyStore, "default:RSA") &&
-			!aliasExists(&keyStore, "default:ECDSA") {
+			!aliasExists(&keyStore, "default:ECDSA") &&
+			!aliasExists(&keyStore, "default:Ed25519") {
 			// Throw a warning to the user that the keystore does not yet have a "default"
 			// alias cert and whether she would like to import the current cert as "default"
 			reader := bufio.NewReader(os.Stdin)
@@ -145,7 +172,7 @@ func GenerateKeyStore(keyStoreFile *string, hostname *string,
 					"one cert type with default alias", alias)
 			}
 		}
-	} else if !(*hostname == defaultHostname) {
+	} else if !(*hostname == defaultHostname) && !isClientCert {
 		//We know that the keystore does not exist yet. But the alias provided
 		// is not "default". Warn the user that a default cert is absolutely
 		//necessary for SillyProxy to fire up.
@@ -183,6 +210,187 @@ func GenerateKeyStore(keyStoreFile *string, hostname *string,
 	return nil
 }
 
+// StoreKeyPair writes the PEM encoded private key and its DER encoded
+// certificate chain into the keystore under alias, creating the keystore if
+// it does not exist yet. Unlike GenerateKeyStore it never prompts, an existing
+// entry under alias is overwritten. The keystore file is replaced in one go
+// so that a SillyProxy reloading it never reads it half written.
+func StoreKeyPair(keyStoreFile string, alias string, keyPEMBlock []byte,
+	certChain [][]byte, keyStorePass []byte) error {
+	keyStore := keystore.New(keystore.WithCaseExactAliases())
+	defer clearOut(&keyStore)
+	mode, openErr := openKeyStore(keyStoreFile, keyStorePass, &keyStore)
+	if openErr != nil {
+		return openErr
+	}
+	chain := make([]keystore.Certificate, len(certChain))
+	for i := range certChain {
+		chain[i].Content = certChain[i]
+		chain[i].Type = fmt.Sprintf("%dth Certificate in %s", i, alias)
+	}
+	setErr := keyStore.SetPrivateKeyEntry(alias, keystore.PrivateKeyEntry{
+		CreationTime:     time.Now(),
+		PrivateKey:       keyPEMBlock,
+		CertificateChain: chain,
+	}, keyStorePass)
+	if setErr != nil {
+		return setErr
+	}
+	return replaceKeyStore(&keyStore, keyStoreFile, mode, keyStorePass)
+}
+
+// AddTicketKey generates a session ticket key into the keystore, creating the
+// keystore if it does not exist yet, and deletes all but the newest keep
+// ticket keys. SillyProxy replicas sharing the keystore pick the new key up
+// when they next reload it and start encrypting tickets with it an hour
+// after it was added.
+func AddTicketKey(keyStoreFile string, keyStorePass []byte, keep int) error {
+	if keyStoreFile == "" {
+		return fmt.Errorf("keyStore not provided. Please use -keystore flag")
+	}
+	if keep < 2 {
+		return fmt.Errorf("At least 2 ticket keys must be kept so that tickets " +
+			"encrypted with the previous key can still be resumed")
+	}
+	keyStore := keystore.New(keystore.WithCaseExactAliases())
+	defer clearOut(&keyStore)
+	mode, openErr := openKeyStore(keyStoreFile, keyStorePass, &keyStore)
+	if openErr != nil {
+		return openErr
+	}
+	key := make([]byte, 32)
+	defer zeroBytes(key)
+	if _, randErr := rand.Read(key); randErr != nil {
+		return randErr
+	}
+	keyPEMBlock := pem.EncodeToMemory(&pem.Block{Type: TicketKeyPEMType, Bytes: key})
+	defer zeroBytes(keyPEMBlock)
+	now := time.Now()
+	setErr := keyStore.SetPrivateKeyEntry(TicketKeyAliasPrefix+strconv.FormatInt(now.UnixNano(), 10),
+		keystore.PrivateKeyEntry{CreationTime: now, PrivateKey: keyPEMBlock}, keyStorePass)
+	if setErr != nil {
+		return setErr
+	}
+	//the aliases carry the time the keys were added, newest sort last
+	var ticketAliases []string
+	for _, alias := range keyStore.Aliases() {
+		if strings.HasPrefix(alias, TicketKeyAliasPrefix) {
+			ticketAliases = append(ticketAliases, alias)
+		}
+	}
+	sort.Slice(ticketAliases, func(i, j int) bool {
+		return len(ticketAliases[i]) < len(ticketAliases[j]) ||
+			len(ticketAliases[i]) == len(ticketAliases[j]) && ticketAliases[i] < ticketAliases[j]
+	})
+	for len(ticketAliases) > keep {
+		keyStore.DeleteEntry(ticketAliases[0])
+		ticketAliases = ticketAliases[1:]
+	}
+	return replaceKeyStore(&keyStore, keyStoreFile, mode, keyStorePass)
+}
+
+// ImportCABundle reads the PEM encoded certificates of pemCertFile and writes
+// them into the keystore as the CA bundle name, see StoreTrustedCerts
+func ImportCABundle(keyStoreFile string, name string, pemCertFile string,
+	keyStorePass []byte) error {
+	if keyStoreFile == "" {
+		return fmt.Errorf("keyStore not provided. Please use -keystore flag")
+	}
+	if pemCertFile == "" {
+		return fmt.Errorf("pemCert flag not set. Please use -pemCert to set it")
+	}
+	content, readErr := ioutil.ReadFile(pemCertFile)
+	if readErr != nil {
+		return fmt.Errorf("Pem file loading failed with the error:%v", readErr)
+	}
+	var certs [][]byte
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	return StoreTrustedCerts(keyStoreFile, name, certs, keyStorePass)
+}
+
+// StoreTrustedCerts writes the DER encoded certificates of a CA bundle into
+// the keystore as trusted certificate entries under the bundle's name,
+// creating the keystore if it does not exist yet. The bundle previously
+// stored under the name is replaced whole.
+func StoreTrustedCerts(keyStoreFile string, name string, certs [][]byte,
+	keyStorePass []byte) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("CA bundle name %#v must be set and free of \":\"", name)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("CA bundle %s holds no certificates", name)
+	}
+	for _, cert := range certs {
+		if _, parseErr := x509.ParseCertificate(cert); parseErr != nil {
+			return fmt.Errorf("CA bundle %s holds an invalid certificate: %v", name, parseErr)
+		}
+	}
+	keyStore := keystore.New(keystore.WithCaseExactAliases())
+	defer clearOut(&keyStore)
+	mode, openErr := openKeyStore(keyStoreFile, keyStorePass, &keyStore)
+	if openErr != nil {
+		return openErr
+	}
+	prefix := TrustedCertAliasPrefix + name + ":"
+	for _, alias := range keyStore.Aliases() {
+		if strings.HasPrefix(alias, prefix) {
+			keyStore.DeleteEntry(alias)
+		}
+	}
+	now := time.Now()
+	for i, cert := range certs {
+		setErr := keyStore.SetTrustedCertificateEntry(prefix+strconv.Itoa(i),
+			keystore.TrustedCertificateEntry{CreationTime: now,
+				Certificate: keystore.Certificate{Type: "X509", Content: cert}})
+		if setErr != nil {
+			return setErr
+		}
+	}
+	return replaceKeyStore(&keyStore, keyStoreFile, mode, keyStorePass)
+}
+
+// openKeyStore loads the keystore at keyStoreFile into keyStore if it exists
+// and returns the file mode to write it back with, 0600 for a new keystore
+func openKeyStore(keyStoreFile string, keyStorePass []byte,
+	keyStore *keystore.KeyStore) (os.FileMode, error) {
+	info, statErr := os.Stat(keyStoreFile)
+	if statErr != nil {
+		return 0600, nil
+	}
+	if loadKSErr := loadKeyStore(keyStoreFile, keyStorePass, keyStore); loadKSErr != nil {
+		return 0, loadKSErr
+	}
+	return info.Mode().Perm(), nil
+}
+
+// replaceKeyStore writes keyStore to a temporary file next to keyStoreFile
+// and renames it over keyStoreFile so that a SillyProxy reloading it never
+// reads it half written
+func replaceKeyStore(keyStore *keystore.KeyStore, keyStoreFile string, mode os.FileMode,
+	keyStorePass []byte) error {
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(keyStoreFile),
+		filepath.Base(keyStoreFile)+".tmp")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(tempFile.Name())
+	storeErr := keyStore.Store(tempFile, keyStorePass)
+	if closeErr := tempFile.Close(); storeErr == nil {
+		storeErr = closeErr
+	}
+	if storeErr != nil {
+		return fmt.Errorf("KeyStore writing failed with error: %v", storeErr)
+	}
+	if chmodErr := os.Chmod(tempFile.Name(), mode); chmodErr != nil {
+		return chmodErr
+	}
+	return os.Rename(tempFile.Name(), keyStoreFile)
+}
+
 func zeroBytes(s []byte) {
 	for i := 0; i < len(s); i++ {
 		s[i] = 0